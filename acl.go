@@ -0,0 +1,41 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// blocked report if the request to host and path must be rejected because
+// it matches the deny-list or, when the allow-list is set, it doesn't match
+// the allow-list
+func blocked(host, path string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if e, ok := denyList.Match(host, path); ok {
+		log.Warnf("blocking request to %s%s: deny-list entry %s", host, path, e)
+		return true
+	}
+
+	if len(allowList) == 0 {
+		return false
+	}
+	if _, ok := allowList.Match(host, path); !ok {
+		log.Warnf("blocking request to %s%s: not in the allow-list", host, path)
+		return true
+	}
+
+	return false
+}
+
+// reject answers a blocked request with 403
+func reject(w http.ResponseWriter) {
+	http.Error(w, "blocked by floki proxy", http.StatusForbidden)
+}
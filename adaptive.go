@@ -0,0 +1,82 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/meox/floki-proxy/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// adaptiveGain is the fraction of the gap between the target and the
+// observed error rate corrected at every step
+const adaptiveGain = 0.5
+
+// adaptiveRule is the rule of -failure-rate when -target-error-rate is set
+var adaptiveRule *types.Rule
+
+// adaptiveController adjusts the probability of a rule so that the error
+// rate observed by the clients, injected faults and upstream errors alike,
+// approaches the target. It counts the requests as a metrics sink
+type adaptiveController struct {
+	target   float64
+	rule     *types.Rule
+	requests uint64
+	errors   uint64
+	m        sync.Mutex
+}
+
+func newAdaptiveController(target float64, rule *types.Rule) *adaptiveController {
+	return &adaptiveController{target: target, rule: rule}
+}
+
+// clientError report if the client sees the request as failed: a server
+// error, the failure code or a broken response
+func clientError(status int) bool {
+	return status == 0 || status >= 500 || status == failureCode
+}
+
+func (c *adaptiveController) request(rr requestRecord) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.requests++
+	if clientError(rr.status) {
+		c.errors++
+	}
+}
+
+func (c *adaptiveController) fault(string) {}
+
+// run adjusts the rule every interval, forever
+func (c *adaptiveController) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		c.step()
+	}
+}
+
+// step moves the probability of the rule by a fraction of the gap between
+// the target and the error rate observed since the previous step, the
+// intervals without requests leave it untouched. In dry-run mode no fault
+// reaches the clients and the controller is frozen
+func (c *adaptiveController) step() {
+	c.m.Lock()
+	requests, errors := c.requests, c.errors
+	c.requests, c.errors = 0, 0
+	c.m.Unlock()
+
+	if requests == 0 || dryRun {
+		return
+	}
+
+	observed := 100 * float64(errors) / float64(requests)
+	p := c.rule.CurrentProbability() + adaptiveGain*(c.target-observed)
+	p = math.Max(0, math.Min(100, p))
+	c.rule.AdjustProbability(p)
+	log.Infof("observed error rate %.2f%% (target %g%%) over %d requests: failure rate set to %.2f%%", observed, c.target, requests, p)
+}
@@ -0,0 +1,64 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// serveAdmin starts the admin server on the given host (interface) and port
+func serveAdmin(host string, port int, metrics *promSink, dash *dashboard) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	mux.HandleFunc("/version", versionHandler)
+	mux.HandleFunc("/drain", drainHandler)
+	mux.HandleFunc("/backends", backendsHandler)
+	mux.HandleFunc("/split", splitHandler)
+	dash.register(mux)
+
+	l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	go func() {
+		log.Errorf("admin server: %v", http.Serve(l, sameOrigin(mux)))
+	}()
+
+	return nil
+}
+
+// sameOrigin rejects the state-changing requests (anything but GET and
+// HEAD) sent by the browsers from the pages of other sites, so a page open
+// in the browser of a tester can't disable the rules or drain the proxy
+func sameOrigin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && crossSite(r) {
+			log.Warnf("rejecting cross-site admin request %s", apiActor(r))
+			http.Error(w, "cross-site request", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// crossSite report if r comes from a page of another origin, according to
+// Sec-Fetch-Site or, from the older browsers, Origin. The requests without
+// either (e.g. curl) are not from a browser page
+func crossSite(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site != "same-origin" && site != "none"
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || u.Host != r.Host
+}
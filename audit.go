@@ -0,0 +1,133 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/meox/floki-proxy/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// events of the audit log
+const (
+	auditArmed    = "armed"
+	auditEnabled  = "enabled"
+	auditDisabled = "disabled"
+	auditFault    = "fault"
+)
+
+// actorFlags arms the faults of the flags, rules included
+const actorFlags = "fault flags"
+
+// auditEntry is a line of the audit log: a change of a rule, with who made
+// it, or an injected fault, with the request and who armed the rule
+type auditEntry struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	Rule        string    `json:"rule,omitempty"`
+	Action      string    `json:"action,omitempty"`
+	Probability *float64  `json:"probability,omitempty"`
+	Actor       string    `json:"actor,omitempty"`
+	Fault       string    `json:"fault,omitempty"`
+	ArmedBy     string    `json:"armed_by,omitempty"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Method      string    `json:"method,omitempty"`
+	URL         string    `json:"url,omitempty"`
+	Host        string    `json:"host,omitempty"`
+	Client      string    `json:"client,omitempty"`
+	Target      string    `json:"target,omitempty"`
+}
+
+// auditLog appends the entries to the -audit-log file, enc is nil when it
+// is disabled. armedBy maps a rule to the actor of its last change
+var auditLog = struct {
+	enc     *json.Encoder
+	armedBy map[*types.Rule]string
+	m       sync.Mutex
+}{armedBy: make(map[*types.Rule]string)}
+
+// openAuditLog starts appending the audit entries to path
+func openAuditLog(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	auditLog.enc = json.NewEncoder(f)
+	return nil
+}
+
+func writeAudit(e auditEntry) {
+	if err := auditLog.enc.Encode(e); err != nil {
+		log.Errorf("writing audit log: %v", err)
+	}
+}
+
+// auditRules records the event (armed, enabled or disabled) of the rules
+// made by actor
+func auditRules(event, actor string, rules ...*types.Rule) {
+	auditLog.m.Lock()
+	defer auditLog.m.Unlock()
+
+	now := time.Now()
+	for _, r := range rules {
+		auditLog.armedBy[r] = actor
+		if auditLog.enc == nil {
+			continue
+		}
+		p := r.CurrentProbability()
+		writeAudit(auditEntry{
+			Time:        now,
+			Event:       event,
+			Rule:        r.Name,
+			Action:      r.Action.String(),
+			Probability: &p,
+			Actor:       actor,
+		})
+	}
+}
+
+// auditInjected records the fault injected on target by rule, nil for the
+// faults of the flags. r is the request hit by the fault, if any
+func auditInjected(r *http.Request, target, fault string, rule *types.Rule) {
+	auditLog.m.Lock()
+	defer auditLog.m.Unlock()
+
+	if auditLog.enc == nil {
+		return
+	}
+
+	e := auditEntry{
+		Time:    time.Now(),
+		Event:   auditFault,
+		Fault:   fault,
+		ArmedBy: actorFlags,
+		Target:  target,
+	}
+	if rule != nil {
+		e.Rule = rule.Name
+		e.ArmedBy = auditLog.armedBy[rule]
+	}
+	if r != nil {
+		e.Tenant = tenantOf(r.Context()).name
+		e.Method, e.Host, e.Client = r.Method, r.Host, r.RemoteAddr
+		e.URL = r.URL.String()
+		if f := flowOf(r); f != nil {
+			e.URL = f.url
+		}
+	}
+	writeAudit(e)
+}
+
+// apiActor describes the admin API call r
+func apiActor(r *http.Request) string {
+	return fmt.Sprintf("%s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+}
@@ -0,0 +1,149 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meox/floki-proxy/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// cacheableRequest report if the response to r can be served from (and
+// stored in) the cache, the authenticated requests are private
+func cacheableRequest(r *http.Request) bool {
+	if responseCache == nil || r.Method != http.MethodGet || r.Header.Get("Range") != "" || r.Header.Get("Authorization") != "" {
+		return false
+	}
+
+	return !strings.Contains(r.Header.Get("Cache-Control"), "no-store")
+}
+
+// cacheableResponse report if resp can be stored in the cache, the ones
+// setting cookies are private. The entries are keyed by URL only, so the
+// negotiated variants (Vary, Content-Encoding) are never stored
+func cacheableResponse(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK || resp.ContentLength > cacheMaxBody || len(resp.Header["Set-Cookie"]) > 0 {
+		return false
+	}
+	if resp.Header.Get("Vary") != "" || resp.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+
+	cc := resp.Header.Get("Cache-Control")
+	return !strings.Contains(cc, "no-store") && !strings.Contains(cc, "private")
+}
+
+// serveFromCache serves r, for the client path, from the cache returning
+// true if a response was written. With the staleness faults an expired
+// entry, or the entry of another resource, can be deliberately served
+func serveFromCache(w http.ResponseWriter, r *http.Request, path string) bool {
+	key := r.URL.String()
+
+	if injectRequestFault(r, cacheMismatchRate, "cache-mismatch") {
+		if cr, ok := responseCache.Other(key); ok {
+			log.Warnf("serving mismatched cache entry %s for %s", cr.Key, key)
+			writeCached(w, r, path, cr)
+			return true
+		}
+	}
+
+	cr, fresh, ok := responseCache.Get(key)
+	if !ok {
+		return false
+	}
+	if !fresh {
+		if !injectRequestFault(r, cacheStaleRate, "stale-cache") {
+			return false
+		}
+		log.Warnf("serving stale cache entry for %s", key)
+	}
+
+	writeCached(w, r, path, cr)
+	log.WithField("code", cr.StatusCode).
+		WithField("method", r.Method).
+		WithField("resp-bytes", len(cr.Body)).
+		Infof("request to %s served from cache", r.RequestURI)
+
+	return true
+}
+
+// writeCached answers r with cr, the entries are stored as received from
+// the upstream so the response header rules are applied here
+func writeCached(w http.ResponseWriter, r *http.Request, path string, cr *types.CachedResponse) {
+	h := cr.Header.Clone()
+	tenantOf(r.Context()).responseHeaders.ApplyHeaders(h, path)
+	if corsPermissive {
+		allowCORS(h, r)
+	}
+	for k, vs := range h {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(cr.Stored).Seconds())))
+	w.WriteHeader(cr.StatusCode)
+	w.Write(cr.Body)
+}
+
+// cacheRecorder keeps a copy of the upstream response body, read through it
+// before any fault acts on it, to be stored in the cache
+type cacheRecorder struct {
+	io.ReadCloser
+	key        string
+	statusCode int
+	header     http.Header
+	body       bytes.Buffer
+	// eof is set once the upstream body is read to the end, too large
+	// when it exceeds -cache-max-body
+	eof      bool
+	tooLarge bool
+}
+
+// newCacheRecorder returns the recorder of resp, the response to the
+// request of url key, taking a snapshot of its header
+func newCacheRecorder(key string, resp *http.Response) *cacheRecorder {
+	return &cacheRecorder{
+		ReadCloser: resp.Body,
+		key:        key,
+		statusCode: resp.StatusCode,
+		header:     resp.Header.Clone(),
+	}
+}
+
+func (c *cacheRecorder) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if int64(c.body.Len()+n) > cacheMaxBody {
+		c.tooLarge = true
+	} else {
+		c.body.Write(p[:n])
+	}
+	if err == io.EOF {
+		c.eof = true
+	}
+
+	return n, err
+}
+
+// store puts the recorded response in the cache, unless the upstream body
+// was truncated or too large
+func (c *cacheRecorder) store() {
+	if !c.eof || c.tooLarge {
+		return
+	}
+
+	responseCache.Put(&types.CachedResponse{
+		Key:        c.key,
+		StatusCode: c.statusCode,
+		Header:     c.header,
+		Body:       c.body.Bytes(),
+		Stored:     time.Now(),
+	})
+}
@@ -0,0 +1,66 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const usage = `usage: floki-proxy [command] [flags]
+
+commands:
+  serve            run the proxy (the default when no command is given)
+  validate-config  check the flags and the rules file without listening
+  version          print the version
+  record           run the proxy recording the traffic to a file
+  replay           send again the requests of a recording
+  import-envoy     translate the fault filters of an Envoy configuration into a rules file
+
+run "floki-proxy <command> -h" for the flags of a command
+`
+
+func main() {
+	// without a command the flags are the ones of serve
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "serve":
+		run := func() error { return serve(newServeFlags(cmd), args, false) }
+		if !runAsService(run) {
+			if err := run(); err != nil {
+				log.Fatal(err)
+			}
+		}
+	case "validate-config":
+		if err := serve(newServeFlags(cmd), args, true); err != nil {
+			log.Fatal(err)
+		}
+	case "version":
+		printVersion()
+	case "record":
+		fs := newServeFlags(cmd)
+		fs.StringVar(&recordFile, "record-file", "flows.jsonl", "file the recorded flows are appended to")
+		fs.IntVar(&recordMaxBody, "record-max-body", 1024*1024, "max number of body bytes recorded for each request and response")
+		if err := serve(fs, args, false); err != nil {
+			log.Fatal(err)
+		}
+	case "replay":
+		replay(args)
+	case "import-envoy":
+		importEnvoy(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+}
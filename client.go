@@ -0,0 +1,122 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/meox/floki-proxy/types"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+)
+
+// hostTransport is a RoundTripper selecting a dedicated transport for the
+// upstream hosts requiring a client certificate and, when enabled, the
+// cleartext HTTP/2 one for the HTTP/2 requests to the http:// upstreams
+type hostTransport struct {
+	def   http.RoundTripper
+	h2c   http.RoundTripper
+	hosts map[string]http.RoundTripper
+}
+
+func (ht *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t, ok := ht.hosts[req.URL.Hostname()]; ok {
+		return t.RoundTrip(req)
+	}
+	if ht.h2c != nil && req.ProtoMajor == 2 && req.URL.Scheme == "http" {
+		return ht.h2c.RoundTrip(req)
+	}
+
+	return ht.def.RoundTrip(req)
+}
+
+// resolveAddr returns the address given with -resolve for addr, addr itself
+// if there is none
+func resolveAddr(addr string) string {
+	if to, ok := resolveOverrides.Resolve(addr); ok {
+		log.Debugf("resolving %s to %s", addr, to)
+		return to
+	}
+	return addr
+}
+
+// upstreamDialer dials the upstreams with dialUpstream, with a proxyProtocol
+// version the connections start with the PROXY protocol header of the client
+func upstreamDialer(proxyProtocol int) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialUpstream(ctx, d, network, addr)
+		if err != nil || proxyProtocol == 0 {
+			return conn, err
+		}
+
+		if err := sendProxyHeader(ctx, conn, proxyProtocol); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// newUpstreamClient returns the client used to contact the upstreams.
+// clientCerts maps an upstream host to the "cert.pem,key.pem" pair presented
+// to it. The upstream redirects are followed up to maxRedirects hops, with 0
+// they are sent back to the client as they are. expectTimeout is how long
+// the body of an "Expect: 100-continue" request waits for the interim 100.
+// With a proxyProtocol version the connections start with the PROXY protocol
+// header of the client, they are not reused
+func newUpstreamClient(clientCerts types.StringMap, maxRedirects int, h2cEnabled bool, expectTimeout time.Duration, proxyProtocol int) (*http.Client, error) {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.ExpectContinueTimeout = expectTimeout
+	base.DialContext = upstreamDialer(proxyProtocol)
+	if proxyProtocol > 0 {
+		base.DisableKeepAlives = true
+	}
+	ht := &hostTransport{
+		def:   base.Clone(),
+		hosts: make(map[string]http.RoundTripper),
+	}
+	if h2cEnabled {
+		ht.h2c = &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialUpstream(context.Background(), &net.Dialer{}, network, addr)
+			},
+		}
+	}
+
+	for host, pair := range clientCerts {
+		files := strings.Split(pair, ",")
+		if len(files) != 2 {
+			return nil, fmt.Errorf("bad client certificate for %s: expected cert.pem,key.pem", host)
+		}
+
+		cert, err := tls.LoadX509KeyPair(files[0], files[1])
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate for %s: %w", host, err)
+		}
+
+		t := base.Clone()
+		t.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		ht.hosts[host] = t
+	}
+
+	return &http.Client{
+		Transport: ht,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return http.ErrUseLastResponse
+			}
+			log.Infof("following upstream redirect to %s (hop %d)", req.URL, len(via))
+			return nil
+		},
+	}, nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// how the connections above -max-client-conns are refused
+const (
+	connLimitClose = "close"
+	connLimitReset = "reset"
+)
+
+// clientConns counts the open connections by client IP, the connections
+// taken over (tunnels, websockets) release their slot when taken over
+var clientConns = struct {
+	data map[string]int
+	// limited are the connections being refused, not counted
+	limited map[net.Conn]bool
+	m       sync.Mutex
+}{data: make(map[string]int), limited: make(map[net.Conn]bool)}
+
+// limitClientConns refuses the new connections of the clients that already
+// have -max-client-conns connections open
+func limitClientConns(conn net.Conn, state http.ConnState) {
+	if maxClientConns <= 0 {
+		return
+	}
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+
+	clientConns.m.Lock()
+	switch state {
+	case http.StateNew:
+		n := clientConns.data[ip]
+		if n < maxClientConns || !injectFault(100, "client-conn-limit", ip) {
+			clientConns.data[ip] = n + 1
+			break
+		}
+		clientConns.limited[conn] = true
+		clientConns.m.Unlock()
+
+		log.Warnf("refusing connection from %s (%s): %d connections open", ip, clientConnsAction, n)
+		refuseConn(conn, clientConnsAction)
+		return
+	case http.StateHijacked, http.StateClosed:
+		if clientConns.limited[conn] {
+			delete(clientConns.limited, conn)
+			break
+		}
+		if clientConns.data[ip]--; clientConns.data[ip] <= 0 {
+			delete(clientConns.data, ip)
+		}
+	}
+	clientConns.m.Unlock()
+}
+
+// refuseConn closes conn, with an RST if the mode is reset
+func refuseConn(conn net.Conn, mode string) {
+	if tc, ok := tcpConn(conn); ok && mode == connLimitReset {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
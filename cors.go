@@ -0,0 +1,140 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// the faults of the CORS headers
+const (
+	corsStrip   = "strip"
+	corsCorrupt = "corrupt"
+)
+
+// corsCorruptedOrigin is the origin allowed by a corrupted response, never
+// the one of the client
+const corsCorruptedOrigin = "https://corrupted.floki.invalid"
+
+// allowCORS makes the response h to the cross-origin request r permissive:
+// the origin of r is allowed, with credentials, as the requested method and
+// headers (meaningful for the preflight requests)
+func allowCORS(h http.Header, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Set("Access-Control-Allow-Credentials", "true")
+	h.Add("Vary", "Origin")
+	if m := r.Header.Get("Access-Control-Request-Method"); m != "" {
+		h.Set("Access-Control-Allow-Methods", m)
+	}
+	if hs := r.Header.Get("Access-Control-Request-Headers"); hs != "" {
+		h.Set("Access-Control-Allow-Headers", hs)
+	}
+}
+
+// hasCORS report if h has any Access-Control-Allow-* header
+func hasCORS(h http.Header) bool {
+	for k := range h {
+		if strings.HasPrefix(k, "Access-Control-Allow-") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tamperCORS strips or corrupts the Access-Control-Allow-* headers of h
+func tamperCORS(h http.Header, mode string) {
+	for k := range h {
+		if !strings.HasPrefix(k, "Access-Control-Allow-") {
+			continue
+		}
+
+		if mode == corsStrip {
+			h.Del(k)
+			continue
+		}
+		switch k {
+		case "Access-Control-Allow-Origin":
+			h.Set(k, corsCorruptedOrigin)
+		case "Access-Control-Allow-Credentials":
+			h.Set(k, "false")
+		default:
+			h.Set(k, "X-Floki-Corrupted")
+		}
+	}
+}
+
+// preflightPolicy is the answer of the proxy to the CORS preflight requests,
+// an empty list allows every origin, method or header
+type preflightPolicy struct {
+	origins []string
+	methods []string
+	headers []string
+	maxAge  time.Duration
+}
+
+// isPreflight report if r is a CORS preflight request
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// allows report if the policy accepts the preflight request r
+func (p preflightPolicy) allows(r *http.Request) bool {
+	if !allowedBy(p.origins, r.Header.Get("Origin")) {
+		return false
+	}
+	if !allowedBy(p.methods, r.Header.Get("Access-Control-Request-Method")) {
+		return false
+	}
+	for _, h := range splitList(r.Header.Get("Access-Control-Request-Headers")) {
+		if !allowedBy(p.headers, h) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// answer responds to the preflight request r: 204 with the CORS headers if
+// the policy allows it, 403 without them otherwise
+func (p preflightPolicy) answer(w http.ResponseWriter, r *http.Request) {
+	if !p.allows(r) {
+		w.WriteHeader(http.StatusForbidden)
+		log.Warnf("preflight request rejected by the policy: %s (origin %s)", r.RequestURI, r.Header.Get("Origin"))
+		return
+	}
+
+	h := w.Header()
+	allowCORS(h, r)
+	if p.maxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.maxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	log.Debugf("answered preflight request: %s (origin %s)", r.RequestURI, r.Header.Get("Origin"))
+}
+
+func allowedBy(allowed []string, x string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if strings.EqualFold(a, x) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,209 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// dashboardWindow is the number of seconds of the rate history
+	dashboardWindow = 60
+	// dashboardMaxPaths bounds the number of paths tracked for the top list
+	dashboardMaxPaths = 10000
+	dashboardTopPaths = 10
+)
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+type dashboardSecond struct {
+	ts       int64
+	requests uint64
+	faults   uint64
+}
+
+// dashboard collects the live statistics shown by the web dashboard
+type dashboard struct {
+	m        sync.Mutex
+	started  time.Time
+	requests uint64
+	faults   map[string]uint64
+	paths    map[string]uint64
+	seconds  [dashboardWindow]dashboardSecond
+}
+
+func newDashboard() *dashboard {
+	return &dashboard{
+		started: time.Now(),
+		faults:  make(map[string]uint64),
+		paths:   make(map[string]uint64),
+	}
+}
+
+// second returns the counters of the current second, d.m must be held
+func (d *dashboard) second(now int64) *dashboardSecond {
+	s := &d.seconds[now%dashboardWindow]
+	if s.ts != now {
+		*s = dashboardSecond{ts: now}
+	}
+
+	return s
+}
+
+func (d *dashboard) request(rr requestRecord) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	d.requests++
+	d.second(time.Now().Unix()).requests++
+	if _, ok := d.paths[rr.path]; ok || len(d.paths) < dashboardMaxPaths {
+		d.paths[rr.path]++
+	}
+}
+
+func (d *dashboard) fault(fault string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	d.faults[fault]++
+	d.second(time.Now().Unix()).faults++
+}
+
+type dashboardRule struct {
+	Index       int     `json:"index"`
+	Name        string  `json:"name"`
+	Priority    int     `json:"priority"`
+	Probability float64 `json:"probability"`
+	Action      string  `json:"action"`
+	Enabled     bool    `json:"enabled"`
+	Expired     bool    `json:"expired"`
+}
+
+type dashboardPath struct {
+	Path  string `json:"path"`
+	Count uint64 `json:"count"`
+}
+
+type dashboardStats struct {
+	Uptime   string            `json:"uptime"`
+	DryRun   bool              `json:"dry_run"`
+	Requests uint64            `json:"requests"`
+	Faults   map[string]uint64 `json:"faults"`
+	// RequestRate and FaultRate are the per-second counts of the last
+	// minute, the oldest first
+	RequestRate []uint64        `json:"request_rate"`
+	FaultRate   []uint64        `json:"fault_rate"`
+	TopPaths    []dashboardPath `json:"top_paths"`
+	Rules       []dashboardRule `json:"rules"`
+}
+
+func (d *dashboard) stats() dashboardStats {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	st := dashboardStats{
+		Uptime:   time.Since(d.started).Round(time.Second).String(),
+		DryRun:   dryRun,
+		Requests: d.requests,
+		Faults:   make(map[string]uint64),
+	}
+	for k, v := range d.faults {
+		st.Faults[k] = v
+	}
+
+	now := time.Now()
+	for ts := now.Unix() - dashboardWindow + 1; ts <= now.Unix(); ts++ {
+		var reqs, faults uint64
+		if s := d.seconds[ts%dashboardWindow]; s.ts == ts {
+			reqs, faults = s.requests, s.faults
+		}
+		st.RequestRate = append(st.RequestRate, reqs)
+		st.FaultRate = append(st.FaultRate, faults)
+	}
+
+	for p, n := range d.paths {
+		st.TopPaths = append(st.TopPaths, dashboardPath{Path: p, Count: n})
+	}
+	sort.Slice(st.TopPaths, func(i, j int) bool {
+		a, b := st.TopPaths[i], st.TopPaths[j]
+		return a.Count > b.Count || (a.Count == b.Count && a.Path < b.Path)
+	})
+	if len(st.TopPaths) > dashboardTopPaths {
+		st.TopPaths = st.TopPaths[:dashboardTopPaths]
+	}
+
+	for i, r := range ruleSet.Rules() {
+		st.Rules = append(st.Rules, dashboardRule{
+			Index:       i,
+			Name:        r.Name,
+			Priority:    r.Priority,
+			Probability: r.CurrentProbability(),
+			Action:      r.Action.String(),
+			Enabled:     r.Enabled(),
+			Expired:     !r.Deadline.IsZero() && now.After(r.Deadline),
+		})
+	}
+
+	return st
+}
+
+func (d *dashboard) register(mux *http.ServeMux) {
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardPage)
+	})
+	mux.HandleFunc("/api/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d.stats())
+	})
+	mux.HandleFunc("/api/rules/toggle", toggleRule)
+}
+
+// toggleRule switches on or off the rule with the given index
+func toggleRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "expected POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rules := ruleSet.Rules()
+	i, err := strconv.Atoi(r.FormValue("index"))
+	if err != nil || i < 0 || i >= len(rules) {
+		http.Error(w, "bad rule index", http.StatusBadRequest)
+		return
+	}
+	enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+	if err != nil {
+		http.Error(w, "bad enabled value", http.StatusBadRequest)
+		return
+	}
+
+	rules[i].SetEnabled(enabled)
+	state := auditDisabled
+	if enabled {
+		state = auditEnabled
+	}
+	auditRules(state, apiActor(r), rules[i])
+	event := eventRuleDisabled
+	if enabled {
+		event = eventRuleEnabled
+	}
+	notify(event, "rule %s %s from the dashboard", rules[i].Name, state)
+	log.Warnf("rule %s %s from the dashboard", rules[i].Name, state)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,81 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	mathrand "math/rand"
+	"net/http"
+	"regexp"
+)
+
+// the targets of the digest corruption
+const (
+	digestBody   = "body"
+	digestHeader = "header"
+)
+
+// digestHeaders are the headers carrying a checksum of the body
+var digestHeaders = []string{"Content-MD5", "Digest", "Content-Digest", "Repr-Digest"}
+
+// hashETag matches the strong ETags made by an hex (MD5, SHA-1, SHA-256) or
+// base64 encoded hash
+var hashETag = regexp.MustCompile(`^"([0-9a-fA-F]{32}|[0-9a-fA-F]{40}|[0-9a-fA-F]{64}|[A-Za-z0-9+/]{22,86}={0,2})"$`)
+
+// integrityHeaders returns the headers of h carrying a checksum of the body
+func integrityHeaders(h http.Header) []string {
+	var found []string
+	for _, k := range digestHeaders {
+		if h.Get(k) != "" {
+			found = append(found, k)
+		}
+	}
+	if hashETag.MatchString(h.Get("ETag")) {
+		found = append(found, "ETag")
+	}
+
+	return found
+}
+
+// corruptDigest alters the last alphanumeric character of the value
+func corruptDigest(v string) string {
+	b := []byte(v)
+	for i := len(b) - 1; i >= 0; i-- {
+		c := b[i]
+		switch {
+		case c >= '0' && c <= '8', c >= 'a' && c <= 'y', c >= 'A' && c <= 'Y':
+			b[i] = c + 1
+		case c == '9', c == 'z', c == 'Z':
+			b[i] = c - 1
+		default:
+			continue
+		}
+		return string(b)
+	}
+
+	return v
+}
+
+// corruptedBody flips the bits of the byte at offset, the length is
+// untouched. A negative offset, for the bodies of unknown length, picks a
+// byte of the first data read
+type corruptedBody struct {
+	io.ReadCloser
+	offset int64
+	pos    int64
+}
+
+func (cb *corruptedBody) Read(p []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(p)
+	if cb.offset < 0 && n > 0 {
+		cb.offset = cb.pos + mathrand.Int63n(int64(n))
+	}
+	if i := cb.offset - cb.pos; i >= 0 && i < int64(n) {
+		p[i] ^= 0xff
+	}
+	cb.pos += int64(n)
+
+	return n, err
+}
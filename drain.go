@@ -0,0 +1,160 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// drain states reported by the /drain admin endpoint
+const (
+	drainServing  = "serving"
+	drainDraining = "draining"
+	drainDrained  = "drained"
+)
+
+// drain tracks the proxy servers, their open connections and in-flight
+// requests (tunnels included), to stop them gracefully on POST /drain
+var drain = struct {
+	conns    int64
+	inFlight int64
+	servers  []*http.Server
+	started  time.Time
+	drained  time.Time
+	m        sync.Mutex
+}{}
+
+// drainStatus is the body of the /drain responses
+type drainStatus struct {
+	State       string `json:"state"`
+	Started     string `json:"started,omitempty"`
+	Elapsed     string `json:"elapsed,omitempty"`
+	Connections int64  `json:"connections"`
+	InFlight    int64  `json:"in_flight"`
+}
+
+// trackServer registers srv to be drained
+func trackServer(srv *http.Server) {
+	drain.m.Lock()
+	drain.servers = append(drain.servers, srv)
+	drain.m.Unlock()
+}
+
+// countConn counts the open connections of the tracked servers
+func countConn(state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		atomic.AddInt64(&drain.conns, 1)
+	case http.StateHijacked, http.StateClosed:
+		atomic.AddInt64(&drain.conns, -1)
+	}
+}
+
+// startRequest counts a request in flight, the returned function ends it
+func startRequest() func() {
+	atomic.AddInt64(&drain.inFlight, 1)
+	return func() { atomic.AddInt64(&drain.inFlight, -1) }
+}
+
+// startDrain closes the listeners and the idle connections of the proxy
+// servers, the drain completes once the in-flight requests are finished. It
+// does nothing if the drain has already started
+func startDrain() {
+	drain.m.Lock()
+	defer drain.m.Unlock()
+	if !drain.started.IsZero() {
+		return
+	}
+	drain.started = time.Now()
+	log.Warnf("draining: no new connections accepted, %d requests in flight", atomic.LoadInt64(&drain.inFlight))
+	notify(eventStopped, "draining, %d requests in flight", atomic.LoadInt64(&drain.inFlight))
+
+	var wg sync.WaitGroup
+	for _, srv := range drain.servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			srv.Shutdown(context.Background())
+		}(srv)
+	}
+	go func() {
+		wg.Wait()
+		// the hijacked connections (tunnels, websockets) are not waited by
+		// Shutdown, their requests are
+		for atomic.LoadInt64(&drain.inFlight) > 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		drain.m.Lock()
+		drain.drained = time.Now()
+		elapsed := drain.drained.Sub(drain.started)
+		drain.m.Unlock()
+		log.Warnf("drained in %s", elapsed.Round(time.Millisecond))
+	}()
+}
+
+// currentDrain returns the progress of the drain
+func currentDrain() drainStatus {
+	drain.m.Lock()
+	defer drain.m.Unlock()
+
+	ds := drainStatus{
+		State:       drainServing,
+		Connections: atomic.LoadInt64(&drain.conns),
+		InFlight:    atomic.LoadInt64(&drain.inFlight),
+	}
+	if drain.started.IsZero() {
+		return ds
+	}
+
+	ds.State = drainDraining
+	ds.Started = drain.started.UTC().Format(time.RFC3339)
+	end := time.Now()
+	if !drain.drained.IsZero() {
+		ds.State = drainDrained
+		end = drain.drained
+	}
+	ds.Elapsed = end.Sub(drain.started).Round(time.Millisecond).String()
+
+	return ds
+}
+
+// drainHandler starts the drain on POST and reports its progress
+func drainHandler(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		startDrain()
+		status = http.StatusAccepted
+	default:
+		http.Error(w, "expected GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(currentDrain())
+}
+
+// serveError returns the first error of the proxy servers, ignoring the
+// ones closed by the drain: then the process keeps running, with the admin
+// server, until it is stopped
+func serveError(errs <-chan error) error {
+	for err := range errs {
+		if err != http.ErrServerClosed {
+			return err
+		}
+	}
+
+	return nil
+}
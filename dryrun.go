@@ -0,0 +1,77 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dryRunCounts counts, by fault, the injections skipped by the dry-run
+var dryRunCounts = struct {
+	data map[string]uint64
+	m    sync.Mutex
+}{data: make(map[string]uint64)}
+
+// injectFault report if the fault, triggered with the given rate, must be
+// injected on target. In dry-run mode the fault is only logged and counted
+func injectFault(rate float64, fault, target string) bool {
+	if !triggerFault(rate, fault, target) {
+		return false
+	}
+
+	auditInjected(nil, target, fault, nil)
+	return true
+}
+
+// triggerFault is injectFault without the audit
+func triggerFault(rate float64, fault, target string) bool {
+	if !rollFault(rate, fault, target) {
+		return false
+	}
+
+	recordFault(fault)
+	return true
+}
+
+// rollFault is triggerFault without recording the fault, for the faults
+// recorded only once they have been actually applied
+func rollFault(rate float64, fault, target string) bool {
+	if !shouldFail(rate) {
+		return false
+	}
+	if dryRun {
+		wouldInject(fault, target)
+		return false
+	}
+
+	return true
+}
+
+// injectRequestFault is injectFault for the faults acting on r, the fault is
+// recorded in the flow of r
+func injectRequestFault(r *http.Request, rate float64, fault string) bool {
+	if !triggerFault(rate, fault, r.RequestURI) {
+		return false
+	}
+	auditInjected(r, r.RequestURI, fault, nil)
+
+	if f := flowOf(r); f != nil {
+		f.fault, f.rule = fault, ""
+	}
+	return true
+}
+
+// wouldInject logs and counts a fault skipped by the dry-run
+func wouldInject(fault, target string) {
+	dryRunCounts.m.Lock()
+	dryRunCounts.data[fault]++
+	n := dryRunCounts.data[fault]
+	dryRunCounts.m.Unlock()
+
+	log.WithField("dry-run-count", n).Warnf("dry-run: would have injected %s on %s", fault, target)
+}
@@ -0,0 +1,144 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// dumpOut is where the flows are dumped, the mutex keeps them from
+// interleaving
+var dumpOut = struct {
+	w io.Writer
+	m sync.Mutex
+}{}
+
+// capture keeps the first max bytes written to it, counting the rest
+type capture struct {
+	buf   bytes.Buffer
+	max   int
+	total int64
+}
+
+func (c *capture) Write(p []byte) (int, error) {
+	c.total += int64(len(p))
+	if room := c.max - c.buf.Len(); room > 0 {
+		if len(p) > room {
+			c.buf.Write(p[:room])
+		} else {
+			c.buf.Write(p)
+		}
+	}
+
+	return len(p), nil
+}
+
+func (c *capture) String() string {
+	// the cap can split the last rune
+	kept := c.buf.Bytes()
+	for i := 0; i < utf8.UTFMax-1 && len(kept) > 0 && !utf8.Valid(kept); i++ {
+		kept = kept[:len(kept)-1]
+	}
+	if !utf8.Valid(kept) {
+		return fmt.Sprintf("(binary body, %d bytes)", c.total)
+	}
+
+	s := string(kept)
+	if dropped := c.total - int64(len(kept)); dropped > 0 {
+		s += fmt.Sprintf("... (%d more bytes)", dropped)
+	}
+
+	return s
+}
+
+func (c *capture) truncated() bool {
+	return c.total > int64(c.buf.Len())
+}
+
+// captureBody replaces the body of r with one copying what is read into a
+// capture of the given size and returns it
+func captureBody(r *http.Request, max int) *capture {
+	c := &capture{max: max}
+	r.Body = teeBody{io.TeeReader(r.Body, c), r.Body}
+
+	return c
+}
+
+// teeBody is a request body copying what is read into a capture
+type teeBody struct {
+	io.Reader
+	io.Closer
+}
+
+// dumpFlow reports if the flow of r must be dumped
+func dumpFlow(r *http.Request) bool {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	_, ok := dumpList.Match(host, r.URL.Path)
+
+	return ok
+}
+
+// writeDump writes the recorded flow of r
+func writeDump(r *http.Request, f *flow) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "> %s %s %s\n", r.Method, r.RequestURI, r.Proto)
+	fmt.Fprintf(&b, "> Host: %s\n", r.Host)
+	writeDumpHeaders(&b, "> ", r.Header)
+	writeDumpBody(&b, "> ", f.reqBody)
+
+	if f.hijacked {
+		b.WriteString("< (raw response written on the hijacked connection)\n")
+	} else {
+		status := f.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		fmt.Fprintf(&b, "< %s %d %s\n", r.Proto, status, http.StatusText(status))
+		writeDumpHeaders(&b, "< ", f.Header())
+		writeDumpBody(&b, "< ", f.respBody)
+	}
+
+	b.WriteString("\n")
+
+	dumpOut.m.Lock()
+	defer dumpOut.m.Unlock()
+	io.WriteString(dumpOut.w, b.String())
+}
+
+func writeDumpHeaders(b *strings.Builder, prefix string, h http.Header) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		for _, v := range h[k] {
+			fmt.Fprintf(b, "%s%s: %s\n", prefix, k, redactHeader(k, v))
+		}
+	}
+}
+
+func writeDumpBody(b *strings.Builder, prefix string, c *capture) {
+	b.WriteString(prefix + "\n")
+	if c.total == 0 {
+		return
+	}
+
+	for _, line := range strings.Split(strings.TrimSuffix(c.String(), "\n"), "\n") {
+		b.WriteString(prefix + line + "\n")
+	}
+}
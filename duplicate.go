@@ -0,0 +1,64 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// duplicateRequest returns a copy of req, to be delivered again to the
+// upstream, buffering its body. It returns nil, leaving req usable, if the
+// body is larger than max
+func duplicateRequest(req *http.Request, max int64) (*http.Request, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		b, err := ioutil.ReadAll(io.LimitReader(req.Body, max+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(b)) > max {
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(b), req.Body), req.Body}
+			return nil, nil
+		}
+		body = b
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	// the copy outlives the client request
+	dup := req.Clone(context.Background())
+	if body != nil {
+		dup.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	return dup, nil
+}
+
+// deliverDuplicate sends dup, the copy of r, to the upstream after delay.
+// The fault is recorded once delivered, the response is only logged
+func deliverDuplicate(r, dup *http.Request, delay time.Duration) {
+	time.Sleep(delay)
+
+	resp, err := upstreamClient.Do(dup)
+	if err != nil {
+		log.Warnf("delivering duplicate of %s: %v", r.RequestURI, err)
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	recordFault("duplicate")
+	auditInjected(r, r.RequestURI, "duplicate", nil)
+	log.Warnf("delivered duplicate of %s: %s", r.RequestURI, resp.Status)
+}
@@ -0,0 +1,370 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/meox/floki-proxy/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// priorities of the rules generated by the legacy flags, they preserve the
+// order in which the flags used to be checked
+const (
+	priorityFailureRate = 100
+	priorityMethod      = 90
+	priorityPrefix      = 80
+	priorityHost        = 70
+	priorityRedirect    = 60
+	priorityHang        = 50
+	priorityWrongLength = 40
+	priorityBadChunked  = 30
+	priorityGarbage     = 20
+	priorityHTTP10      = 10
+	priorityProtocolErr = 5
+)
+
+// legacyRules converts the fault flags into rules
+func legacyRules() []*types.Rule {
+	var rules []*types.Rule
+	add := func(r *types.Rule) {
+		if r.Probability > 0 {
+			rules = append(rules, r)
+		}
+	}
+
+	fr := &types.Rule{
+		Name:        "failure-rate",
+		Priority:    priorityFailureRate,
+		Probability: failureRate,
+		Action:      types.Action{Type: types.ActionAbort, Status: failureCode},
+	}
+	if targetErrorRate > 0 {
+		// the controller starts from -failure-rate, even 0, and adjusts it
+		adaptiveRule = fr
+		rules = append(rules, fr)
+	} else {
+		add(fr)
+	}
+	for m, rate := range methodFailureRates {
+		add(&types.Rule{
+			Name:        "method-failure-rate:" + m,
+			Priority:    priorityMethod,
+			Probability: rate,
+			Match:       types.Match{Methods: []string{m}},
+			Action:      types.Action{Type: types.ActionAbort, Status: failureCode},
+		})
+	}
+	for p, pf := range failWithPrefix {
+		add(&types.Rule{
+			Name:        "fail-with-prefix:" + p,
+			Priority:    priorityPrefix,
+			Probability: 100,
+			Match:       types.Match{PathPrefix: p},
+			Action:      types.Action{Type: types.ActionAbort, Status: pf.Code},
+			Deadline:    pf.Deadline,
+		})
+	}
+	for h, rate := range hostFailureRates {
+		add(&types.Rule{
+			Name:        "host-failure-rate:" + h,
+			Priority:    priorityHost,
+			Probability: rate,
+			Match:       types.Match{Hosts: []string{h}},
+			Action:      types.Action{Type: types.ActionAbort, Status: failureCode},
+		})
+	}
+	if redirectDepth > 0 || redirectLoop {
+		add(&types.Rule{
+			Name:        "redirect-rate",
+			Priority:    priorityRedirect,
+			Probability: redirectRate,
+			Action: types.Action{
+				Type:   types.ActionRedirect,
+				Status: redirectCode,
+				Depth:  redirectDepth,
+				Loop:   redirectLoop,
+			},
+		})
+	}
+	add(&types.Rule{
+		Name:        "hang-rate",
+		Priority:    priorityHang,
+		Probability: hangRate,
+		Action:      types.Action{Type: types.ActionHang, Mode: hangMode},
+	})
+	add(&types.Rule{
+		Name:        "wrong-length-rate",
+		Priority:    priorityWrongLength,
+		Probability: wrongLengthRate,
+		Action:      types.Action{Type: types.ActionWrongLength, Bytes: wrongLengthDelta},
+	})
+	add(&types.Rule{
+		Name:        "bad-chunked-rate",
+		Priority:    priorityBadChunked,
+		Probability: badChunkedRate,
+		Action:      types.Action{Type: types.ActionBadChunked, Mode: badChunkedMode},
+	})
+	add(&types.Rule{
+		Name:        "garbage-rate",
+		Priority:    priorityGarbage,
+		Probability: garbageRate,
+		Action:      types.Action{Type: types.ActionGarbage, Bytes: garbageBytes},
+	})
+	add(&types.Rule{
+		Name:        "http10-rate",
+		Priority:    priorityHTTP10,
+		Probability: http10Rate,
+		Action:      types.Action{Type: types.ActionHTTP10},
+	})
+	add(&types.Rule{
+		Name:        "protocol-error-rate",
+		Priority:    priorityProtocolErr,
+		Probability: protocolErrorRate,
+		Action:      types.Action{Type: types.ActionProtocolErr, Mode: protocolErrorMode},
+	})
+
+	return rules
+}
+
+// buildRuleSet returns the rule set made by the rules given with -rules-file
+// and -rule and the ones generated by the legacy flags
+func buildRuleSet(mode string, rules []*types.Rule) (*types.RuleSet, error) {
+	rs, err := types.NewRuleSet(mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := rs.Add(rules...); err != nil {
+		return nil, err
+	}
+	legacy := legacyRules()
+	auditRules(auditArmed, actorFlags, legacy...)
+	if err := rs.Add(legacy...); err != nil {
+		return nil, fmt.Errorf("converting the fault flags: %w", err)
+	}
+
+	return rs, nil
+}
+
+// requestFaults is the outcome of the evaluation of the rules for a request
+type requestFaults struct {
+	// delay is the latency added before forwarding the request
+	delay time.Duration
+	// timeout, retries and buffer override -upstream-timeout, -retries and
+	// -buffer-size
+	timeout time.Duration
+	retries *int
+	buffer  int
+	// terminal is the rule ending the request, if any
+	terminal *types.Rule
+}
+
+// evaluateRules looks for the rules triggered by r, directed to host and
+// path, arrived with the given load. In dry-run mode the triggered faults
+// are only logged. The settings are applied anyway: they are not faults,
+// they ignore the dry-run and the failure TTL and are never recorded
+func evaluateRules(r *http.Request, host, path string, load types.Load) requestFaults {
+	var rf requestFaults
+	rs := tenantOf(r.Context()).ruleSet
+	settings := rs.Settings(r, host, path, load, sampled)
+	// the settings of the rules with the highest priority win
+	for i := len(settings) - 1; i >= 0; i-- {
+		rule := settings[i]
+		log.Debugf("applying %s: %s (rule %s)", rule.Action, r.RequestURI, rule.Name)
+		if rule.Action.Type == types.ActionTimeout {
+			rf.timeout = rule.Action.Delay
+			continue
+		}
+		rf.override(rule.Action)
+	}
+
+	for _, rule := range rs.Evaluate(r, host, path, load, shouldFail) {
+		if dryRun {
+			wouldInject(fmt.Sprintf("%s (rule %s)", rule.Action, rule.Name), path)
+			continue
+		}
+		// a partial GraphQL response is recorded once the body is rewritten
+		if rule.Action.Type != types.ActionGraphQLPart {
+			recordRule(r, path, rule)
+		}
+		if rule.Action.Type == types.ActionDelay {
+			rf.delay += rule.Action.Delay
+			continue
+		}
+		rf.terminal = rule
+	}
+
+	return rf
+}
+
+// recordRule records the fault of rule injected on r, for path
+func recordRule(r *http.Request, path string, rule *types.Rule) {
+	recordFault(rule.Action.Type)
+	auditInjected(r, path, rule.Action.Type, rule)
+	if f := flowOf(r); f != nil {
+		f.fault, f.rule = rule.Action.Type, rule.Name
+	}
+}
+
+// override applies the settings of an override action
+func (rf *requestFaults) override(a types.Action) {
+	if a.Timeout > 0 {
+		rf.timeout = a.Timeout
+	}
+	if a.Retries != nil {
+		rf.retries = a.Retries
+	}
+	if a.Buffer > 0 {
+		rf.buffer = a.Buffer
+	}
+}
+
+// retryPolicy returns the retry policy of the request, p with the retries
+// of the override rule if any
+func (rf requestFaults) retryPolicy(p *retryPolicy) *retryPolicy {
+	if rf.retries == nil {
+		return p
+	}
+
+	rp := *p
+	rp.count = *rf.retries
+	return &rp
+}
+
+// respondsEarly report if the terminal rule answers the request without
+// contacting the upstream
+func (rf requestFaults) respondsEarly() bool {
+	if rf.terminal == nil {
+		return false
+	}
+
+	a := rf.terminal.Action
+	if a.Type == types.ActionReset {
+		return a.Mode != types.ResetResponse
+	}
+	return a.Type == types.ActionAbort || a.Type == types.ActionRedirect
+}
+
+// dropRedirect discards a terminal redirect rule
+func (rf *requestFaults) dropRedirect() {
+	if rf.terminal != nil && rf.terminal.Action.Type == types.ActionRedirect {
+		rf.terminal = nil
+	}
+}
+
+// applyEarly answers r applying the terminal abort, redirect or reset rule
+func (rf requestFaults) applyEarly(w http.ResponseWriter, r *http.Request, path string) {
+	rule := rf.terminal
+	switch rule.Action.Type {
+	case types.ActionAbort:
+		w.WriteHeader(rule.Action.Status)
+		log.Warnf("failing request to: %s (rule %s)", r.RequestURI, rule.Name)
+	case types.ActionRedirect:
+		startRedirect(w, r, path, rule.Action)
+		log.Warnf("injecting redirect %d: %s (rule %s)", rule.Action.Status, r.RequestURI, rule.Name)
+	case types.ActionReset:
+		log.Warnf("resetting connection: %s (rule %s)", r.RequestURI, rule.Name)
+		resetConnection(w)
+	}
+}
+
+// resetConnection closes the client connection without answering, with
+// HTTP/2 only the stream is reset
+func resetConnection(w http.ResponseWriter) {
+	conn, _, err := hijack(w)
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	conn.Close()
+}
+
+// holdResponse keeps the upstream response until the delay of the terminal
+// hold rule has elapsed since the start of the request, it returns an error
+// if the client gives up in the meantime
+func (rf requestFaults) holdResponse(r *http.Request) error {
+	rule := rf.terminal
+	if rule == nil || rule.Action.Type != types.ActionHold {
+		return nil
+	}
+
+	start := time.Now()
+	if f := flowOf(r); f != nil {
+		start = f.start
+	}
+	d := rule.Action.Delay - time.Since(start)
+	if d <= 0 {
+		return nil
+	}
+
+	log.Warnf("holding response for %s: %s (rule %s)", d.Round(time.Millisecond), r.RequestURI, rule.Name)
+	if err := sleepContext(r.Context(), d); err != nil {
+		log.Warnf("client gave up after %s: %s (rule %s)", time.Since(start).Round(time.Millisecond), r.RequestURI, rule.Name)
+		return err
+	}
+
+	return nil
+}
+
+// applyResponse applies the terminal rule acting on the upstream response,
+// it returns false if there is no such rule
+func (rf requestFaults) applyResponse(w http.ResponseWriter, r *http.Request, resp *http.Response) bool {
+	rule := rf.terminal
+	if rule == nil {
+		return false
+	}
+
+	if f := flowOf(r); f != nil {
+		// the raw responses bypass the flow
+		f.annotate(resp.Header, resp.StatusCode)
+	}
+
+	var err error
+	a := rule.Action
+	switch a.Type {
+	case types.ActionHang:
+		log.Warnf("hanging request after headers (%s): %s (rule %s)", a.Mode, r.RequestURI, rule.Name)
+		err = hangAfterHeaders(w, resp, a.Mode)
+	case types.ActionWrongLength:
+		log.Warnf("sending wrong content-length (%+d): %s (rule %s)", a.Bytes, r.RequestURI, rule.Name)
+		err = writeWrongLength(w, resp, a.Bytes)
+	case types.ActionBadChunked:
+		log.Warnf("sending malformed chunked encoding (%s): %s (rule %s)", a.Mode, r.RequestURI, rule.Name)
+		err = writeBadChunked(w, resp, a.Mode)
+	case types.ActionGarbage:
+		log.Warnf("prepending %d garbage bytes: %s (rule %s)", a.Bytes, r.RequestURI, rule.Name)
+		err = writeGarbagePrefix(w, resp, a.Bytes)
+	case types.ActionHTTP10:
+		log.Warnf("downgrading the response to HTTP/1.0: %s (rule %s)", r.RequestURI, rule.Name)
+		err = writeHTTP10(w, resp)
+	case types.ActionProtocolErr:
+		log.Warnf("sending a protocol error (%s): %s (rule %s)", a.Mode, r.RequestURI, rule.Name)
+		err = writeProtocolError(w, resp, a.Mode)
+	case types.ActionReset:
+		log.Warnf("resetting connection after the upstream response: %s (rule %s)", r.RequestURI, rule.Name)
+		resetConnection(w)
+	default:
+		return false
+	}
+
+	if err != nil {
+		log.Errorf("applying rule %s: %v", rule.Name, err)
+	}
+
+	return true
+}
+
+// describeRules returns a printable summary of the rule set
+func describeRules(rs *types.RuleSet) string {
+	var xs []string
+	for _, r := range rs.Rules() {
+		xs = append(xs, fmt.Sprintf("%d:%s", r.Priority, r))
+	}
+
+	return strings.Join(xs, " ")
+}
@@ -0,0 +1,35 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// the faults of the requests with "Expect: 100-continue"
+const (
+	// expectNoContinue never sends the interim 100, the body is read
+	// when the client stops waiting
+	expectNoContinue = "no-continue"
+	// expectEarlyStatus sends the final status without reading the body
+	expectEarlyStatus = "early-status"
+)
+
+// expectsContinue report if the client of r waits for the interim 100
+// before sending the body
+func expectsContinue(r *http.Request) bool {
+	return r.ProtoAtLeast(1, 1) && r.ContentLength != 0 &&
+		strings.EqualFold(r.Header.Get("Expect"), "100-continue")
+}
+
+// withholdContinue takes over the connection of the flow f so that the
+// interim 100 is never sent: the body of r is read from the connection once
+// the client gives up waiting and sends it. The returned function closes the
+// connection
+func withholdContinue(f *flow, r *http.Request) (func(), error) {
+	_, closeConn, err := takeOver(f, r)
+	return closeConn, err
+}
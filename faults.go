@@ -0,0 +1,286 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/meox/floki-proxy/types"
+)
+
+const (
+	hangModeHeaders = "headers"
+	hangModeBody    = "body"
+)
+
+// hijack takes over the client connection
+func hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection hijacking not supported")
+	}
+
+	return hj.Hijack()
+}
+
+// bodyAllowed report if resp can carry a body: the responses to HEAD and
+// the 1xx, 204 and 304 responses never do
+func bodyAllowed(resp *http.Response) bool {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return false
+	}
+	s := resp.StatusCode
+	return s >= 200 && s != http.StatusNoContent && s != http.StatusNotModified
+}
+
+// writeStatusAndHeaders writes the raw status line and the headers of resp.
+// When terminate is false the blank line closing the header section is omitted
+func writeStatusAndHeaders(bw *bufio.Writer, resp *http.Response, terminate bool) error {
+	fmt.Fprintf(bw, "HTTP/1.1 %s\r\n", resp.Status)
+	if err := resp.Header.Write(bw); err != nil {
+		return err
+	}
+	if terminate {
+		bw.WriteString("\r\n")
+	}
+
+	return bw.Flush()
+}
+
+// hangAfterHeaders writes the status line and the headers of resp on the
+// hijacked connection and then stalls until the client goes away.
+// With hangModeHeaders the header section is never terminated, with
+// hangModeBody the headers are complete but the body never arrives
+func hangAfterHeaders(w http.ResponseWriter, resp *http.Response, mode string) error {
+	conn, brw, err := hijack(w)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := writeStatusAndHeaders(brw.Writer, resp, mode == hangModeBody); err != nil {
+		return err
+	}
+
+	// wait for the client to give up
+	_, err = io.Copy(ioutil.Discard, brw)
+	return err
+}
+
+// writeWrongLength sends the upstream response on the hijacked connection
+// advertising a Content-Length that differs by delta bytes from the actual
+// body length, then closes the connection. For the responses without a body
+// the delta is applied to the advertised length
+func writeWrongLength(w http.ResponseWriter, resp *http.Response, delta int) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	length := len(body) + delta
+	if !bodyAllowed(resp) {
+		body = nil
+		length = delta
+		if resp.ContentLength > 0 {
+			length += int(resp.ContentLength)
+		}
+	}
+	if length < 0 {
+		length = 0
+	}
+
+	conn, brw, err := hijack(w)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resp.Header.Del("Transfer-Encoding")
+	resp.Header.Set("Content-Length", strconv.Itoa(length))
+	resp.Header.Set("Connection", "close")
+	if err := writeStatusAndHeaders(brw.Writer, resp, true); err != nil {
+		return err
+	}
+	if _, err := brw.Write(body); err != nil {
+		return err
+	}
+
+	return brw.Flush()
+}
+
+// writeHTTP10 sends the upstream response on the hijacked connection as an
+// HTTP/1.0 server would: no chunking, no keep-alive and a body delimited by
+// the closing of the connection
+func writeHTTP10(w http.ResponseWriter, resp *http.Response) error {
+	conn, brw, err := hijack(w)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, k := range []string{"Transfer-Encoding", "Content-Length", "Connection", "Keep-Alive"} {
+		resp.Header.Del(k)
+	}
+	fmt.Fprintf(brw, "HTTP/1.0 %s\r\n", resp.Status)
+	if err := resp.Header.Write(brw); err != nil {
+		return err
+	}
+	brw.WriteString("\r\n")
+	if bodyAllowed(resp) {
+		if _, err := io.Copy(brw, resp.Body); err != nil {
+			return err
+		}
+	}
+
+	return brw.Flush()
+}
+
+// writeProtocolError sends the upstream response on the hijacked connection
+// breaking the HTTP syntax as the mode (types.ProtocolError*) says. The body
+// is delimited by the closing of the connection
+func writeProtocolError(w http.ResponseWriter, resp *http.Response, mode string) error {
+	conn, brw, err := hijack(w)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resp.Header.Del("Transfer-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Connection", "close")
+	switch mode {
+	case types.ProtocolErrorStatusLine:
+		fmt.Fprintf(brw, "HTTP/1.x %s\r\n", resp.Status)
+	case types.ProtocolErrorStatusCode:
+		// 200 becomes 20x
+		fmt.Fprintf(brw, "HTTP/1.1 %dx %s\r\n", resp.StatusCode/10, http.StatusText(resp.StatusCode))
+	default:
+		fmt.Fprintf(brw, "HTTP/1.1 %s\r\n", resp.Status)
+	}
+	if err := resp.Header.Write(brw); err != nil {
+		return err
+	}
+	if mode == types.ProtocolErrorHeader {
+		brw.WriteString("X-Floki\x01Bad: \x00\x7f\r\n")
+	}
+	brw.WriteString("\r\n")
+	if bodyAllowed(resp) {
+		if _, err := io.Copy(brw, resp.Body); err != nil {
+			return err
+		}
+	}
+
+	return brw.Flush()
+}
+
+const (
+	badChunkedSize         = "size"
+	badChunkedUnterminated = "unterminated"
+)
+
+// writeBadChunked sends the upstream response using an invalid chunked
+// transfer encoding: with badChunkedSize the chunk size line is not an
+// hexadecimal number, with badChunkedUnterminated the terminating chunk is
+// never sent. The responses without a body only get the header
+func writeBadChunked(w http.ResponseWriter, resp *http.Response, mode string) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	conn, brw, err := hijack(w)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Transfer-Encoding", "chunked")
+	resp.Header.Set("Connection", "close")
+	if err := writeStatusAndHeaders(brw.Writer, resp, true); err != nil {
+		return err
+	}
+	if !bodyAllowed(resp) {
+		return nil
+	}
+
+	switch mode {
+	case badChunkedSize:
+		fmt.Fprintf(brw, "zz%x\r\n%s\r\n0\r\n\r\n", len(body), body)
+	default:
+		fmt.Fprintf(brw, "%x\r\n%s\r\n", len(body), body)
+	}
+
+	return brw.Flush()
+}
+
+// writeGarbagePrefix sends n random bytes on the hijacked connection before
+// the real upstream response. The headers of the responses without a body
+// are sent as they are
+func writeGarbagePrefix(w http.ResponseWriter, resp *http.Response, n int) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	conn, brw, err := hijack(w)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	garbage := make([]byte, n)
+	mathrand.Read(garbage)
+	if _, err := brw.Write(garbage); err != nil {
+		return err
+	}
+
+	if bodyAllowed(resp) {
+		resp.Header.Del("Transfer-Encoding")
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	resp.Header.Set("Connection", "close")
+	if err := writeStatusAndHeaders(brw.Writer, resp, true); err != nil {
+		return err
+	}
+	if !bodyAllowed(resp) {
+		return nil
+	}
+	if _, err := brw.Write(body); err != nil {
+		return err
+	}
+
+	return brw.Flush()
+}
+
+// writeForbiddenBody violates the semantics of a response without a body
+// (to HEAD, 204 or 304) sending its headers as they are followed by n
+// random bytes on the hijacked connection, then closes the connection
+func writeForbiddenBody(w http.ResponseWriter, resp *http.Response, n int) error {
+	conn, brw, err := hijack(w)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := writeStatusAndHeaders(brw.Writer, resp, true); err != nil {
+		return err
+	}
+
+	body := make([]byte, n)
+	mathrand.Read(body)
+	if _, err := brw.Write(body); err != nil {
+		return err
+	}
+
+	return brw.Flush()
+}
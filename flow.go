@@ -0,0 +1,162 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+type flowKey struct{}
+
+// flow tracks a request handled by mainHandler: it records the status of
+// the response and the injected fault for the metrics and, when the flow is
+// dumped, the first bytes of the bodies
+type flow struct {
+	http.ResponseWriter
+	tenant   *tenant
+	start    time.Time
+	url      string
+	host     string
+	path     string
+	status   int
+	fault    string
+	rule     string
+	hijacked bool
+	dump     bool
+	reqBody  *capture
+	respBody *capture
+}
+
+// startFlow wraps w with the flow of r, the returned request carries the
+// flow and the tenant in its context. On the listeners of the default
+// tenant the virtual host, if any, is the tenant: the Host header can't
+// move a request to another tenant
+func startFlow(w http.ResponseWriter, r *http.Request) (*flow, *http.Request) {
+	t := tenantOf(r.Context())
+	if t == defaultTenant {
+		if vt := virtualHost(r.Host); vt != nil {
+			t = vt
+		}
+	}
+
+	f := &flow{
+		ResponseWriter: w,
+		tenant:         t,
+		start:          time.Now(),
+		url:            r.URL.String(),
+		host:           r.Host,
+		path:           r.URL.Path,
+		dump:           dumpFlow(r),
+	}
+
+	size := 0
+	if f.dump {
+		size = dumpMaxBody
+	}
+	if recording() && recordMaxBody > size {
+		size = recordMaxBody
+	}
+	if f.dump || recording() {
+		f.reqBody = captureBody(r, size)
+		f.respBody = &capture{max: size}
+	}
+
+	ctx := context.WithValue(withTenant(r.Context(), t), flowKey{}, f)
+	return f, r.WithContext(ctx)
+}
+
+// flowOf returns the flow of r, nil if r is not handled by mainHandler
+func flowOf(r *http.Request) *flow {
+	f, _ := r.Context().Value(flowKey{}).(*flow)
+	return f
+}
+
+func (f *flow) WriteHeader(status int) {
+	if f.status == 0 {
+		f.status = status
+		f.annotate(f.Header(), status)
+	}
+	f.ResponseWriter.WriteHeader(status)
+}
+
+func (f *flow) Write(p []byte) (int, error) {
+	if f.status == 0 {
+		f.status = http.StatusOK
+		f.annotate(f.Header(), f.status)
+	}
+	if f.respBody != nil {
+		f.respBody.Write(p)
+	}
+
+	return f.ResponseWriter.Write(p)
+}
+
+func (f *flow) Flush() {
+	if fl, ok := f.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+func (f *flow) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := f.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+
+	f.hijacked = true
+	return h.Hijack()
+}
+
+// annotate adds to h, the headers of a response with the given status, the
+// -fault-header describing the fault injected so far, if any
+func (f *flow) annotate(h http.Header, status int) {
+	if faultHeader == "" || f.fault == "" {
+		return
+	}
+
+	v := fmt.Sprintf("%s;status=%d", f.fault, status)
+	if f.rule != "" {
+		v += ";rule=" + f.rule
+	}
+	h.Set(faultHeader, v)
+}
+
+// finish records the metrics of the flow of r, dumps and records it if
+// requested. The part of the request body not read by the proxy is drained
+// up to the size cap
+func (f *flow) finish(r *http.Request) {
+	status := f.status
+	if status == 0 && !f.hijacked {
+		status = http.StatusOK
+	}
+
+	if f.reqBody != nil {
+		io.Copy(ioutil.Discard, io.LimitReader(r.Body, int64(f.reqBody.max)))
+	}
+	if f.dump {
+		writeDump(r, f)
+	}
+	if recording() {
+		recordFlow(r, f, status)
+	}
+	recordRequest(requestRecord{
+		tenant:   f.tenant.name,
+		method:   r.Method,
+		host:     f.host,
+		path:     f.path,
+		status:   status,
+		fault:    f.fault,
+		duration: time.Since(f.start),
+		traceID:  traceID(r),
+	})
+}
@@ -0,0 +1,196 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/meox/floki-proxy/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// graphqlMessage is the error of graphql-partial without a message
+const graphqlMessage = "injected fault"
+
+// inspectGraphQL returns r carrying its GraphQL operation, when the rules
+// of rs look at it: the query of a GET or the body of a POST, read up to
+// max bytes and restored. The body of an "Expect: 100-continue" request is
+// left alone, reading it would send the interim 100 to the client
+func inspectGraphQL(r *http.Request, rs *types.RuleSet, max int64) *http.Request {
+	if !rs.InspectsGraphQL() {
+		return r
+	}
+
+	var op *types.GraphQLOperation
+	var err error
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Get("query") != "":
+		q := r.URL.Query()
+		op, err = types.ParseGraphQL(q.Get("query"), q.Get("operationName"))
+	case r.Method == http.MethodPost && r.Body != nil && r.Body != http.NoBody && !expectsContinue(r):
+		ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if ct != "application/json" && ct != "application/graphql" {
+			return r
+		}
+		b, rerr := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), r.Body), r.Body}
+		if rerr != nil {
+			return r
+		}
+		if int64(len(b)) > max {
+			log.Debugf("request body too large to be inspected: %s", r.RequestURI)
+			return r
+		}
+		if ct == "application/graphql" {
+			op, err = types.ParseGraphQL(string(b), r.URL.Query().Get("operationName"))
+		} else {
+			op, err = types.ParseGraphQLRequest(b)
+		}
+	default:
+		return r
+	}
+	if err != nil {
+		log.Debugf("not a GraphQL request %s: %v", r.RequestURI, err)
+		return r
+	}
+
+	log.Debugf("GraphQL %s: %s", op, r.RequestURI)
+	return r.WithContext(types.WithGraphQL(r.Context(), op))
+}
+
+// graphqlPartial returns the terminal graphql-partial rule, if any
+func (rf requestFaults) graphqlPartial() *types.Rule {
+	if rf.terminal == nil || rf.terminal.Action.Type != types.ActionGraphQLPart {
+		return nil
+	}
+
+	return rf.terminal
+}
+
+// graphqlError is an entry of the errors of a GraphQL response
+type graphqlError struct {
+	Message string   `json:"message"`
+	Path    []string `json:"path"`
+}
+
+// partialResponse sets to null some of the top-level fields of the data of
+// the JSON response resp, of the operation op, adding an error for each of
+// them. Up to max bytes are read, a larger body is left untouched
+func partialResponse(resp *http.Response, op *types.GraphQLOperation, rule *types.Rule, max int64) ([]string, error) {
+	ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" || (ct != "application/json" && !strings.HasSuffix(ct, "+json")) {
+		return nil, errors.New("not a JSON response")
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, max+1))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > max {
+		return nil, errors.New("response body too large")
+	}
+
+	var doc map[string]json.RawMessage
+	var data map[string]json.RawMessage
+	if json.Unmarshal(b, &doc) != nil || json.Unmarshal(doc["data"], &data) != nil || len(data) == 0 {
+		return nil, errors.New("no data in the response")
+	}
+	var errs []json.RawMessage
+	if raw, ok := doc["errors"]; ok && json.Unmarshal(raw, &errs) != nil {
+		return nil, errors.New("bad errors in the response")
+	}
+
+	msg := rule.Action.Message
+	if msg == "" {
+		msg = graphqlMessage
+	}
+	keys := partialKeys(op, rule, data)
+	if len(keys) == 0 {
+		return nil, errors.New("none of the fields in the response")
+	}
+	for _, k := range keys {
+		data[k] = json.RawMessage("null")
+		e, _ := json.Marshal(graphqlError{Message: msg, Path: []string{k}})
+		errs = append(errs, e)
+	}
+	doc["data"], _ = json.Marshal(data)
+	doc["errors"], _ = json.Marshal(errs)
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(out))
+	resp.ContentLength = int64(len(out))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	return keys, nil
+}
+
+// partialKeys returns the keys of data the rule sets to null: the fields of
+// the action or, if none, of the match; without either all the fields but
+// the first one
+func partialKeys(op *types.GraphQLOperation, rule *types.Rule, data map[string]json.RawMessage) []string {
+	// the response keys in the order of the selection
+	var keys, names []string
+	if op != nil {
+		for _, f := range op.Fields {
+			if _, ok := data[f.Key]; ok && !contains(keys, f.Key) {
+				keys, names = append(keys, f.Key), append(names, f.Name)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		for k := range data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		names = keys
+	}
+
+	fields := rule.Action.Fields
+	if len(fields) == 0 {
+		fields = rule.Match.GraphQLFields
+	}
+	if len(fields) == 0 {
+		if len(keys) > 1 {
+			return keys[1:]
+		}
+		return keys
+	}
+
+	var selected []string
+	for i, k := range keys {
+		if contains(fields, names[i]) || contains(fields, k) {
+			selected = append(selected, k)
+		}
+	}
+	return selected
+}
+
+func contains(xs []string, x string) bool {
+	for _, e := range xs {
+		if e == x {
+			return true
+		}
+	}
+
+	return false
+}
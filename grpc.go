@@ -0,0 +1,156 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/meox/floki-proxy/types"
+)
+
+// errStreamCut is returned by a streamCut reaching its limit
+var errStreamCut = errors.New("gRPC stream cut")
+
+// grpcStatus returns the terminal grpc-status rule, if any
+func (rf requestFaults) grpcStatus() *types.Rule {
+	if rf.terminal == nil || rf.terminal.Action.Type != types.ActionGRPCStatus {
+		return nil
+	}
+
+	return rf.terminal
+}
+
+// grpcCut returns the terminal grpc-cut rule, if any
+func (rf requestFaults) grpcCut() *types.Rule {
+	if rf.terminal == nil || rf.terminal.Action.Type != types.ActionGRPCCut {
+		return nil
+	}
+
+	return rf.terminal
+}
+
+// setGRPCStatus sets the grpc-status and grpc-message of a into h, prefix
+// is http.TrailerPrefix to set them as trailers
+func setGRPCStatus(h http.Header, prefix string, a types.Action) {
+	h[prefix+"Grpc-Status"] = []string{strconv.Itoa(a.Status)}
+	delete(h, prefix+"Grpc-Message")
+	if a.Message != "" {
+		h[prefix+"Grpc-Message"] = []string{encodeGRPCMessage(a.Message)}
+	}
+}
+
+// encodeGRPCMessage percent-encodes the bytes of msg outside the printable
+// ASCII range, as required for grpc-message
+func encodeGRPCMessage(msg string) string {
+	var sb strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&sb, "%%%02X", c)
+			continue
+		}
+		sb.WriteByte(c)
+	}
+
+	return sb.String()
+}
+
+// streamCut wraps the body of a gRPC response ending it, with errStreamCut,
+// right after the given number of length-prefixed messages or when the
+// timer fires
+type streamCut struct {
+	body     io.ReadCloser
+	limit    int
+	messages int
+	timer    *time.Timer
+	fired    int32
+
+	// framing state: the bytes of the message prefix read so far or, once
+	// complete, the bytes left of the message
+	prefix  [5]byte
+	prefixN int
+	left    uint32
+}
+
+func newStreamCut(body io.ReadCloser, a types.Action) *streamCut {
+	sc := &streamCut{body: body, limit: a.Messages}
+	if a.After > 0 {
+		sc.timer = time.AfterFunc(a.After, func() {
+			atomic.StoreInt32(&sc.fired, 1)
+			body.Close()
+		})
+	}
+
+	return sc
+}
+
+func (sc *streamCut) Read(p []byte) (int, error) {
+	if sc.limitReached() {
+		return 0, errStreamCut
+	}
+
+	n, err := sc.body.Read(p)
+	if atomic.LoadInt32(&sc.fired) == 1 {
+		return n, errStreamCut
+	}
+
+	for i := 0; i < n; {
+		if sc.prefixN < len(sc.prefix) {
+			c := copy(sc.prefix[sc.prefixN:], p[i:n])
+			sc.prefixN += c
+			i += c
+			if sc.prefixN < len(sc.prefix) {
+				break
+			}
+			sc.left = binary.BigEndian.Uint32(sc.prefix[1:])
+		} else {
+			c := n - i
+			if uint32(c) > sc.left {
+				c = int(sc.left)
+			}
+			sc.left -= uint32(c)
+			i += c
+		}
+
+		if sc.left == 0 {
+			sc.messages++
+			sc.prefixN = 0
+			if sc.limitReached() {
+				return i, errStreamCut
+			}
+		}
+	}
+
+	return n, err
+}
+
+func (sc *streamCut) Close() error {
+	sc.stop()
+	return sc.body.Close()
+}
+
+// stop disarms the timer
+func (sc *streamCut) stop() {
+	if sc.timer != nil {
+		sc.timer.Stop()
+	}
+}
+
+// cut report if the stream has been cut
+func (sc *streamCut) cut() bool {
+	return sc.limitReached() || atomic.LoadInt32(&sc.fired) == 1
+}
+
+func (sc *streamCut) limitReached() bool {
+	return sc.limit > 0 && sc.messages >= sc.limit
+}
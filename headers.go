@@ -0,0 +1,159 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// conditionalHeaders are the request validators used by conditional requests
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since"}
+
+// isConditional report if r is a conditional GET
+func isConditional(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	for _, h := range conditionalHeaders {
+		if r.Header.Get(h) != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stripValidators removes the validators from the request heading upstream,
+// forcing a full response even if the client holds a valid copy
+func stripValidators(req *http.Request) {
+	for _, h := range conditionalHeaders {
+		req.Header.Del(h)
+	}
+}
+
+const (
+	validatorsRewrite   = "rewrite"
+	validatorsRandomize = "randomize"
+	validatorsDrop      = "drop"
+)
+
+// manipulateValidators alters the ETag and Last-Modified response headers:
+// validatorsRewrite derives a different but stable value, validatorsRandomize
+// sets a new random value every time and validatorsDrop removes them
+func manipulateValidators(h http.Header, mode string) {
+	switch mode {
+	case validatorsDrop:
+		h.Del("ETag")
+		h.Del("Last-Modified")
+	case validatorsRandomize:
+		if h.Get("ETag") != "" {
+			h.Set("ETag", fmt.Sprintf("%q", strconv.FormatUint(mathrand.Uint64(), 36)))
+		}
+		if h.Get("Last-Modified") != "" {
+			t := time.Now().Add(-time.Duration(mathrand.Int63n(int64(365 * 24 * time.Hour))))
+			h.Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+		}
+	default:
+		if etag := h.Get("ETag"); etag != "" {
+			h.Set("ETag", rewriteETag(etag))
+		}
+		if t, err := http.ParseTime(h.Get("Last-Modified")); err == nil {
+			h.Set("Last-Modified", t.Add(time.Hour).UTC().Format(http.TimeFormat))
+		}
+	}
+}
+
+// rewriteETag returns a new ETag derived from etag, preserving the weakness
+func rewriteETag(etag string) string {
+	prefix := ""
+	if strings.HasPrefix(etag, "W/") {
+		prefix, etag = "W/", etag[2:]
+	}
+
+	return fmt.Sprintf("%s%q", prefix, strings.Trim(etag, `"`)+"-floki")
+}
+
+const (
+	cookieDrop         = "drop"
+	cookieMutate       = "mutate"
+	cookieExpire       = "expire"
+	cookieStripRequest = "strip-request"
+)
+
+// tamperSetCookies alters the Set-Cookie headers of resp: cookieDrop removes
+// them, cookieMutate replaces the values with random ones and cookieExpire
+// makes the client delete the cookies
+func tamperSetCookies(resp *http.Response, mode string) {
+	cookies := resp.Cookies()
+	resp.Header.Del("Set-Cookie")
+	if mode == cookieDrop {
+		return
+	}
+
+	for _, c := range cookies {
+		switch mode {
+		case cookieMutate:
+			c.Value = strconv.FormatUint(mathrand.Uint64(), 36)
+		case cookieExpire:
+			c.MaxAge = -1
+			c.Expires = time.Unix(0, 0)
+		}
+		resp.Header.Add("Set-Cookie", c.String())
+	}
+}
+
+const (
+	authStrip   = "strip"
+	authCorrupt = "corrupt"
+)
+
+// authHeaders are the request headers carrying credentials
+var authHeaders = []string{"Authorization", "Proxy-Authorization"}
+
+// tamperAuthorization strips or corrupts the credentials of the request
+// heading upstream, it returns false if no credentials were found
+func tamperAuthorization(req *http.Request, mode string) bool {
+	found := false
+	for _, h := range authHeaders {
+		v := req.Header.Get(h)
+		if v == "" {
+			continue
+		}
+
+		found = true
+		if mode == authStrip {
+			req.Header.Del(h)
+			continue
+		}
+		req.Header.Set(h, corruptCredentials(v))
+	}
+
+	return found
+}
+
+// corruptCredentials keeps the authentication scheme and replaces some
+// characters of the credentials
+func corruptCredentials(v string) string {
+	scheme, token := "", v
+	if i := strings.IndexByte(v, ' '); i >= 0 {
+		scheme, token = v[:i+1], v[i+1:]
+	}
+	if token == "" {
+		return scheme + "floki"
+	}
+
+	b := []byte(token)
+	for i := 0; i < 1+len(b)/8; i++ {
+		b[mathrand.Intn(len(b))] = "abcdefghijklmnopqrstuvwxyz0123456789"[mathrand.Intn(36)]
+	}
+
+	return scheme + string(b)
+}
@@ -0,0 +1,44 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+
+	"github.com/meox/floki-proxy/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// importEnvoy translates the fault filters of an Envoy configuration into a
+// rules file
+func importEnvoy(args []string) {
+	fs := flag.NewFlagSet("import-envoy", flag.ExitOnError)
+	in := fs.String("config", "envoy.yaml", "Envoy configuration (JSON or YAML) to import")
+	out := fs.String("out", "", "rules file (YAML) to write, the standard output when empty")
+	fs.Parse(args)
+
+	raw, err := ioutil.ReadFile(*in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rules, warnings, err := types.ImportEnvoy(raw)
+	if err != nil {
+		log.Fatalf("%s: %v", *in, err)
+	}
+	for _, w := range warnings {
+		log.Warnf("%s: %s", *in, w)
+	}
+
+	if *out == "" {
+		os.Stdout.Write(rules)
+		return
+	}
+	if err := ioutil.WriteFile(*out, rules, 0644); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("written %s", *out)
+}
@@ -0,0 +1,38 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+)
+
+// sendInterim takes over the connection of the flow f and sends the
+// spurious informational responses (-interim-status, -interim-count times)
+// ahead of the final one. The interim 100 expected by r is sent first,
+// unless withheld. The returned function closes the connection
+func sendInterim(f *flow, r *http.Request, withheld bool) (func(), error) {
+	cw, closeConn, err := takeOver(f, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if expectsContinue(r) && !withheld {
+		if err := cw.writeInterim(http.StatusContinue, http.Header{}); err != nil {
+			return closeConn, err
+		}
+	}
+
+	h := http.Header{}
+	if interimStatus == http.StatusEarlyHints && interimLink != "" {
+		h.Set("Link", interimLink)
+	}
+	for i := 0; i < interimCount; i++ {
+		if err := cw.writeInterim(interimStatus, h); err != nil {
+			return closeConn, err
+		}
+	}
+
+	return closeConn, nil
+}
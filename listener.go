@@ -0,0 +1,220 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// parseUpstream validates the upstream used in reverse proxy mode
+func parseUpstream(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing upstream %s: %w", raw, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("bad upstream %s: expected an http or https URL", raw)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("bad upstream %s: missing host", raw)
+	}
+
+	return u, nil
+}
+
+// listenHost is the interface of the first -listen address, the tenants and
+// the TCP and UDP proxies listen on it too. Empty for all the interfaces
+var listenHost string
+
+// bindAddr returns the address at the given port on listenHost
+func bindAddr(port int) string {
+	return net.JoinHostPort(listenHost, strconv.Itoa(port))
+}
+
+// parseListen validates the comma separated addresses of -listen, the
+// proxy listens on all the interfaces at the given port if there are none
+func parseListen(raw string, port int) ([]string, error) {
+	addrs := splitList(raw)
+	if len(addrs) == 0 {
+		return []string{fmt.Sprintf(":%d", port)}, nil
+	}
+
+	for _, addr := range addrs {
+		_, p, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("bad listen address %s: %w", addr, err)
+		}
+		if n, err := strconv.Atoi(p); err != nil || n <= 0 || n > 65535 {
+			return nil, fmt.Errorf("bad listen address %s: bad port %s", addr, p)
+		}
+	}
+
+	return addrs, nil
+}
+
+// resolveTarget rewrites the URL of an origin-form request (reverse proxy
+// mode) to point to upstream. Absolute-form requests (forward proxy mode)
+// are left untouched
+func resolveTarget(r *http.Request, upstream *url.URL) {
+	if upstream == nil || r.URL.Host != "" {
+		return
+	}
+
+	r.URL.Scheme = upstream.Scheme
+	r.URL.Host = upstream.Host
+	if upstream.Path != "" && upstream.Path != "/" {
+		r.URL.Path = singleJoiningSlash(upstream.Path, r.URL.Path)
+		r.URL.RawPath = ""
+	}
+}
+
+// overrideHost redirects the request to the host configured for its target
+// host (if any), the original port is kept unless the override carries one
+func overrideHost(r *http.Request) (string, bool) {
+	to, ok := hostOverrides[r.URL.Hostname()]
+	if !ok {
+		return "", false
+	}
+
+	if _, _, err := net.SplitHostPort(to); err != nil && r.URL.Port() != "" {
+		to = net.JoinHostPort(to, r.URL.Port())
+	}
+	r.URL.Host = to
+
+	return to, true
+}
+
+func singleJoiningSlash(a, b string) string {
+	trailing := strings.HasSuffix(b, "/") && b != "/"
+	joined := path.Join(a, b)
+	if trailing {
+		joined += "/"
+	}
+
+	return joined
+}
+
+// listenerTLSConfig builds the TLS configuration of the listener. Every
+// certificate/key pair is selected by SNI, the ACME domains (if any) get
+// their certificates from Let's Encrypt
+func listenerTLSConfig(certs, keys []string, acmeDomains []string, acmeCache string) (*tls.Config, error) {
+	if len(certs) != len(keys) {
+		return nil, fmt.Errorf("got %d certificates and %d keys", len(certs), len(keys))
+	}
+
+	cfg := &tls.Config{}
+	for i := range certs {
+		pair, err := tls.LoadX509KeyPair(certs[i], keys[i])
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %w", certs[i], err)
+		}
+		cfg.Certificates = append(cfg.Certificates, pair)
+	}
+
+	if len(acmeDomains) == 0 {
+		return cfg, nil
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(acmeDomains...),
+	}
+	if acmeCache != "" {
+		m.Cache = autocert.DirCache(acmeCache)
+	}
+
+	static := cfg.Certificates
+	cfg.Certificates = nil
+	cfg.NextProtos = []string{"http/1.1", "acme-tls/1"}
+	cfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		for i := range static {
+			if hello.SupportsCertificate(&static[i]) == nil {
+				return &static[i], nil
+			}
+		}
+
+		return m.GetCertificate(hello)
+	}
+
+	return cfg, nil
+}
+
+// requireClientCerts configures the verification of the client certificates
+// against the CA bundle in caFile, rejecting the ones listed in the
+// (optional) revocation list crlFile and randomly rejecting rejectRate
+// percent of the valid ones
+func requireClientCerts(cfg *tls.Config, caFile, crlFile string, rejectRate float64) error {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("reading client CA: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificate found in %s", caFile)
+	}
+
+	revoked := make(map[string]bool)
+	if crlFile != "" {
+		raw, err := ioutil.ReadFile(crlFile)
+		if err != nil {
+			return fmt.Errorf("reading client CRL: %w", err)
+		}
+		crl, err := x509.ParseCRL(raw)
+		if err != nil {
+			return fmt.Errorf("parsing client CRL: %w", err)
+		}
+		for _, rc := range crl.TBSCertList.RevokedCertificates {
+			revoked[rc.SerialNumber.String()] = true
+		}
+	}
+
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	cfg.ClientCAs = pool
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("missing client certificate")
+		}
+
+		leaf := cs.PeerCertificates[0]
+		if revoked[leaf.SerialNumber.String()] {
+			log.Warnf("rejecting revoked client certificate %s", leaf.Subject)
+			return fmt.Errorf("client certificate %s revoked", leaf.SerialNumber)
+		}
+		if injectFault(rejectRate, "client-cert-reject", leaf.Subject.String()) {
+			log.Warnf("randomly rejecting client certificate %s", leaf.Subject)
+			return errors.New("client certificate rejected by floki")
+		}
+
+		return nil
+	}
+
+	return nil
+}
+
+// splitList splits a comma separated flag value ignoring empty items
+func splitList(x string) []string {
+	var rs []string
+	for _, e := range strings.Split(x, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			rs = append(rs, e)
+		}
+	}
+
+	return rs
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/meox/floki-proxy/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// log formats
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// setupLogger applies the log level and format
+func setupLogger(level, format string) error {
+	lvl, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(lvl)
+
+	switch format {
+	case logFormatText:
+		log.SetFormatter(&log.TextFormatter{})
+	case logFormatJSON:
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("bad log format %q: expected text or json", format)
+	}
+
+	return nil
+}
+
+// log outputs
+const (
+	logOutputStderr   = "stderr"
+	logOutputSyslog   = "syslog"
+	logOutputJournald = "journald"
+)
+
+// setupLogOutput sends the logs to stderr, to syslog or to the systemd
+// journal
+func setupLogOutput(output, syslogAddr string) error {
+	var hook log.Hook
+	var err error
+	switch output {
+	case logOutputStderr:
+		return nil
+	case logOutputSyslog:
+		hook, err = newSyslogHook(syslogAddr)
+	case logOutputJournald:
+		hook, err = newJournaldHook()
+	default:
+		return fmt.Errorf("bad log output %q: expected stderr, syslog or journald", output)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.AddHook(hook)
+	log.SetOutput(ioutil.Discard)
+	return nil
+}
+
+// samplingFormatter drops a share of the entries of the sampled levels, the
+// other levels are always logged
+type samplingFormatter struct {
+	rates map[log.Level]float64
+	log.Formatter
+}
+
+// newSamplingFormatter wraps f with the sampling rates by level name
+func newSamplingFormatter(f log.Formatter, rates types.RateMap) (*samplingFormatter, error) {
+	sf := &samplingFormatter{rates: make(map[log.Level]float64), Formatter: f}
+	for name, rate := range rates {
+		lvl, err := log.ParseLevel(name)
+		if err != nil {
+			return nil, err
+		}
+		if lvl <= log.ErrorLevel {
+			return nil, fmt.Errorf("level %s cannot be sampled", name)
+		}
+		sf.rates[lvl] = rate
+	}
+
+	return sf, nil
+}
+
+func (sf *samplingFormatter) Format(e *log.Entry) ([]byte, error) {
+	if rate, ok := sf.rates[e.Level]; ok && !sampled(rate) {
+		return nil, nil
+	}
+
+	return sf.Formatter.Format(e)
+}
@@ -8,12 +8,19 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	mathrand "math/rand"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/meox/floki-proxy/types"
@@ -21,50 +28,445 @@ import (
 )
 
 var (
-	port                int
-	failureRate         int
-	failureTransferRate int
-	maxFailure          int
-	failureCode         int
-	failWithPrefix      types.FailingPrefixCode
-	methodCounters      *types.MethodCounters
+	port                  int
+	listenFlag            string
+	listenAddrs           []string
+	failureRate           float64
+	failureTransferRate   float64
+	maxFailure            int64
+	hangRate              float64
+	hangMode              string
+	wrongLengthRate       float64
+	wrongLengthDelta      int
+	badChunkedRate        float64
+	badChunkedMode        string
+	garbageRate           float64
+	garbageBytes          int
+	http10Rate            float64
+	protocolErrorRate     float64
+	protocolErrorMode     string
+	mitmCACert            string
+	mitmCAKey             string
+	mitmCA                *certAuthority
+	mitmBadCerts          types.StringMap
+	tlsFaultRate          float64
+	tlsFault              string
+	sniRuleFlags          types.StringMap
+	sniRules              map[string]sniRule
+	connectPorts          string
+	upstreamAddr          string
+	upstream              *upstreamPool
+	tlsCerts              string
+	tlsKeys               string
+	acmeDomains           string
+	acmeCache             string
+	tlsClientCA           string
+	tlsClientCRL          string
+	tlsClientRejectRate   float64
+	upstreamClientCerts   types.StringMap
+	upstreamClient        *http.Client
+	cacheSize             int
+	cacheTTL              time.Duration
+	cacheMaxBody          int64
+	cacheStaleRate        float64
+	cacheMismatchRate     float64
+	responseCache         *types.ResponseCache
+	notModifiedRate       float64
+	stripValidatorsRate   float64
+	validatorsFaultRate   float64
+	validatorsFault       string
+	redirectRate          float64
+	redirectCode          int
+	redirectDepth         int
+	redirectLoop          bool
+	followRedirects       int
+	cookieFaultRate       float64
+	cookieFault           string
+	authFaultRate         float64
+	authFault             string
+	requestHeaders        types.RewriteRules
+	responseHeaders       types.RewriteRules
+	queryRewrites         types.RewriteRules
+	pathRewrites          types.PathRewrites
+	hostOverrides         types.StringMap
+	resolveOverrides      types.ResolveMap
+	denyList              types.URLList
+	allowList             types.URLList
+	maxThroughput         int64
+	globalBucket          *types.TokenBucket
+	latencyPerKB          time.Duration
+	networkName           string
+	network               *types.NetworkProfile
+	stallRate             float64
+	stallMax              time.Duration
+	wsDropRate            float64
+	wsDelayRate           float64
+	wsDelay               time.Duration
+	wsReorderRate         float64
+	wsReorderWindow       int
+	wsCloseRate           float64
+	wsCloseCode           int
+	wsCloseAfter          time.Duration
+	sseDropRate           float64
+	sseDuplicateRate      float64
+	sseDelayRate          float64
+	sseDelay              time.Duration
+	expectFaultRate       float64
+	expectFault           string
+	expectFaultCode       int
+	expectContinueTimeout time.Duration
+	interimRate           float64
+	interimStatus         int
+	interimCount          int
+	interimLink           string
+	noBodyViolationRate   float64
+	noBodyViolationBytes  int
+	corsPermissive        bool
+	corsFaultRate         float64
+	corsFault             string
+	preflightEnabled      bool
+	preflightOrigins      string
+	preflightMethods      string
+	preflightHeaders      string
+	preflightMaxAge       time.Duration
+	preflightFailRate     float64
+	preflight             preflightPolicy
+	rangeFaultRate        float64
+	rangeFault            string
+	digestFaultRate       float64
+	digestFault           string
+	duplicateRate         float64
+	duplicateDelay        time.Duration
+	duplicateMaxBody      int64
+	reorderWindow         int
+	reorderWait           time.Duration
+	queueServiceTime      time.Duration
+	queueCapacity         int
+	targetErrorRate       float64
+	targetErrorInterval   time.Duration
+	faultArrivalRate      float64
+	faultArrivalDuration  time.Duration
+	methodFailureRates    types.RateMap
+	hostFailureRates      types.RateMap
+	ruleFlags             types.RuleFlags
+	rulesMode             string
+	rulesFile             string
+	dryRun                bool
+	dumpList              types.URLList
+	dumpMaxBody           int
+	dumpFile              string
+	recordFile            string
+	recordMaxBody         int
+	showVersion           bool
+	h2cEnabled            bool
+	logBodiesRate         float64
+	logBodiesMax          int
+	redactHeaders         string
+	logSampling           types.RateMap
+	logLevel              string
+	logFormat             string
+	logOutput             string
+	syslogAddr            string
+	logFile               string
+	statsdAddr            string
+	statsdPrefix          string
+	statsdTags            string
+	eventsURL             string
+	maxClientConns        int
+	clientConnsAction     string
+	connectionCloseRate   float64
+	tcpProxies            types.Forwards
+	tcpDelay              time.Duration
+	tcpBandwidth          int64
+	tcpDisconnectRate     float64
+	tcpCorruptRate        float64
+	udpProxies            types.Forwards
+	transparentMode       string
+	proxyProtocol         bool
+	upstreamProxyProtocol int
+	udpDelay              time.Duration
+	udpLossRate           float64
+	udpDuplicateRate      float64
+	udpReorderRate        float64
+	udpReorderDelay       time.Duration
+	dnsServer             string
+	dnsTimeout            time.Duration
+	dnsDelay              time.Duration
+	dnsDelayRate          float64
+	dnsServfailRate       float64
+	negativeCacheTTL      time.Duration
+	upstreamTimeout       time.Duration
+	healthPath            string
+	routeSpecs            types.RouteSpecs
+	variantSpecs          types.VariantSpecs
+	variantKey            string
+	canaryAddr            string
+	canaryWeightFlag      float64
+	stickyCookie          string
+	stickyHeader          string
+	healthInterval        time.Duration
+	healthTimeout         time.Duration
+	healthUnhealthy       int
+	healthHealthy         int
+	bufferSize            int
+	retryCount            int
+	retryBackoff          time.Duration
+	retryStatuses         string
+	retryMethods          string
+	retryMaxBody          int64
+	graphqlMaxBody        int64
+	upstreamRetries       *retryPolicy
+	adminPort             int
+	adminListen           string
+	metricLabelsFlag      string
+	metricLabels          []string
+	metricBuckets         types.Buckets
+	pathTemplates         types.PathTemplates
+	exemplarHeader        string
+	faultHeader           string
+	auditFile             string
+	webhooks              string
+	webhookErrorRate      float64
+	webhookInterval       time.Duration
+	ruleSet               *types.RuleSet
+	tenantSpecs           types.TenantSpecs
+	vhostSpecs            types.VirtualHostSpecs
+	failureCode           int
+	failureTTL            time.Duration
+	failureDeadline       time.Time
+	failWithPrefix        types.FailingPrefixCode
+	methodCounters        *types.MethodCounters
 )
 
 func mainHandler(w http.ResponseWriter, r *http.Request) {
-	if shouldFail(failureRate) {
-		w.WriteHeader(failureCode)
-		log.Warnf("failing request to: %s", r.RequestURI)
+	f, r := startFlow(w, r)
+	w = f
+	defer func() { f.finish(r) }()
+	t := f.tenant
+	load := t.load.Start()
+	defer t.load.Done()
+
+	// the rules match the path requested by the client
+	clientPath := r.URL.Path
+	handled, chained := continueRedirect(w, r)
+	if handled {
 		return
 	}
 
-	statusCode, failed := shouldFailByPrefix(r.URL.Path)
-	if failed {
-		w.WriteHeader(statusCode)
-		log.Warnf("failing request due to prefix match: %s", r.RequestURI)
+	if p, ok := t.pathRewrites.Apply(clientPath); ok {
+		r.URL.Path, r.URL.RawPath = p, ""
+		log.Debugf("rewritten path %s to %s", clientPath, p)
+	}
+	dialAddr := transparentTarget(r)
+	upstreamURL, affinity := t.upstream.route(r)
+	if u := routeTarget(t, r); u != nil {
+		upstreamURL, affinity = u, ""
+	} else if u := canaryTarget(t, r); u != nil {
+		upstreamURL, affinity = u, ""
+	}
+	resolveTarget(r, upstreamURL)
+	targetHost := r.URL.Host
+	f.host = targetHost
+	if to, ok := overrideHost(r); ok {
+		log.Debugf("overriding host %s with %s", targetHost, to)
+		dialAddr = ""
+	}
+
+	if blocked(r.URL.Host, clientPath) {
+		reject(w)
 		return
 	}
 
+	r = inspectGraphQL(r, t.ruleSet, graphqlMaxBody)
 	ctx := r.Context()
+	faults := evaluateRules(r, r.URL.Host, clientPath, load)
+	if chained {
+		// the last hop of an injected chain is never redirected again
+		faults.dropRedirect()
+	}
+	if faults.delay > 0 {
+		log.Warnf("delaying request by %s: %s", faults.delay, r.RequestURI)
+		if sleepContext(ctx, faults.delay) != nil {
+			return
+		}
+	}
+	if faults.respondsEarly() {
+		faults.applyEarly(w, r, clientPath)
+		return
+	}
+	if serveVariant(w, r, clientPath) {
+		return
+	}
+	if arrivals != nil && arrivals.trigger(time.Now()) && injectRequestFault(r, 100, "fault-arrival") {
+		w.WriteHeader(failureCode)
+		log.Warnf("failing request on fault arrival: %s", r.RequestURI)
+		return
+	}
+
+	if isPreflight(r) {
+		if injectRequestFault(r, preflightFailRate, "preflight-fail") {
+			w.WriteHeader(http.StatusForbidden)
+			log.Warnf("failing preflight request: %s", r.RequestURI)
+			return
+		}
+		if preflightEnabled {
+			preflight.answer(w, r)
+			return
+		}
+	}
+
+	if len(t.queryRewrites) > 0 {
+		q := r.URL.Query()
+		if n := t.queryRewrites.ApplyQuery(q, clientPath); n > 0 {
+			r.URL.RawQuery = q.Encode()
+			log.Debugf("applied %d query rules: %s", n, r.RequestURI)
+		}
+	}
+
+	if isConditional(r) && injectRequestFault(r, notModifiedRate, "not-modified") {
+		w.WriteHeader(http.StatusNotModified)
+		log.Warnf("answering conditional request with 304: %s", r.RequestURI)
+		return
+	}
+	if cacheableRequest(r) && serveFromCache(w, r, clientPath) {
+		return
+	}
+
+	if network != nil && sleepContext(ctx, network.Delay()) != nil {
+		return
+	}
+	if d := queueDelay(load.InFlight); d > 0 && injectRequestFault(r, 100, "queueing") {
+		log.Debugf("queueing request for %s (%d in flight): %s", d, load.InFlight, r.RequestURI)
+		if sleepContext(ctx, d) != nil {
+			return
+		}
+	}
 
 	// update counters
-	methodCounters.Add(r.Method, 1)
+	t.counters.Add(r.Method, 1)
+
+	withheld := false
+	if expectsContinue(r) && injectRequestFault(r, expectFaultRate, "expect-"+expectFault) {
+		if expectFault == expectEarlyStatus {
+			w.Header().Set("Connection", "close")
+			w.WriteHeader(expectFaultCode)
+			log.Warnf("answering %d before reading the body: %s", expectFaultCode, r.RequestURI)
+			return
+		}
+
+		closeConn, err := withholdContinue(f, r)
+		if err != nil {
+			log.Errorf("withholding the interim 100: %v", err)
+		} else {
+			defer closeConn()
+			withheld = true
+			log.Warnf("withholding the interim 100: %s", r.RequestURI)
+		}
+	}
+
+	// the informational responses can't be sent to HTTP/1.0 clients
+	if r.ProtoMajor == 1 && r.ProtoMinor == 1 && injectRequestFault(r, interimRate, "interim") {
+		closeConn, err := sendInterim(f, r, withheld)
+		if closeConn != nil {
+			defer closeConn()
+		}
+		if err != nil {
+			log.Errorf("sending interim responses: %v", err)
+			return
+		}
+		log.Warnf("sending %d interim %d responses: %s", interimCount, interimStatus, r.RequestURI)
+	}
+
+	// a sample of the requests logs the bodies
+	var reqBody, respBody *capture
+	if sampled(logBodiesRate) {
+		reqBody, respBody = captureBody(r, logBodiesMax), &capture{max: logBodiesMax}
+	}
 
-	req, err := http.NewRequestWithContext(ctx, r.Method, r.RequestURI, r.Body)
+	// the upstream request is bounded by the timeout until the response
+	// headers arrive, the body is copied with the waits injected by floki
+	upstreamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	timeout := upstreamTimeout
+	if faults.timeout > 0 {
+		timeout = faults.timeout
+	}
+	var deadline *time.Timer
+	if timeout > 0 {
+		deadline = time.AfterFunc(timeout, cancel)
+	}
+
+	req, err := http.NewRequestWithContext(upstreamCtx, r.Method, r.URL.String(), r.Body)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Errorf("creating request: %v", err)
 		return
 	}
+	if dialAddr != "" {
+		// intercepted in transparent mode: the Host is kept
+		req.Host, req.URL.Host = req.URL.Host, dialAddr
+	}
 
 	// attach the original headers
 	req.Header = r.Header.Clone()
 	req.ContentLength = r.ContentLength
+	// ignored when sending, it selects the cleartext HTTP/2 transport
+	req.ProtoMajor, req.ProtoMinor = r.ProtoMajor, r.ProtoMinor
 	req.Header.Set("Via", "floki proxy")
 	req.Header.Set("X-Forwarded-For", r.RemoteAddr)
 	req.Header.Set("X-Forwarded-Host", r.Host)
+	if n := t.requestHeaders.ApplyHeaders(req.Header, clientPath); n > 0 {
+		log.Debugf("applied %d request header rules: %s", n, r.RequestURI)
+	}
+	cookieTampered := injectRequestFault(r, cookieFaultRate, "cookie-"+cookieFault)
+	if cookieTampered && cookieFault == cookieStripRequest {
+		req.Header.Del("Cookie")
+		log.Warnf("stripping request cookies: %s", r.RequestURI)
+	}
+	if injectRequestFault(r, authFaultRate, "auth-"+authFault) && tamperAuthorization(req, authFault) {
+		log.Warnf("tampering credentials (%s): %s", authFault, r.RequestURI)
+	}
+	if req.Header.Get("Range") != "" && rangeFault == rangeIgnore && injectRequestFault(r, rangeFaultRate, "range-"+rangeFault) {
+		req.Header.Del("Range")
+		req.Header.Del("If-Range")
+		log.Warnf("ignoring range %s: %s", r.Header.Get("Range"), r.RequestURI)
+	}
+	if isConditional(r) && injectRequestFault(r, stripValidatorsRate, "strip-validators") {
+		stripValidators(req)
+		log.Warnf("stripping validators: %s", r.RequestURI)
+	}
+
+	if requestQueue != nil && injectRequestFault(r, 100, "reorder") && requestQueue.enter(ctx) != nil {
+		return
+	}
+
+	// a retrying intermediary delivers the request again
+	var dup *http.Request
+	if rollFault(duplicateRate, "duplicate", r.RequestURI) {
+		if dup, err = duplicateRequest(req, duplicateMaxBody); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Errorf("reading the request body: %v", err)
+			return
+		}
+		if dup == nil {
+			log.Debugf("request body too large to be duplicated: %s", r.RequestURI)
+		}
+	}
 
 	// perform the actual request
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := doUpstream(req, faults.retryPolicy(upstreamRetries), retryMaxBody)
+	if dup != nil {
+		go deliverDuplicate(r, dup, duplicateDelay)
+	}
+	if deadline != nil && !deadline.Stop() && ctx.Err() == nil {
+		// the timer fired, the headers arrived too late if at all
+		if err == nil {
+			resp.Body.Close()
+		}
+		w.WriteHeader(http.StatusGatewayTimeout)
+		log.Errorf("upstream timed out after %s: %s", timeout, r.RequestURI)
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Errorf("performing the request: %v", err)
@@ -72,6 +474,117 @@ func mainHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		proxyUpgrade(w, r, resp)
+		return
+	}
+
+	if faults.holdResponse(r) != nil {
+		return
+	}
+
+	if faults.applyResponse(w, r, resp) {
+		return
+	}
+
+	if !bodyAllowed(resp) && injectRequestFault(r, noBodyViolationRate, "no-body-violation") {
+		log.Warnf("sending a %d bytes body with a bodyless %d response: %s", noBodyViolationBytes, resp.StatusCode, r.RequestURI)
+		if err := writeForbiddenBody(w, resp, noBodyViolationBytes); err != nil {
+			log.Errorf("sending forbidden body: %v", err)
+		}
+		return
+	}
+
+	// the cache stores the response as received, before the faults
+	var cached *cacheRecorder
+	if cacheableRequest(r) && cacheableResponse(resp) {
+		cached = newCacheRecorder(r.URL.String(), resp)
+		resp.Body = cached
+	}
+
+	if cookieTampered && cookieFault != cookieStripRequest && len(resp.Header["Set-Cookie"]) > 0 {
+		tamperSetCookies(resp, cookieFault)
+		log.Warnf("tampering response cookies (%s): %s", cookieFault, r.RequestURI)
+	}
+
+	if injectRequestFault(r, validatorsFaultRate, "validators-"+validatorsFault) {
+		manipulateValidators(resp.Header, validatorsFault)
+		log.Warnf("manipulating validators (%s): %s", validatorsFault, r.RequestURI)
+	}
+
+	if n := t.responseHeaders.ApplyHeaders(resp.Header, clientPath); n > 0 {
+		log.Debugf("applied %d response header rules: %s", n, r.RequestURI)
+	}
+
+	if corsPermissive {
+		allowCORS(resp.Header, r)
+	}
+	if req.Header.Get("Range") != "" && rangeFault != rangeIgnore && tamperRange(r, resp, rangeFault) {
+		log.Warnf("tampering range (%s): now %s: %s", rangeFault, resp.Header.Get("Content-Range"), r.RequestURI)
+	}
+
+	if hs := integrityHeaders(resp.Header); len(hs) > 0 && bodyAllowed(resp) && (digestFault == digestHeader || resp.ContentLength != 0) && injectRequestFault(r, digestFaultRate, "digest-"+digestFault) {
+		if digestFault == digestHeader {
+			for _, k := range hs {
+				resp.Header.Set(k, corruptDigest(resp.Header.Get(k)))
+			}
+		} else {
+			offset := int64(-1)
+			if resp.ContentLength > 0 {
+				offset = mathrand.Int63n(resp.ContentLength)
+			}
+			resp.Body = &corruptedBody{ReadCloser: resp.Body, offset: offset}
+		}
+		log.Warnf("corrupting the %s checked by %v: %s", digestFault, hs, r.RequestURI)
+	}
+
+	if hasCORS(resp.Header) && injectRequestFault(r, corsFaultRate, "cors-"+corsFault) {
+		tamperCORS(resp.Header, corsFault)
+		log.Warnf("tampering CORS headers (%s): %s", corsFault, r.RequestURI)
+	}
+
+	// the server closes the connection after a response with Connection: close
+	if r.ProtoMajor == 1 && injectRequestFault(r, connectionCloseRate, "connection-close") {
+		resp.Header.Set("Connection", "close")
+		log.Warnf("disabling keep-alive: %s", r.RequestURI)
+	}
+
+	// gRPC errors are carried by the trailers, unless the upstream already
+	// answered with a trailers-only response
+	grpcRule := faults.grpcStatus()
+	if grpcRule != nil {
+		log.Warnf("injecting gRPC status %d: %s (rule %s)", grpcRule.Action.Status, r.RequestURI, grpcRule.Name)
+		if resp.Header.Get("Grpc-Status") != "" {
+			setGRPCStatus(resp.Header, "", grpcRule.Action)
+			grpcRule = nil
+		}
+	}
+
+	if rule := faults.graphqlPartial(); rule != nil {
+		if keys, err := partialResponse(resp, types.GraphQLOf(ctx), rule, graphqlMaxBody); err != nil {
+			log.Debugf("no partial GraphQL response (rule %s): %v", rule.Name, err)
+		} else {
+			recordRule(r, clientPath, rule)
+			log.Warnf("nulling GraphQL fields %v: %s (rule %s)", keys, r.RequestURI, rule.Name)
+		}
+	}
+
+	if sseFaultsEnabled() && isEventStream(resp) {
+		resp.Body = newSSEStream(r, resp.Body)
+	}
+
+	var cut *streamCut
+	cutRule := faults.grpcCut()
+	if cutRule != nil {
+		cut = newStreamCut(resp.Body, cutRule.Action)
+		defer cut.stop()
+		resp.Body = cut
+	}
+
+	if affinity != "" {
+		resp.Header.Add("Set-Cookie", (&http.Cookie{Name: stickyCookie, Value: affinity, Path: "/", HttpOnly: true}).String())
+	}
+
 	// send back the response header
 	for k, vs := range resp.Header {
 		for _, v := range vs {
@@ -80,28 +593,102 @@ func mainHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	w.WriteHeader(resp.StatusCode)
 
-	var errorTransfer bool
+	var linkBucket *types.TokenBucket
+	if network != nil && network.Bandwidth > 0 {
+		linkBucket = types.NewTokenBucket(network.Bandwidth)
+	}
+
+	// a stalling response pauses once, at a random offset, for a random duration
+	stallOffset := int64(-1)
+	if stallMax > 0 && injectRequestFault(r, stallRate, "stall") {
+		stallOffset = randomOffset(resp.ContentLength)
+	}
+
+	// the streaming responses (e.g. gRPC) are flushed as they arrive
+	flusher, _ := w.(http.Flusher)
+	if resp.ContentLength >= 0 {
+		flusher = nil
+	}
+
+	var errorTransfer, completed bool
 	var totalWritten int64
-	buf := make([]byte, 4096)
+	size := bufferSize
+	if faults.buffer > 0 {
+		size = faults.buffer
+	}
+	buf := make([]byte, size)
 	for {
 		n, err := resp.Body.Read(buf)
-		if (maxFailure != -1 && maxFailure > 0) && shouldFail(failureTransferRate) {
+		if injectTransferFailure(r) {
 			// simulate error
 			errorTransfer = true
-			maxFailure--
+			break
+		}
+
+		if globalBucket != nil && globalBucket.Wait(ctx, n) != nil {
+			break
+		}
+		if linkBucket != nil && linkBucket.Wait(ctx, n) != nil {
+			break
+		}
+		if network != nil && shouldFail(network.StallRate) && sleepContext(ctx, network.Stall) != nil {
+			break
+		}
+		if stallOffset >= 0 && totalWritten+int64(n) > stallOffset {
+			d := time.Duration(mathrand.Int63n(int64(stallMax))) + 1
+			log.Warnf("stalling response for %s after %d bytes: %s", d, totalWritten, r.RequestURI)
+			stallOffset = -1
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			if sleepContext(ctx, d) != nil {
+				break
+			}
+		}
+		if latencyPerKB > 0 && sleepContext(ctx, latencyPerKB*time.Duration(n)/1024) != nil {
 			break
 		}
 
 		w, errW := w.Write(buf[0:n])
 		totalWritten += int64(w)
+		if respBody != nil {
+			respBody.Write(buf[0:w])
+		}
 		if errW != nil {
 			break
 		}
+		if flusher != nil && n > 0 {
+			flusher.Flush()
+		}
 		if err != nil {
+			completed = err == io.EOF
 			break
 		}
 	}
 
+	if cut != nil && cut.cut() {
+		log.Warnf("cutting gRPC stream (%s) after %d messages: %s (rule %s)", cutRule.Action.Mode, cut.messages, r.RequestURI, cutRule.Name)
+		if cutRule.Action.Mode == "reset" {
+			// resets the HTTP/2 stream (closes the HTTP/1 connection)
+			panic(http.ErrAbortHandler)
+		}
+		resp.Trailer = nil
+		grpcRule = cutRule
+	}
+
+	// forward the trailers
+	for k, vs := range resp.Trailer {
+		w.Header()[http.TrailerPrefix+k] = vs
+	}
+	if grpcRule != nil && !errorTransfer {
+		setGRPCStatus(w.Header(), http.TrailerPrefix, grpcRule.Action)
+	}
+
+	// only the responses delivered whole are stored
+	if cached != nil && completed && !errorTransfer {
+		cached.store()
+	}
+
 	logger := log.WithField("code", resp.Status).
 		WithField("method", r.Method).
 		WithField("req-bytes", req.ContentLength).
@@ -109,6 +696,10 @@ func mainHandler(w http.ResponseWriter, r *http.Request) {
 		WithField("resp-bytes", resp.ContentLength).
 		WithField("error-transfer", errorTransfer).
 		WithField("total-written", totalWritten)
+	if reqBody != nil {
+		logger = logger.WithField("req-body", reqBody.String()).
+			WithField("resp-body", respBody.String())
+	}
 
 	if (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNoContent) && !errorTransfer {
 		logger.Infof("request to %s completed", r.RequestURI)
@@ -117,33 +708,792 @@ func mainHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func main() {
+// proxyHandler dispatches the CONNECT requests to the MITM interceptor and
+// everything else to mainHandler
+func proxyHandler(w http.ResponseWriter, r *http.Request) {
+	defer startRequest()()
+
+	if r.Method == http.MethodConnect {
+		if blocked(r.Host, "") {
+			reject(w)
+			return
+		}
+		connectHandler(w, r)
+		return
+	}
+
+	mainHandler(w, r)
+}
+
+// newServeFlags returns the flag set of the commands running the proxy
+func newServeFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.IntVar(&port, "port", 9005, "proxy port, on all the interfaces unless -listen is given")
+	fs.StringVar(&listenFlag, "listen", "", "addresses of the proxy, specific interfaces or IPv6 ones (127.0.0.1:9005,[::1]:9005, comma separated), they override -port; the tenants and the TCP and UDP proxies listen on the interface of the first one")
+	fs.BoolVar(&showVersion, "version", false, "print the version and exit")
+	fs.Int64Var(&maxFailure, "max-failure", -1, "max failure")
+	fs.Float64Var(&failureRate, "failure-rate", 0, "percentage of failure")
+	fs.IntVar(&failureCode, "failure-code", http.StatusInternalServerError, "http failure code status")
+	fs.Float64Var(&failureTransferRate, "failure-transfer-rate", 0, "percentage of transfer failure")
+	fs.Float64Var(&hangRate, "hang-rate", 0, "percentage of responses that stall after the headers")
+	fs.StringVar(&hangMode, "hang-mode", hangModeHeaders, "where to stall: headers (incomplete header section) or body")
+	fs.Float64Var(&wrongLengthRate, "wrong-length-rate", 0, "percentage of responses with a wrong Content-Length")
+	fs.IntVar(&wrongLengthDelta, "wrong-length-delta", 100, "bytes added to (or subtracted from, if negative) the real Content-Length")
+	fs.Float64Var(&badChunkedRate, "bad-chunked-rate", 0, "percentage of responses with a malformed chunked encoding")
+	fs.StringVar(&badChunkedMode, "bad-chunked-mode", badChunkedSize, "chunked encoding violation: size (bad chunk size line) or unterminated (missing last chunk)")
+	fs.Float64Var(&garbageRate, "garbage-rate", 0, "percentage of responses prefixed by random bytes")
+	fs.IntVar(&garbageBytes, "garbage-bytes", 16, "number of random bytes sent before the response")
+	fs.Float64Var(&protocolErrorRate, "protocol-error-rate", 0, "percentage of responses breaking the HTTP syntax")
+	fs.StringVar(&protocolErrorMode, "protocol-error-mode", types.ProtocolErrorStatusLine, "HTTP syntax violation: status-line (bad protocol version), status-code (non-numeric status) or header (illegal header bytes)")
+	fs.Float64Var(&http10Rate, "http10-rate", 0, "percentage of responses downgraded to HTTP/1.0 (no chunking, no keep-alive, body delimited by the connection close)")
+	fs.BoolVar(&h2cEnabled, "h2c", false, "accept cleartext HTTP/2 and use it towards the http:// upstreams for the HTTP/2 requests (e.g. gRPC)")
+	fs.StringVar(&upstreamAddr, "upstream", "", "reverse proxy mode: forward origin-form requests to the given URL, or round robin to the comma separated ones")
+	fs.StringVar(&tlsCerts, "tls-cert", "", "comma separated list of certificates (PEM) served by the listener")
+	fs.StringVar(&tlsKeys, "tls-key", "", "comma separated list of private keys (PEM) matching -tls-cert")
+	fs.StringVar(&acmeDomains, "acme-domains", "", "comma separated list of domains served with ACME (Let's Encrypt) certificates")
+	fs.StringVar(&acmeCache, "acme-cache", "", "directory used to cache the ACME certificates")
+	fs.StringVar(&tlsClientCA, "tls-client-ca", "", "require client certificates signed by the given CA bundle (PEM)")
+	fs.StringVar(&tlsClientCRL, "tls-client-crl", "", "revocation list (PEM or DER) checked against the client certificates")
+	fs.Float64Var(&tlsClientRejectRate, "tls-client-reject-rate", 0, "percentage of valid client certificates to reject")
+	fs.IntVar(&followRedirects, "follow-redirects", 0, "max number of upstream redirects followed by the proxy (0 sends them back to the client)")
+	fs.Var(&upstreamClientCerts, "upstream-client-cert", "client certificates presented to the upstreams (host:cert.pem,key.pem;...)")
+	fs.StringVar(&mitmCACert, "mitm-ca-cert", "", "CA certificate (PEM) used to intercept CONNECT requests")
+	fs.StringVar(&mitmCAKey, "mitm-ca-key", "", "CA private key (PEM) used to intercept CONNECT requests")
+	fs.Var(&mitmBadCerts, "mitm-bad-cert", "serve broken certificates for the given hosts (host:expired|self-signed)")
+	fs.Float64Var(&tlsFaultRate, "tls-fault-rate", 0, "percentage of intercepted TLS handshakes to fail (MITM mode)")
+	fs.StringVar(&tlsFault, "tls-fault", tlsFaultAbort, "TLS handshake fault: abort, wrong-host or bad-version")
+	fs.StringVar(&connectPorts, "connect-ports", "443", "ports the CONNECT requests are tunneled to without a MITM CA, the others get 403 (comma separated)")
+	fs.Var(&sniRuleFlags, "sni-rules", "rules applied to CONNECT tunnels by SNI (host:delay=2s|reset|blackhole|route=addr;...)")
+	fs.IntVar(&cacheSize, "cache-size", 0, "number of responses kept in the cache (0 disables the cache)")
+	fs.DurationVar(&cacheTTL, "cache-ttl", time.Minute, "freshness lifetime of the cached responses")
+	fs.Int64Var(&cacheMaxBody, "cache-max-body", 1<<20, "max size in bytes of a cached response body")
+	fs.Float64Var(&cacheStaleRate, "cache-stale-rate", 0, "percentage of requests served with an expired cache entry")
+	fs.Float64Var(&cacheMismatchRate, "cache-mismatch-rate", 0, "percentage of requests served with the cache entry of another resource")
+	fs.Float64Var(&notModifiedRate, "not-modified-rate", 0, "percentage of conditional requests answered with 304 without asking the upstream")
+	fs.Float64Var(&stripValidatorsRate, "strip-validators-rate", 0, "percentage of conditional requests forwarded without validators")
+	fs.Float64Var(&validatorsFaultRate, "validators-fault-rate", 0, "percentage of responses with manipulated ETag/Last-Modified")
+	fs.StringVar(&validatorsFault, "validators-fault", validatorsRewrite, "ETag/Last-Modified manipulation: rewrite, randomize or drop")
+	fs.Float64Var(&redirectRate, "redirect-rate", 0, "percentage of requests answered with a redirect")
+	fs.IntVar(&redirectCode, "redirect-code", http.StatusFound, "status code of the injected redirects (301, 302, 307 or 308)")
+	fs.IntVar(&redirectDepth, "redirect-depth", 1, "number of redirects in an injected chain")
+	fs.BoolVar(&redirectLoop, "redirect-loop", false, "inject endless redirect loops instead of chains")
+	fs.Float64Var(&cookieFaultRate, "cookie-fault-rate", 0, "percentage of requests with tampered cookies")
+	fs.StringVar(&cookieFault, "cookie-fault", cookieDrop, "cookie tampering: drop, mutate or expire the Set-Cookie headers, strip-request removes the Cookie header")
+	fs.Float64Var(&authFaultRate, "auth-fault-rate", 0, "percentage of requests with tampered Authorization/Proxy-Authorization headers")
+	fs.StringVar(&authFault, "auth-fault", authStrip, "credentials tampering: strip or corrupt")
+	fs.Var(&requestHeaders, "request-header", "request header rule (prefix:add|set|del:name[=value]), can be repeated")
+	fs.Var(&responseHeaders, "response-header", "response header rule (prefix:add|set|del:name[=value]), can be repeated")
+	fs.Var(&queryRewrites, "query-rewrite", "query parameter rule (prefix:add|set|del:name[=value]), can be repeated")
+	fs.Var(&pathRewrites, "path-rewrite", "path rule (prefix:/from=/to or regex:pattern=replacement), can be repeated")
+	fs.Var(&hostOverrides, "host-override", "send the traffic of an host to another one (host:target[:port];...)")
+	fs.Var(&resolveOverrides, "resolve", "connect to the given address in place of an host, keeping the Host and the SNI (api.example.com=10.0.0.7:8443[,host:port=addr]), can be repeated")
+	fs.Var(&denyList, "deny", "reject with 403 the requests matching the list (host, host/path-prefix or /path-prefix, comma separated)")
+	fs.Var(&allowList, "allow", "forward only the requests matching the list (same syntax of -deny), everything else gets 403")
+	fs.Int64Var(&maxThroughput, "max-throughput", 0, "max bytes/sec sent back to all the clients (0 means unlimited)")
+	fs.DurationVar(&latencyPerKB, "latency-per-kb", 0, "delay added for every KB of response body")
+	fs.StringVar(&networkName, "network", "", fmt.Sprintf("simulate the network profile: %s", strings.Join(types.NetworkProfileNames(), ", ")))
+	fs.Float64Var(&stallRate, "stall-rate", 0, "percentage of responses pausing once at a random offset")
+	fs.DurationVar(&stallMax, "stall-max", 5*time.Second, "max duration of a mid-transfer stall")
+	fs.Float64Var(&wsDropRate, "ws-drop-rate", 0, "percentage of the WebSocket data messages dropped")
+	fs.Float64Var(&wsDelayRate, "ws-delay-rate", 0, "percentage of the WebSocket data messages delayed by -ws-delay")
+	fs.DurationVar(&wsDelay, "ws-delay", 500*time.Millisecond, "delay of the WebSocket messages")
+	fs.Float64Var(&wsReorderRate, "ws-reorder-rate", 0, "percentage of the WebSocket data messages delivered out of order")
+	fs.IntVar(&wsReorderWindow, "ws-reorder-window", 3, "max number of later WebSocket messages delivered before a reordered one")
+	fs.Float64Var(&wsCloseRate, "ws-close-rate", 0, "percentage of the WebSocket connections closed after -ws-close-after")
+	fs.IntVar(&wsCloseCode, "ws-close-code", 1011, "close code sent to the client, 1006 drops the connection without a close frame")
+	fs.DurationVar(&wsCloseAfter, "ws-close-after", 10*time.Second, "lifetime of the WebSocket connections closed by -ws-close-rate")
+	fs.Float64Var(&sseDropRate, "sse-drop-rate", 0, "percentage of the server-sent events dropped")
+	fs.Float64Var(&sseDuplicateRate, "sse-duplicate-rate", 0, "percentage of the server-sent events sent twice")
+	fs.Float64Var(&sseDelayRate, "sse-delay-rate", 0, "percentage of the server-sent events delayed by -sse-delay")
+	fs.DurationVar(&sseDelay, "sse-delay", time.Second, "delay of the server-sent events")
+	fs.DurationVar(&expectContinueTimeout, "expect-continue-timeout", time.Second, "how long the body of an Expect: 100-continue request waits for the upstream interim 100")
+	fs.Float64Var(&expectFaultRate, "expect-fault-rate", 0, "percentage of the Expect: 100-continue requests affected by -expect-fault")
+	fs.StringVar(&expectFault, "expect-fault", expectNoContinue, "Expect: 100-continue fault: no-continue (the interim 100 is never sent) or early-status (final status without reading the body)")
+	fs.IntVar(&expectFaultCode, "expect-fault-code", http.StatusExpectationFailed, "final status sent by the early-status fault")
+	fs.Float64Var(&interimRate, "interim-rate", 0, "percentage of the responses preceded by spurious informational responses")
+	fs.IntVar(&interimStatus, "interim-status", http.StatusEarlyHints, "status of the spurious informational responses (e.g. 102 or 103)")
+	fs.IntVar(&interimCount, "interim-count", 1, "number of spurious informational responses")
+	fs.BoolVar(&corsPermissive, "cors-permissive", false, "allow every cross-origin request (for development): the origin, with credentials, the requested methods and headers")
+	fs.Float64Var(&corsFaultRate, "cors-fault-rate", 0, "percentage of the responses with the Access-Control-Allow-* headers tampered by -cors-fault")
+	fs.StringVar(&corsFault, "cors-fault", corsStrip, "CORS fault: strip or corrupt the Access-Control-Allow-* headers")
+	fs.BoolVar(&preflightEnabled, "preflight", false, "answer the CORS preflight requests without forwarding them")
+	fs.StringVar(&preflightOrigins, "preflight-origins", "", "comma separated origins allowed by the preflight answers, empty for any")
+	fs.StringVar(&preflightMethods, "preflight-methods", "", "comma separated methods allowed by the preflight answers, empty for any")
+	fs.StringVar(&preflightHeaders, "preflight-headers", "", "comma separated request headers allowed by the preflight answers, empty for any")
+	fs.DurationVar(&preflightMaxAge, "preflight-max-age", 0, "Access-Control-Max-Age of the preflight answers, 0 to omit it")
+	fs.Float64Var(&preflightFailRate, "preflight-fail-rate", 0, "percentage of the preflight requests (answered or forwarded) failed with 403")
+	fs.Float64Var(&rangeFaultRate, "range-fault-rate", 0, "percentage of the Range requests affected by -range-fault")
+	fs.StringVar(&rangeFault, "range-fault", rangeWrong, "Range fault: wrong-range (Content-Range shifted by one byte), short (half of the range served) or ignore (200 with the whole body)")
+	fs.Float64Var(&digestFaultRate, "digest-fault-rate", 0, "percentage of the responses with a checksum (Content-MD5, Digest, hash ETag) corrupted by -digest-fault")
+	fs.StringVar(&digestFault, "digest-fault", digestBody, "what the digest fault corrupts: body (one byte) or header (the checksum)")
+	fs.Float64Var(&duplicateRate, "duplicate-rate", 0, "percentage of the requests delivered twice to the upstream (the first response is returned)")
+	fs.DurationVar(&duplicateDelay, "duplicate-delay", 0, "delay of the duplicate delivery after the first response")
+	fs.Int64Var(&duplicateMaxBody, "duplicate-max-body", 1<<20, "max size of the request bodies buffered for the duplicate delivery")
+	fs.IntVar(&reorderWindow, "reorder-window", 0, "buffer the requests by groups of this size and forward them in shuffled order, 0 to disable")
+	fs.DurationVar(&reorderWait, "reorder-wait", 100*time.Millisecond, "max time a request waits for its group to fill up")
+	fs.DurationVar(&queueServiceTime, "queue-service-time", 0, "service time of the queueing latency model, the added delay grows with the requests in flight (0 to disable)")
+	fs.IntVar(&queueCapacity, "queue-capacity", 100, "requests in flight saturating the queueing latency model")
+	fs.Float64Var(&targetErrorRate, "target-error-rate", 0, "error rate (percentage) seen by the clients that -failure-rate is adjusted to maintain, 0 to keep it fixed")
+	fs.DurationVar(&targetErrorInterval, "target-error-interval", 5*time.Second, "how often the failure rate is adjusted to -target-error-rate")
+	fs.Float64Var(&faultArrivalRate, "fault-arrival-rate", 0, "faults per minute arriving as a Poisson process, independent of the request volume (failing with -failure-code)")
+	fs.DurationVar(&faultArrivalDuration, "fault-arrival-duration", 0, "how long every fault arrival fails all the requests, 0 to fail only the next one")
+	fs.StringVar(&webhooks, "webhooks", "", "URLs notified (JSON POST, Slack compatible) of the chaos events: start, stop, exhausted -max-failure, error rate crossing -webhook-error-rate (comma separated)")
+	fs.Float64Var(&webhookErrorRate, "webhook-error-rate", 0, "error rate (percentage) seen by the clients whose crossing is notified to the webhooks, 0 to disable")
+	fs.DurationVar(&webhookInterval, "webhook-interval", 10*time.Second, "window of the error rate notified to the webhooks")
+	fs.StringVar(&auditFile, "audit-log", "", "append-only JSON lines file recording every injected fault and rule change, with who armed it")
+	fs.StringVar(&faultHeader, "fault-header", "", "response header describing the injected fault (X-Floki-Injected: abort;status=503;rule=name), empty to disable")
+	fs.IntVar(&maxClientConns, "max-client-conns", 0, "maximum of concurrent connections per client IP, the next ones are refused (0 means no limit)")
+	fs.StringVar(&clientConnsAction, "client-conns-action", connLimitClose, "how the connections above -max-client-conns are refused: close or reset")
+	fs.Float64Var(&connectionCloseRate, "connection-close-rate", 0, "percentage of HTTP/1.x responses sent with Connection: close, closing the client connection")
+	fs.StringVar(&transparentMode, "transparent", "", "transparent proxy mode, for the HTTP connections diverted by iptables: redirect (REDIRECT target) or tproxy (TPROXY target, requires CAP_NET_ADMIN)")
+	fs.BoolVar(&proxyProtocol, "proxy-protocol", false, "read the PROXY protocol header (v1 or v2) of the connections from the load balancers, the proxy and TCP proxy ports require it")
+	fs.IntVar(&upstreamProxyProtocol, "upstream-proxy-protocol", 0, "send the PROXY protocol header of the given version (1 or 2) to the upstreams and TCP proxy targets, one connection per request (0 disables it)")
+	fs.Var(&tcpProxies, "tcp", "TCP proxy forwarding a port to an address with the byte level faults (5433:db.internal:5432), can be repeated")
+	fs.DurationVar(&tcpDelay, "tcp-delay", 0, "latency added to every chunk of data forwarded by the TCP proxies")
+	fs.Int64Var(&tcpBandwidth, "tcp-bandwidth", 0, "max bytes/sec forwarded by the TCP proxies in each direction of a connection (0 means unlimited)")
+	fs.Float64Var(&tcpDisconnectRate, "tcp-disconnect-rate", 0, "percentage of the chunks of data on which the TCP proxies reset the connection")
+	fs.Float64Var(&tcpCorruptRate, "tcp-corrupt-rate", 0, "percentage of the chunks of data forwarded by the TCP proxies with a corrupted byte")
+	fs.Var(&udpProxies, "udp", "UDP proxy forwarding a port to an address with the packet level faults (5353:dns.internal:53), can be repeated")
+	fs.DurationVar(&udpDelay, "udp-delay", 0, "latency added to every packet forwarded by the UDP proxies")
+	fs.Float64Var(&udpLossRate, "udp-loss-rate", 0, "percentage of the packets lost by the UDP proxies")
+	fs.Float64Var(&udpDuplicateRate, "udp-duplicate-rate", 0, "percentage of the packets sent twice by the UDP proxies")
+	fs.Float64Var(&udpReorderRate, "udp-reorder-rate", 0, "percentage of the packets delayed by -udp-reorder-delay, overtaken by the next ones")
+	fs.DurationVar(&udpReorderDelay, "udp-reorder-delay", 50*time.Millisecond, "extra latency of the reordered UDP packets")
+	fs.StringVar(&dnsServer, "dns-server", "", "DNS server resolving the upstream hosts (10.0.0.2:53), the system resolver if empty")
+	fs.DurationVar(&dnsTimeout, "dns-timeout", 0, "max duration of the resolution of an upstream host (0 means no limit)")
+	fs.Float64Var(&dnsDelayRate, "dns-delay-rate", 0, "percentage of the upstream resolutions slowed down by -dns-delay")
+	fs.DurationVar(&dnsDelay, "dns-delay", time.Second, "latency added to the slow upstream resolutions")
+	fs.Float64Var(&dnsServfailRate, "dns-servfail-rate", 0, "percentage of the upstream resolutions failing with SERVFAIL")
+	fs.Var(&variantSpecs, "variant", "stub response served, in place of the upstream one, to a stable share of the clients (prefix=/api/profile,name=b,status=200,file=profile-b.json,content-type=application/json), can be repeated")
+	fs.StringVar(&variantKey, "variant-key", types.DefaultClientKey, "client identifier selecting the variant: ip, header:name or cookie:name")
+	fs.Var(&routeSpecs, "route", "send the reverse proxy requests carrying an header or a cookie to another upstream (name=qa,header=X-Canary:true,cookie=qa=1,upstream=http://qa.internal), can be repeated")
+	fs.StringVar(&canaryAddr, "canary", "", "canary upstream URL (or comma separated URLs) receiving -canary-weight percent of the reverse proxy traffic")
+	fs.Float64Var(&canaryWeightFlag, "canary-weight", 0, "percentage of the reverse proxy requests sent to the -canary upstream, it can be changed at runtime with /split")
+	fs.StringVar(&stickyCookie, "sticky-cookie", "", "cookie set by the proxy to send all the requests of a client to the same upstream, no affinity if empty")
+	fs.StringVar(&stickyHeader, "sticky-header", "", "header whose value selects the upstream by consistent hashing (the sticky cookie is used without it)")
+	fs.StringVar(&healthPath, "health-path", "", "path probed with GET on every upstream to remove the unhealthy ones, no health checks if empty")
+	fs.DurationVar(&healthInterval, "health-interval", 5*time.Second, "interval between the health checks of an upstream")
+	fs.DurationVar(&healthTimeout, "health-timeout", 2*time.Second, "max duration of a health check")
+	fs.IntVar(&healthUnhealthy, "health-unhealthy", 3, "failed health checks in a row removing an upstream")
+	fs.IntVar(&healthHealthy, "health-healthy", 2, "successful health checks in a row readmitting an upstream")
+	fs.DurationVar(&upstreamTimeout, "upstream-timeout", 0, "max duration of an upstream request until the response headers, retries included, the ones not answered in time get 504 (0 means no limit)")
+	fs.IntVar(&bufferSize, "buffer-size", 4096, "size of the buffer the response bodies are copied with, the chunks written to the client are at most this large")
+	fs.IntVar(&retryCount, "retries", 0, "times a failed upstream request is retried, after a connection error or a -retry-statuses response")
+	fs.DurationVar(&retryBackoff, "retry-backoff", 100*time.Millisecond, "wait before the first retry, doubled at every retry")
+	fs.StringVar(&retryStatuses, "retry-statuses", "502,503,504", "upstream statuses retried (comma separated)")
+	fs.StringVar(&retryMethods, "retry-methods", "GET,HEAD,OPTIONS,PUT,DELETE", "methods of the requests retried (comma separated)")
+	fs.Int64Var(&retryMaxBody, "retry-max-body", 1<<20, "max size of the request bodies buffered to be retried, the larger ones are sent once")
+	fs.Int64Var(&graphqlMaxBody, "graphql-max-body", 1<<20, "max size of the GraphQL request and response bodies inspected by the rules")
+	fs.DurationVar(&negativeCacheTTL, "negative-cache-ttl", 0, "cache the upstream connection failures for this long, the requests to the same upstream fail fast meanwhile (0 means disabled)")
+	fs.Float64Var(&noBodyViolationRate, "no-body-violation-rate", 0, "percentage of the responses to HEAD and of the 204 and 304 responses sent with a (forbidden) body")
+	fs.IntVar(&noBodyViolationBytes, "no-body-violation-bytes", 64, "size of the forbidden body")
+	fs.StringVar(&interimLink, "interim-link", "</floki.css>; rel=preload; as=style", "Link header of the spurious 103 Early Hints")
+	fs.Var(&methodFailureRates, "method-failure-rate", "percentage of failure by method (GET:5,POST:50)")
+	fs.Var(&hostFailureRates, "host-failure-rate", "percentage of failure by upstream host (payments.internal:40,orders.internal:8080:10)")
+	fs.Var(&ruleFlags, "rule", "fault rule (name=n,priority=10,probability=5,scope=clients|resources,client-key=header:X-User,method=GET|PUT,host=h,prefix=/p,header=k:v,action=abort|delay|redirect|hang|wrong-length|bad-chunked|garbage|graphql-partial,status=503,delay=1s,mode=m,bytes=n,depth=n,loop=true,timeout=5s,retries=n,buffer=n,graphql-operation=mutation CreateOrder,graphql-field=f,fields=f|g,ttl=10m), can be repeated")
+	fs.Var(&tenantSpecs, "tenant", "virtual proxy on its own port with independent rules and counters (name=team-a,port=9101,rules-file=team-a.yaml), can be repeated")
+	fs.Var(&vhostSpecs, "vhost", "reverse proxy mode: upstream and rules selected by the Host header (host=api.example.com|*.api.example.com,upstream=http://api.internal,rules-file=api.yaml), can be repeated")
+	fs.StringVar(&rulesMode, "rules-mode", types.ModeFirst, "rules evaluation: first (first triggered rule wins) or all (accumulate until a terminal rule)")
+	fs.StringVar(&rulesFile, "rules-file", "", "JSON or YAML file with the fault rules and the rewrites, its rules come before the -rule ones")
+	fs.BoolVar(&dryRun, "dry-run", false, "evaluate and log the faults without injecting them, the requests are forwarded untouched")
+	fs.Var(&dumpList, "dump", "log the complete requests and responses matching the list (same syntax of -deny)")
+	fs.IntVar(&dumpMaxBody, "dump-max-body", 64*1024, "max number of body bytes dumped for each request and response")
+	fs.StringVar(&dumpFile, "dump-file", "", "file the flows are appended to (default stderr)")
+	fs.Float64Var(&logBodiesRate, "log-bodies-rate", 0, "percentage of requests logging the request and response bodies")
+	fs.IntVar(&logBodiesMax, "log-bodies-max", 1024, "max number of bytes of each logged body")
+	fs.StringVar(&redactHeaders, "redact-headers", "Authorization,Proxy-Authorization,Cookie,Set-Cookie", "headers whose values are hidden in the logs and in the dumps (comma separated)")
+	fs.StringVar(&logLevel, "log-level", "info", "log level: trace, debug, info, warning, error")
+	fs.StringVar(&logFormat, "log-format", logFormatText, "log format: text or json")
+	fs.StringVar(&logOutput, "log-output", logOutputStderr, "log output: stderr, syslog or journald")
+	fs.StringVar(&logFile, "log-file", "", "append the logs to the given file instead of stderr (e.g. when running as a Windows service)")
+	fs.StringVar(&syslogAddr, "syslog-addr", "", "remote syslog daemon (udp://host:514 or tcp://host:514), the local one if empty")
+	fs.IntVar(&adminPort, "admin-port", 0, "port of the admin server exposing /metrics and the dashboard (0 disables it)")
+	fs.StringVar(&adminListen, "admin-listen", "127.0.0.1", "interface of the admin server (0.0.0.0 or :: for all of them)")
+	fs.StringVar(&metricLabelsFlag, "metrics-labels", "method,host,status,fault", "labels of the request metrics: method, host, path, status, fault, tenant (comma separated)")
+	fs.Var(&metricBuckets, "metrics-buckets", "upper bounds in seconds of the latency histogram buckets (comma separated)")
+	fs.Var(&pathTemplates, "metrics-path-templates", "templates of the path label (/users/:id,/static/*), the other paths are labeled as other")
+	fs.StringVar(&exemplarHeader, "metrics-exemplar-header", "traceparent", "request header carrying the trace ID of the latency exemplars (OpenMetrics), traceparent is decoded as W3C Trace Context")
+	fs.StringVar(&statsdAddr, "statsd-addr", "", "StatsD (DogStatsD) server receiving the metrics (host:8125)")
+	fs.StringVar(&statsdPrefix, "statsd-prefix", "floki.", "prefix of the StatsD metric names")
+	fs.StringVar(&statsdTags, "statsd-tags", "", "tags added to all the StatsD metrics (env:staging,team:payments)")
+	fs.StringVar(&eventsURL, "events-url", "", "publish an access record per request (JSON) to nats://host:4222/subject or kafka://host:9092/topic")
+	fs.Var(&logSampling, "log-sample", "percentage of the entries logged by level (info:1,warning:50), errors are always logged")
+	fs.DurationVar(&failureTTL, "failure-ttl", 0, "revert to pass-through after the given duration (0 means never)")
+	fs.Var(&failWithPrefix, "fail-with-prefix", "fail all request with the given prefix (prefix:code[:ttl])")
+
+	return fs
+}
+
+// serve runs the proxy configured by args, with validateOnly the
+// configuration is checked and serve returns before listening. It returns
+// the errors of the configuration and of the listeners
+func serve(fs *flag.FlagSet, args []string, validateOnly bool) error {
 	seedRandom()
 
-	flag.IntVar(&port, "port", 9005, "proxy port")
-	flag.IntVar(&maxFailure, "max-failure", -1, "max failure")
-	flag.IntVar(&failureRate, "failure-rate", 0, "percentage of failure")
-	flag.IntVar(&failureCode, "failure-code", http.StatusInternalServerError, "http failure code status")
-	flag.IntVar(&failureTransferRate, "failure-transfer-rate", 0, "percentage of transfer failure")
-	flag.Var(&failWithPrefix, "fail-with-prefix", "fail all request with the given prefix")
-	flag.Parse()
+	fs.Parse(args)
+	if showVersion {
+		printVersion()
+		return nil
+	}
+
+	if err := setupLogger(logLevel, logFormat); err != nil {
+		return err
+	}
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("opening log file: %w", err)
+		}
+		log.SetOutput(f)
+	}
+	if err := setupLogOutput(logOutput, syslogAddr); err != nil {
+		return err
+	}
+	sf, err := newSamplingFormatter(log.StandardLogger().Formatter, logSampling)
+	if err != nil {
+		return fmt.Errorf("bad log sampling: %w", err)
+	}
 
 	if failureRate < 0 || failureRate > 100 {
-		log.Fatal("bad failure rate: expected a value in the range [0, 100]")
+		return errors.New("bad failure rate: expected a value in the range [0, 100]")
+	}
+	if badChunkedMode != badChunkedSize && badChunkedMode != badChunkedUnterminated {
+		return fmt.Errorf("bad chunked mode %q: expected size or unterminated", badChunkedMode)
+	}
+	switch protocolErrorMode {
+	case types.ProtocolErrorStatusLine, types.ProtocolErrorStatusCode, types.ProtocolErrorHeader:
+	default:
+		return fmt.Errorf("bad protocol error mode %q: expected status-line, status-code or header", protocolErrorMode)
+	}
+	if canaryWeightFlag < 0 || canaryWeightFlag > 100 {
+		return errors.New("bad canary weight: expected a value in the range [0, 100]")
+	}
+	if healthPath != "" && (healthInterval <= 0 || healthTimeout <= 0 || healthUnhealthy <= 0 || healthHealthy <= 0) {
+		return errors.New("bad health checks: interval, timeout and thresholds must be positive")
+	}
+	if upstreamTimeout < 0 {
+		return errors.New("bad upstream timeout: expected a value >= 0")
+	}
+	if bufferSize <= 0 {
+		return errors.New("bad buffer size: expected a value > 0")
+	}
+	if retryCount < 0 {
+		return errors.New("bad retries: expected a value >= 0")
+	}
+	if upstreamRetries, err = newRetryPolicy(retryCount, retryBackoff, retryStatuses, retryMethods); err != nil {
+		return err
+	}
+	if dnsServer != "" {
+		if _, _, err := net.SplitHostPort(dnsServer); err != nil {
+			dnsServer = net.JoinHostPort(dnsServer, "53")
+		}
+		upstreamResolver = newResolver(dnsServer)
+	}
+	if tlsFault != tlsFaultAbort && tlsFault != tlsFaultWrongHost && tlsFault != tlsFaultBadVersion {
+		return fmt.Errorf("bad TLS fault %q: expected abort, wrong-host or bad-version", tlsFault)
+	}
+	for h, kind := range mitmBadCerts {
+		if kind != certExpired && kind != certSelfSigned {
+			return fmt.Errorf("bad certificate kind %q for %s: expected expired or self-signed", kind, h)
+		}
+	}
+	sniRules = make(map[string]sniRule)
+	for h, x := range sniRuleFlags {
+		rule, err := parseSNIRule(x)
+		if err != nil {
+			return err
+		}
+		sniRules[h] = rule
+	}
+	if validatorsFault != validatorsRewrite && validatorsFault != validatorsRandomize && validatorsFault != validatorsDrop {
+		return fmt.Errorf("bad validators fault %q: expected rewrite, randomize or drop", validatorsFault)
+	}
+	if redirectCode < 300 || redirectCode > 399 {
+		return fmt.Errorf("bad redirect code %d: expected a 3xx status", redirectCode)
+	}
+	switch cookieFault {
+	case cookieDrop, cookieMutate, cookieExpire, cookieStripRequest:
+	default:
+		return fmt.Errorf("bad cookie fault %q: expected drop, mutate, expire or strip-request", cookieFault)
+	}
+	if authFault != authStrip && authFault != authCorrupt {
+		return fmt.Errorf("bad auth fault %q: expected strip or corrupt", authFault)
+	}
+	if networkName != "" {
+		np, ok := types.NetworkProfiles[networkName]
+		if !ok {
+			return fmt.Errorf("unknown network profile %q: expected one of %s", networkName, strings.Join(types.NetworkProfileNames(), ", "))
+		}
+		network = &np
+	}
+	setRedactedHeaders(redactHeaders)
+	metricLabels = splitList(metricLabelsFlag)
+	if err := checkMetricLabels(metricLabels); err != nil {
+		return err
+	}
+	if len(metricBuckets) == 0 {
+		metricBuckets = types.DefaultBuckets
+	}
+	if statsdAddr != "" && validateOnly {
+		if _, _, err := net.SplitHostPort(statsdAddr); err != nil {
+			return fmt.Errorf("bad StatsD address: %w", err)
+		}
+	} else if statsdAddr != "" {
+		client, err := types.NewStatsD(statsdAddr, statsdPrefix, splitList(statsdTags))
+		if err != nil {
+			return fmt.Errorf("connecting to StatsD: %w", err)
+		}
+		metricsSinks = append(metricsSinks, statsdSink{client: client})
+	}
+	if eventsURL != "" && validateOnly {
+		if err := types.CheckEventStream(eventsURL); err != nil {
+			return err
+		}
+	} else if eventsURL != "" {
+		stream, err := types.NewEventStream(eventsURL, func(err error) {
+			log.Errorf("publishing access records: %v", err)
+		})
+		if err != nil {
+			return fmt.Errorf("connecting to the event stream: %w", err)
+		}
+		metricsSinks = append(metricsSinks, eventSink{stream: stream})
+	}
+	// the configuration is validated without creating the output files
+	if recordFile != "" && !validateOnly {
+		if err := openRecording(recordFile); err != nil {
+			return fmt.Errorf("opening recording: %w", err)
+		}
+	}
+	webhookURLs = splitList(webhooks)
+	if webhookErrorRate < 0 || webhookErrorRate > 100 || webhookInterval <= 0 {
+		return errors.New("bad webhook error rate: expected a percentage in the range [0, 100] and a positive interval")
+	}
+	if auditFile != "" && !validateOnly {
+		if err := openAuditLog(auditFile); err != nil {
+			return fmt.Errorf("opening audit log: %w", err)
+		}
+	}
+	dumpOut.w = os.Stderr
+	if dumpFile != "" && !validateOnly {
+		f, err := os.OpenFile(dumpFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("opening dump file: %w", err)
+		}
+		dumpOut.w = f
+	}
+	var rules []*types.Rule
+	if rulesFile != "" {
+		rf, err := types.LoadRulesFile(rulesFile)
+		if err != nil {
+			return fmt.Errorf("loading rules file: %w", err)
+		}
+		// an explicit -rules-mode wins over the mode of the file
+		explicitMode := false
+		fs.Visit(func(f *flag.Flag) {
+			explicitMode = explicitMode || f.Name == "rules-mode"
+		})
+		if rf.Mode != "" && !explicitMode {
+			rulesMode = rf.Mode
+		}
+		rules = rf.Rules
+		auditRules(auditArmed, "rules file "+rulesFile, rf.Rules...)
+		requestHeaders = append(requestHeaders, rf.RequestHeaders...)
+		responseHeaders = append(responseHeaders, rf.ResponseHeaders...)
+		queryRewrites = append(queryRewrites, rf.Query...)
+		pathRewrites = append(pathRewrites, rf.Paths...)
+	}
+	auditRules(auditArmed, "-rule flag", ruleFlags...)
+	rules = append(rules, ruleFlags...)
+	if logBodiesRate < 0 || logBodiesRate > 100 {
+		return errors.New("bad log bodies rate: expected a value in the range [0, 100]")
+	}
+	if expectFault != expectNoContinue && expectFault != expectEarlyStatus {
+		return fmt.Errorf("bad expect fault %q: expected no-continue or early-status", expectFault)
+	}
+	if interimStatus < 102 || interimStatus > 199 {
+		return fmt.Errorf("bad interim status %d: expected an 1xx status other than 100 and 101", interimStatus)
+	}
+	if reorderWindow < 0 || reorderWait <= 0 {
+		return errors.New("bad reorder window: expected a non negative size and a positive wait")
+	}
+	if targetErrorRate < 0 || targetErrorRate >= 100 || targetErrorInterval <= 0 {
+		return errors.New("bad target error rate: expected a percentage in the range [0, 100) and a positive interval")
+	}
+	if faultArrivalRate < 0 || faultArrivalDuration < 0 {
+		return errors.New("bad fault arrivals: expected a non negative rate and duration")
+	}
+	if faultArrivalRate > maxFaultArrivalRate {
+		return fmt.Errorf("bad fault arrivals: expected a rate up to %g per minute", float64(maxFaultArrivalRate))
+	}
+	if faultArrivalRate > 0 {
+		arrivals = newFaultArrivals(faultArrivalRate, faultArrivalDuration)
+	}
+	if queueServiceTime < 0 || queueCapacity <= 0 {
+		return errors.New("bad queueing model: expected a non negative service time and a positive capacity")
+	}
+	if reorderWindow > 1 {
+		requestQueue = newReorderQueue(reorderWindow, reorderWait)
+	}
+	if digestFault != digestBody && digestFault != digestHeader {
+		return fmt.Errorf("bad digest fault %q: expected body or header", digestFault)
+	}
+	switch rangeFault {
+	case rangeWrong, rangeShort, rangeIgnore:
+	default:
+		return fmt.Errorf("bad range fault %q: expected wrong-range, short or ignore", rangeFault)
+	}
+	if corsFault != corsStrip && corsFault != corsCorrupt {
+		return fmt.Errorf("bad CORS fault %q: expected strip or corrupt", corsFault)
+	}
+	preflight = preflightPolicy{
+		origins: splitList(preflightOrigins),
+		methods: splitList(preflightMethods),
+		headers: splitList(preflightHeaders),
+		maxAge:  preflightMaxAge,
+	}
+	if noBodyViolationBytes <= 0 {
+		return errors.New("bad no-body violation bytes: expected a positive size")
+	}
+	if interimCount <= 0 {
+		return errors.New("bad interim count: expected a positive number of responses")
+	}
+	if wsReorderWindow <= 0 {
+		return errors.New("bad WebSocket reorder window: expected a positive number of messages")
+	}
+	if !validWSCloseCode(wsCloseCode) {
+		return fmt.Errorf("bad WebSocket close code %d: expected 1006 or a code sendable in a close frame", wsCloseCode)
+	}
+	if hangMode != hangModeHeaders && hangMode != hangModeBody {
+		return fmt.Errorf("bad hang mode %q: expected headers or body", hangMode)
+	}
+	addrs, err := parseListen(listenFlag, port)
+	if err != nil {
+		return err
+	}
+	listenAddrs = addrs
+	if err := checkTenantPorts(tenantSpecs, listenAddrs); err != nil {
+		return err
+	}
+	if listenFlag != "" {
+		listenHost, _, _ = net.SplitHostPort(addrs[0])
+	}
+	switch transparentMode {
+	case "", transparentRedirect, transparentTProxy:
+	default:
+		return fmt.Errorf("bad transparent mode %q: expected redirect or tproxy", transparentMode)
+	}
+	if upstreamProxyProtocol < 0 || upstreamProxyProtocol > 2 {
+		return fmt.Errorf("bad upstream PROXY protocol version %d: expected 1 or 2", upstreamProxyProtocol)
+	}
+	if upstreamProxyProtocol > 0 && h2cEnabled {
+		// the HTTP/2 connections carry the streams of many clients
+		return errors.New("bad upstream PROXY protocol: not supported with -h2c")
+	}
+	if transparentMode != "" && !transparentSupported {
+		return errTransparent
+	}
+	if clientConnsAction != connLimitClose && clientConnsAction != connLimitReset {
+		return fmt.Errorf("bad client connections action %q: expected close or reset", clientConnsAction)
 	}
 
 	log.Infof("============== STARTING FLOKI PROXY ==================")
-	log.Infof("== Listening on: *:%d", port)
-	log.Infof("== F-Rate:    %d%%", failureRate)
-	log.Infof("== F-Tr-Rate: %d%%", failureTransferRate)
+	log.Infof("== Version:   %s (%s)", version, commit)
+	log.Infof("== Listening on: %s", strings.Join(listenAddrs, ","))
+	log.Infof("== Upstream:  %s", upstreamAddr)
+	log.Infof("== F-Rate:    %g%%", failureRate)
+	log.Infof("== F-Methods: %s", methodFailureRates)
+	log.Infof("== F-Hosts:   %s", hostFailureRates)
+	log.Infof("== F-Tr-Rate: %g%%", failureTransferRate)
 	log.Infof("== F-Prefix:  %s", failWithPrefix)
+	log.Infof("== Hang-Rate: %g%% (%s)", hangRate, hangMode)
+	log.Infof("== WL-Rate:   %g%% (%+d bytes)", wrongLengthRate, wrongLengthDelta)
+	log.Infof("== BC-Rate:   %g%% (%s)", badChunkedRate, badChunkedMode)
+	log.Infof("== G-Rate:    %g%% (%d bytes)", garbageRate, garbageBytes)
+	log.Infof("== HTTP/1.0:  %g%%", http10Rate)
+	log.Infof("== P-Error:   %g%% (%s)", protocolErrorRate, protocolErrorMode)
+	log.Infof("== TLS-Rate:  %g%% (%s)", tlsFaultRate, tlsFault)
+	log.Infof("== Network:   %s", networkName)
+	log.Infof("== Resolve:   %s", resolveOverrides)
+	log.Infof("== Routes:    %s", routeSpecs)
+	log.Infof("== Variants:  %s (by %s)", variantSpecs, variantKey)
+	log.Infof("== Canary:    %s (%g%%)", canaryAddr, canaryWeightFlag)
+	log.Infof("== Sticky:    cookie %q, header %q", stickyCookie, stickyHeader)
+	log.Infof("== Health:    %s (every %s, timeout %s, down after %d, up after %d)", healthPath, healthInterval, healthTimeout, healthUnhealthy, healthHealthy)
+	log.Infof("== Timeout:   %s (buffer %d bytes)", upstreamTimeout, bufferSize)
+	log.Infof("== Retries:   %s", upstreamRetries)
+	log.Infof("== Neg-Cache: %s", negativeCacheTTL)
+	log.Infof("== DNS:       %s (timeout %s, delay %g%% (%s), servfail %g%%)", dnsServer, dnsTimeout, dnsDelayRate, dnsDelay, dnsServfailRate)
+	log.Infof("== WebSocket: drop %g%%, delay %g%% (%s), reorder %g%% (%d), close %g%% (%d after %s)",
+		wsDropRate, wsDelayRate, wsDelay, wsReorderRate, wsReorderWindow, wsCloseRate, wsCloseCode, wsCloseAfter)
+	log.Infof("== Expect:    %g%% (%s)", expectFaultRate, expectFault)
+	log.Infof("== Range:     %g%% (%s)", rangeFaultRate, rangeFault)
+	log.Infof("== Duplicate: %g%% (after %s)", duplicateRate, duplicateDelay)
+	log.Infof("== Reorder:   %d (wait %s)", reorderWindow, reorderWait)
+	log.Infof("== Arrivals:  %g/min (for %s)", faultArrivalRate, faultArrivalDuration)
+	log.Infof("== Adaptive:  %g%% (every %s)", targetErrorRate, targetErrorInterval)
+	log.Infof("== Queueing:  %s (capacity %d)", queueServiceTime, queueCapacity)
+	log.Infof("== Conn-Lim.: %d per client (%s)", maxClientConns, clientConnsAction)
+	log.Infof("== KeepAlive: close %g%%", connectionCloseRate)
+	log.Infof("== Transp.:   %s", transparentMode)
+	log.Infof("== PROXY:     accept %t, upstream v%d", proxyProtocol, upstreamProxyProtocol)
+	log.Infof("== TCP:       %s (delay %s, %d B/s, disconnect %g%%, corrupt %g%%)", tcpProxies, tcpDelay, tcpBandwidth, tcpDisconnectRate, tcpCorruptRate)
+	log.Infof("== UDP:       %s (delay %s, loss %g%%, duplicate %g%%, reorder %g%% by %s)", udpProxies, udpDelay, udpLossRate, udpDuplicateRate, udpReorderRate, udpReorderDelay)
+	log.Infof("== Digest:    %g%% (%s)", digestFaultRate, digestFault)
+	log.Infof("== CORS:      permissive %t, %g%% (%s)", corsPermissive, corsFaultRate, corsFault)
+	log.Infof("== Preflight: %t (origins %q), fail %g%%", preflightEnabled, preflightOrigins, preflightFailRate)
+	log.Infof("== NB-Viol.:  %g%% (%d bytes)", noBodyViolationRate, noBodyViolationBytes)
+	log.Infof("== Interim:   %g%% (%d x %d)", interimRate, interimCount, interimStatus)
+	log.Infof("== SSE:       drop %g%%, duplicate %g%%, delay %g%% (%s)", sseDropRate, sseDuplicateRate, sseDelayRate, sseDelay)
+	log.Infof("== Rules:     %s", rulesFile)
+	log.Infof("== Dry-run:   %t", dryRun)
+	log.Infof("== Admin:     %s", net.JoinHostPort(adminListen, strconv.Itoa(adminPort)))
+	log.Infof("== Metrics:   %s", strings.Join(metricLabels, ","))
+	log.Infof("== StatsD:    %s", statsdAddr)
+	log.Infof("== Events:    %s", eventsURL)
+	log.Infof("== Dump:      %s", dumpList)
+	log.Infof("== Bodies:    %g%% (%d bytes)", logBodiesRate, logBodiesMax)
+	log.Infof("== F-TTL:     %s", failureTTL)
+	log.Infof("== Webhooks:  %s (error rate %g%%)", webhooks, webhookErrorRate)
 	log.Infof("======================================================")
 
+	rs, err := buildRuleSet(rulesMode, rules)
+	if err != nil {
+		return err
+	}
+	ruleSet = rs
+	log.Infof("rules (%s): %s", ruleSet.Mode, describeRules(ruleSet))
+
+	if failureTTL > 0 {
+		failureDeadline = time.Now().Add(failureTTL)
+		time.AfterFunc(failureTTL, func() {
+			log.Warnf("failure TTL of %s expired: reverting to pass-through", failureTTL)
+			notifyStopped("failure TTL of %s expired, reverting to pass-through", failureTTL)
+		})
+	}
+
+	if mitmCACert != "" || mitmCAKey != "" {
+		ca, err := loadCertAuthority(mitmCACert, mitmCAKey)
+		if err != nil {
+			return err
+		}
+		mitmCA = ca
+		log.Infof("MITM mode enabled, CA: %s", ca.cert.Subject.CommonName)
+	}
+
+	if upstreamAddr != "" {
+		p, err := parseUpstreams(upstreamAddr)
+		if err != nil {
+			return err
+		}
+		upstream = p
+	}
+	if err := types.CheckClientKey(variantKey); err != nil {
+		return err
+	}
+	if variantGroups, err = loadVariants(variantSpecs); err != nil {
+		return err
+	}
+	if len(routeSpecs) > 0 {
+		if upstream == nil {
+			return errors.New("bad route: it requires -upstream")
+		}
+		routes, err := newHeaderRoutes(routeSpecs)
+		if err != nil {
+			return err
+		}
+		headerRoutes = routes
+	}
+	if canaryAddr != "" {
+		if upstream == nil {
+			return errors.New("bad canary: it requires -upstream")
+		}
+		p, err := parseUpstreams(canaryAddr)
+		if err != nil {
+			return err
+		}
+		canarySplit.pool = p
+		setCanaryWeight(canaryWeightFlag)
+	}
+
+	if maxThroughput > 0 {
+		globalBucket = types.NewTokenBucket(maxThroughput)
+	}
+
+	if cacheSize > 0 {
+		responseCache = types.NewResponseCache(cacheSize, cacheTTL)
+	}
+
+	client, err := newUpstreamClient(upstreamClientCerts, followRedirects, h2cEnabled, expectContinueTimeout, upstreamProxyProtocol)
+	if err != nil {
+		return err
+	}
+	upstreamClient = client
+
 	methodCounters = types.NewMethodCounters()
 	//go printCounters(context.Background())
 
-	http.HandleFunc("/", mainHandler)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+	defaultTenant = &tenant{
+		name:            defaultTenantName,
+		addrs:           listenAddrs,
+		ruleSet:         ruleSet,
+		requestHeaders:  requestHeaders,
+		responseHeaders: responseHeaders,
+		queryRewrites:   queryRewrites,
+		pathRewrites:    pathRewrites,
+		counters:        methodCounters,
+		load:            types.NewLoadMeter(),
+		upstream:        upstream,
+	}
+	registerPool(defaultTenant.name, upstream)
+	registerPool("canary", canarySplit.pool)
+	for _, hr := range headerRoutes {
+		registerPool("route:"+hr.spec.Name, hr.pool)
+	}
+	for _, spec := range vhostSpecs {
+		t, err := loadTenant(spec)
+		if err != nil {
+			return fmt.Errorf("loading virtual host %s: %v", spec.Name, err)
+		}
+		log.Infof("virtual host %s (%s) to %s, rules (%s): %s", t.name, strings.Join(t.hosts, "|"), t.upstream, t.ruleSet.Mode, describeRules(t.ruleSet))
+		virtualHosts = append(virtualHosts, t)
+		registerPool(t.name, t.upstream)
+	}
+	var others []*tenant
+	for _, spec := range tenantSpecs {
+		t, err := loadTenant(spec)
+		if err != nil {
+			return fmt.Errorf("loading tenant %s: %v", spec.Name, err)
+		}
+		log.Infof("tenant %s on %s, rules (%s): %s", t.name, t.addrs[0], t.ruleSet.Mode, describeRules(t.ruleSet))
+		others = append(others, t)
+		registerPool(t.name, t.upstream)
+	}
+
+	var tlsConfig *tls.Config
+	if tlsCerts != "" || acmeDomains != "" {
+		cfg, err := listenerTLSConfig(splitList(tlsCerts), splitList(tlsKeys), splitList(acmeDomains), acmeCache)
+		if err != nil {
+			return err
+		}
+		if tlsClientCA != "" {
+			if err := requireClientCerts(cfg, tlsClientCA, tlsClientCRL, tlsClientRejectRate); err != nil {
+				return err
+			}
+		}
+		tlsConfig = cfg
+	}
+
+	if validateOnly {
+		log.Infof("configuration is valid")
+		return nil
+	}
+
+	notify(eventStarted, "started with the rules (%s) %s", ruleSet.Mode, describeRules(ruleSet))
+	if len(webhookURLs) > 0 {
+		notifyOnSignal()
+	}
+	if webhookErrorRate > 0 && len(webhookURLs) > 0 {
+		ew := newErrorRateWatch(webhookErrorRate)
+		metricsSinks = append(metricsSinks, ew)
+		go ew.run(webhookInterval)
+	}
+	if adaptiveRule != nil {
+		c := newAdaptiveController(targetErrorRate, adaptiveRule)
+		metricsSinks = append(metricsSinks, c)
+		go c.run(targetErrorInterval)
+	}
+	if healthPath != "" {
+		hc := &healthChecker{
+			client: &http.Client{
+				Transport: upstreamClient.Transport,
+				Timeout:   healthTimeout,
+				CheckRedirect: func(*http.Request, []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			},
+			path:      healthPath,
+			interval:  healthInterval,
+			unhealthy: healthUnhealthy,
+			healthy:   healthHealthy,
+		}
+		checked := []*upstreamPool{upstream, canarySplit.pool}
+		for _, hr := range headerRoutes {
+			checked = append(checked, hr.pool)
+		}
+		for _, t := range virtualHosts {
+			checked = append(checked, t.upstream)
+		}
+		for _, t := range others {
+			checked = append(checked, t.upstream)
+		}
+		hc.start(checked...)
+	}
+	if adminPort != 0 {
+		ps := newPromSink(metricBuckets)
+		dash := newDashboard()
+		metricsSinks = append(metricsSinks, ps, dash)
+		if err := serveAdmin(adminListen, adminPort, ps, dash); err != nil {
+			return err
+		}
+	}
+
+	// the startup messages are never sampled
+	log.SetFormatter(sf)
+
+	for _, p := range tcpProxies {
+		if err := listenTCP(p); err != nil {
+			return fmt.Errorf("starting tcp proxy: %w", err)
+		}
+	}
+	for _, p := range udpProxies {
+		if err := listenUDP(p); err != nil {
+			return fmt.Errorf("starting udp proxy: %w", err)
+		}
+	}
+
+	// the errors of the proxy servers, of the tenants and of the addresses
+	errs := make(chan error)
+	for _, t := range others {
+		srv := newServer(t, tlsConfig, h2cEnabled)
+		l, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			return err
+		}
+		go func() {
+			errs <- serveListener(srv, l, tlsConfig)
+		}()
+	}
+
+	srv := newServer(defaultTenant, tlsConfig, h2cEnabled)
+
+	l, err := activationListener()
+	if err != nil {
+		return err
+	}
+	ls := []net.Listener{l}
+	if l != nil {
+		log.Infof("listening on the socket passed by systemd: %s", l.Addr())
+	} else {
+		ls = nil
+		for _, addr := range defaultTenant.addrs {
+			var l net.Listener
+			if transparentMode == transparentTProxy {
+				l, err = listenTransparent(addr)
+			} else {
+				l, err = net.Listen("tcp", addr)
+			}
+			if err != nil {
+				return err
+			}
+			ls = append(ls, l)
+		}
+	}
+	for _, l := range ls {
+		go func(l net.Listener) {
+			errs <- serveListener(srv, l, tlsConfig)
+		}(l)
+	}
+	return serveError(errs)
 }
 
 func printCounters(ctx context.Context) {
@@ -162,32 +1512,76 @@ func printCounters(ctx context.Context) {
 }
 
 //shouldFail is an utility function the takes as input the failure-rate
-//and using a normal distribution decide if the request should
-//fails, returning immediately 500, or should be forwarded
-func shouldFail(fRate int) bool {
-	if fRate == 0 {
+//(a percentage, possibly fractional) and using a normal distribution decide
+//if the request should fails, returning immediately 500, or should be forwarded
+func shouldFail(fRate float64) bool {
+	if fRate <= 0 || failureExpired() {
 		return false
 	}
-	if fRate == 100 {
+	if fRate >= 100 {
 		return true
 	}
 
-	return mathrand.Intn(100) < fRate
+	return mathrand.Float64()*100 < fRate
 }
 
-//shouldFailByPrefix if failure by prefix is set return true if the request path
-//match the desired prefix, otherwise return false
-func shouldFailByPrefix(path string) (int, bool) {
-	for k, v := range failWithPrefix {
-		if strings.HasPrefix(path, k) {
-			return v, true
-		}
+// sampled report if an event belongs to the given percentage of the traffic,
+// unlike shouldFail it ignores the failure TTL
+func sampled(rate float64) bool {
+	return rate >= 100 || (rate > 0 && mathrand.Float64()*100 < rate)
+}
+
+// failureExpired report if the global failure TTL is elapsed
+func failureExpired() bool {
+	return !failureDeadline.IsZero() && time.Now().After(failureDeadline)
+}
+
+// randomOffset returns a random offset within a body of the given length,
+// within the first 64KB if the length is unknown
+func randomOffset(length int64) int64 {
+	if length <= 0 {
+		length = 64 * 1024
+	}
+
+	return mathrand.Int63n(length)
+}
+
+// injectTransferFailure report if the transfer of the response to r must
+// fail, within the -max-failure transfer failures. The handlers claim a
+// failure decrementing maxFailure atomically, giving it back if the fault
+// is not triggered, so exactly one of them exhausts it
+func injectTransferFailure(r *http.Request) bool {
+	if atomic.LoadInt64(&maxFailure) <= 0 {
+		return false
+	}
+	left := atomic.AddInt64(&maxFailure, -1)
+	if left < 0 || !injectRequestFault(r, failureTransferRate, "transfer-failure") {
+		atomic.AddInt64(&maxFailure, 1)
+		return false
 	}
 
-	return 0, false
+	if left == 0 {
+		log.Warnf("max transfer failures reached")
+		notify(eventBudgetExhausted, "the -max-failure transfer failures are exhausted")
+	}
+	return true
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
 }
 
-// seed the random engine using the "/dev/random" as a source
+// seed the random engine using the OS entropy source (getrandom or
+// /dev/urandom, RtlGenRandom on Windows)
 func seedRandom() {
 	var r [8]byte
 	_, err := rand.Read(r[:])
@@ -0,0 +1,248 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meox/floki-proxy/types"
+)
+
+// labels that can be attached to the request metrics
+const (
+	labelMethod = "method"
+	labelHost   = "host"
+	labelPath   = "path"
+	labelStatus = "status"
+	labelFault  = "fault"
+	labelTenant = "tenant"
+)
+
+// requestRecord describes a completed request, fault is "none" if nothing
+// was injected and status is zero if the connection was hijacked
+type requestRecord struct {
+	tenant   string
+	method   string
+	host     string
+	path     string
+	status   int
+	fault    string
+	duration time.Duration
+	// traceID is the trace of the request, if any
+	traceID string
+}
+
+// labels returns the values of the labels selected with -metrics-labels
+func (rr requestRecord) labels() []string {
+	values := make([]string, len(metricLabels))
+	for i, l := range metricLabels {
+		switch l {
+		case labelMethod:
+			values[i] = rr.method
+		case labelHost:
+			values[i] = rr.host
+		case labelPath:
+			// the raw paths would explode the cardinality
+			values[i] = pathTemplates.Match(rr.path)
+		case labelStatus:
+			values[i] = strconv.Itoa(rr.status)
+		case labelFault:
+			values[i] = rr.fault
+		case labelTenant:
+			values[i] = rr.tenant
+		}
+	}
+
+	return values
+}
+
+// metricsSink receives the metrics of the proxy
+type metricsSink interface {
+	// request records a completed request
+	request(rr requestRecord)
+	// fault records an injected fault
+	fault(fault string)
+}
+
+var metricsSinks []metricsSink
+
+// backendSink is a metricsSink counting the health events of the backends
+type backendSink interface {
+	// backend records a backend going down or up
+	backend(url, event string)
+}
+
+// checkMetricLabels validates the labels selected with -metrics-labels
+func checkMetricLabels(labels []string) error {
+	for _, l := range labels {
+		switch l {
+		case labelMethod, labelHost, labelPath, labelStatus, labelFault, labelTenant:
+		default:
+			return fmt.Errorf("unknown metric label %q: expected method, host, path, status, fault or tenant", l)
+		}
+	}
+
+	return nil
+}
+
+func recordRequest(rr requestRecord) {
+	if rr.fault == "" {
+		rr.fault = "none"
+	}
+	for _, s := range metricsSinks {
+		s.request(rr)
+	}
+}
+
+func recordFault(fault string) {
+	for _, s := range metricsSinks {
+		s.fault(fault)
+	}
+}
+
+func recordBackendEvent(url, event string) {
+	for _, s := range metricsSinks {
+		if bs, ok := s.(backendSink); ok {
+			bs.backend(url, event)
+		}
+	}
+}
+
+// statsdSink emits the metrics to a StatsD server
+type statsdSink struct {
+	client *types.StatsD
+}
+
+func (s statsdSink) request(rr requestRecord) {
+	tags := rr.labels()
+	for i, v := range tags {
+		tags[i] = metricLabels[i] + ":" + v
+	}
+
+	s.client.Count("requests", 1, tags...)
+	s.client.Timing("request.duration", rr.duration, tags...)
+}
+
+func (s statsdSink) fault(fault string) {
+	s.client.Count("faults", 1, "fault:"+fault)
+}
+
+func (s statsdSink) backend(url, event string) {
+	s.client.Count("backend.events", 1, "backend:"+url, "event:"+event)
+}
+
+// eventSink publishes an access record per request to a NATS subject or
+// a Kafka topic
+type eventSink struct {
+	stream *types.EventStream
+}
+
+// accessRecord is the JSON message published by eventSink
+type accessRecord struct {
+	Time       time.Time `json:"time"`
+	Tenant     string    `json:"tenant"`
+	Method     string    `json:"method"`
+	Host       string    `json:"host"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Fault      string    `json:"fault"`
+	DurationMs float64   `json:"duration_ms"`
+	TraceID    string    `json:"trace_id,omitempty"`
+}
+
+func (s eventSink) request(rr requestRecord) {
+	msg, err := json.Marshal(accessRecord{
+		Time:       time.Now().UTC(),
+		Tenant:     rr.tenant,
+		Method:     rr.method,
+		Host:       rr.host,
+		Path:       rr.path,
+		Status:     rr.status,
+		Fault:      rr.fault,
+		DurationMs: float64(rr.duration) / float64(time.Millisecond),
+		TraceID:    rr.traceID,
+	})
+	if err != nil {
+		return
+	}
+
+	s.stream.Send(msg)
+}
+
+func (s eventSink) fault(fault string) {}
+
+// promSink collects the metrics exposed by the /metrics admin endpoint
+type promSink struct {
+	registry *types.Registry
+	requests *types.CounterVec
+	duration *types.HistogramVec
+	faults   *types.CounterVec
+	backends *types.CounterVec
+}
+
+func newPromSink(buckets []float64) *promSink {
+	reg := &types.Registry{}
+	return &promSink{
+		registry: reg,
+		requests: reg.NewCounter("floki_requests_total", "Requests handled by the proxy.", metricLabels...),
+		duration: reg.NewHistogram("floki_request_duration_seconds", "Latency of the requests handled by the proxy.", buckets, metricLabels...),
+		faults:   reg.NewCounter("floki_faults_total", "Injected faults.", labelFault),
+		backends: reg.NewCounter("floki_backend_events_total", "Backends removed (down) and readmitted (up) by the health checks.", "backend", "event"),
+	}
+}
+
+func (s *promSink) request(rr requestRecord) {
+	values := rr.labels()
+	s.requests.Add(1, values...)
+	s.duration.ObserveWithExemplar(rr.duration.Seconds(), rr.traceID, values...)
+}
+
+func (s *promSink) fault(fault string) {
+	s.faults.Add(1, fault)
+}
+
+func (s *promSink) backend(url, event string) {
+	s.backends.Add(1, url, event)
+}
+
+// ServeHTTP exposes the metrics in the OpenMetrics format, with the latency
+// exemplars, to the scrapers asking for it and in the Prometheus one to the
+// others
+func (s *promSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text") {
+		w.Header().Set("Content-Type", types.OpenMetricsType)
+		s.registry.ExposeOpenMetrics(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.registry.Expose(w)
+}
+
+// traceID returns the trace ID carried by the -metrics-exemplar-header of
+// r: the trace-id field of a W3C traceparent or the whole value of any
+// other header
+func traceID(r *http.Request) string {
+	v := strings.TrimSpace(r.Header.Get(exemplarHeader))
+	if !strings.EqualFold(exemplarHeader, "traceparent") {
+		return v
+	}
+
+	// version-traceid-parentid-flags
+	fields := strings.Split(v, "-")
+	if len(fields) < 4 || len(fields[1]) != 32 || strings.Trim(fields[1], "0") == "" {
+		return ""
+	}
+	if _, err := hex.DecodeString(fields[1]); err != nil {
+		return ""
+	}
+	return fields[1]
+}
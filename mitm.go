@@ -0,0 +1,307 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	tlsFaultAbort      = "abort"
+	tlsFaultWrongHost  = "wrong-host"
+	tlsFaultBadVersion = "bad-version"
+
+	wrongHostName = "wrong-host.floki.invalid"
+
+	certValid      = ""
+	certExpired    = "expired"
+	certSelfSigned = "self-signed"
+)
+
+// certAuthority issues (and caches) the leaf certificates presented to the
+// clients in MITM mode
+type certAuthority struct {
+	cert  *x509.Certificate
+	key   interface{}
+	cache map[string]*tls.Certificate
+	m     sync.Mutex
+}
+
+func loadCertAuthority(certFile, keyFile string) (*certAuthority, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading the CA key pair: %w", err)
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parsing the CA certificate: %w", err)
+	}
+
+	return &certAuthority{
+		cert:  cert,
+		key:   pair.PrivateKey,
+		cache: make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// certificate returns a certificate for host signed by the CA, kind selects
+// a deliberately broken certificate (expired or self-signed)
+func (ca *certAuthority) certificate(host, kind string) (*tls.Certificate, error) {
+	ca.m.Lock()
+	defer ca.m.Unlock()
+
+	id := host + "|" + kind
+	if c, ok := ca.cache[id]; ok {
+		return c, nil
+	}
+
+	c, err := ca.issue(host, kind)
+	if err != nil {
+		return nil, err
+	}
+	ca.cache[id] = c
+
+	return c, nil
+}
+
+func (ca *certAuthority) issue(host, kind string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+
+	parent, signer := ca.cert, ca.key
+	switch kind {
+	case certExpired:
+		tmpl.NotBefore = time.Now().Add(-48 * time.Hour)
+		tmpl.NotAfter = time.Now().Add(-24 * time.Hour)
+	case certSelfSigned:
+		parent, signer = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		return nil, fmt.Errorf("issuing certificate for %s: %w", host, err)
+	}
+
+	chain := [][]byte{der}
+	if kind != certSelfSigned {
+		chain = append(chain, ca.cert.Raw)
+	}
+
+	return &tls.Certificate{
+		Certificate: chain,
+		PrivateKey:  key,
+	}, nil
+}
+
+// tlsConfigFor returns the TLS configuration used to intercept a CONNECT to
+// host, injecting the handshake faults if requested
+func (ca *certAuthority) tlsConfigFor(host string) *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = host
+			}
+
+			kind := mitmBadCerts[name]
+			if kind != certValid {
+				log.Warnf("serving %s certificate for %s", kind, name)
+			}
+
+			if !injectFault(tlsFaultRate, "tls-"+tlsFault, name) {
+				return &tls.Config{GetCertificate: ca.getCertificate(name, kind)}, nil
+			}
+
+			log.Warnf("injecting TLS fault (%s) for %s", tlsFault, name)
+			switch tlsFault {
+			case tlsFaultWrongHost:
+				return &tls.Config{GetCertificate: ca.getCertificate(wrongHostName, kind)}, nil
+			case tlsFaultBadVersion:
+				v := unsupportedVersion(hello.SupportedVersions)
+				return &tls.Config{
+					GetCertificate: ca.getCertificate(name, kind),
+					MinVersion:     v,
+					MaxVersion:     v,
+				}, nil
+			default:
+				return nil, fmt.Errorf("handshake aborted by floki")
+			}
+		},
+	}
+}
+
+func (ca *certAuthority) getCertificate(name, kind string) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return ca.certificate(name, kind)
+	}
+}
+
+// unsupportedVersion returns a TLS version not offered by the client,
+// falling back to the oldest one
+func unsupportedVersion(offered []uint16) uint16 {
+	for _, v := range []uint16{tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13} {
+		found := false
+		for _, o := range offered {
+			if o == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return v
+		}
+	}
+
+	return tls.VersionTLS10
+}
+
+// connectPortAllowed report if the CONNECT requests can be tunneled to
+// port, so the proxy is not an open relay to any service
+func connectPortAllowed(port string) bool {
+	for _, p := range splitList(connectPorts) {
+		if p == port {
+			return true
+		}
+	}
+
+	return false
+}
+
+// connectHandler handles a CONNECT request. In MITM mode the TLS session is
+// terminated with a certificate signed by the MITM CA and the decrypted
+// requests are served by mainHandler, otherwise the connection is tunneled
+// to the target applying the SNI rules, only on the -connect-ports
+func connectHandler(w http.ResponseWriter, r *http.Request) {
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = r.Host, "443"
+	}
+	if mitmCA == nil && !connectPortAllowed(port) {
+		log.Warnf("rejecting CONNECT to %s: port not allowed", r.Host)
+		reject(w)
+		return
+	}
+
+	conn, brw, err := hijack(w)
+	if err != nil {
+		log.Errorf("hijacking CONNECT to %s: %v", r.Host, err)
+		return
+	}
+
+	if _, err := brw.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		conn.Close()
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	if mitmCA == nil {
+		tunnel(conn, brw.Reader, r.Host)
+		return
+	}
+
+	// the ClientHello may be already buffered, sent right behind the CONNECT
+	tlsConn := tls.Server(&bufferedConn{Conn: conn, r: brw.Reader}, mitmCA.tlsConfigFor(host))
+	if err := tlsConn.Handshake(); err != nil {
+		log.Warnf("TLS handshake with client for %s: %v", r.Host, err)
+		tlsConn.Close()
+		return
+	}
+
+	target := r.Host
+	t := tenantOf(r.Context())
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Scheme = "https"
+			r.URL.Host = target
+			mainHandler(w, r)
+		}),
+		BaseContext: func(net.Listener) context.Context {
+			return withTenant(context.Background(), t)
+		},
+	}
+	srv.Serve(newSingleConnListener(tlsConn))
+}
+
+// bufferedConn is a hijacked net.Conn reading through the buffer of the
+// server, which may hold data already sent by the client
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// singleConnListener is a net.Listener returning a single, already accepted,
+// connection
+type singleConnListener struct {
+	conn net.Conn
+	once sync.Once
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	return &singleConnListener{conn: conn}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	var c net.Conn
+	l.once.Do(func() {
+		c = l.conn
+	})
+	if c == nil {
+		return nil, io.EOF
+	}
+
+	return c, nil
+}
+
+func (l *singleConnListener) Close() error {
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,65 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// negativeEntry is an upstream connection failure cached until expires
+type negativeEntry struct {
+	err     error
+	expires time.Time
+}
+
+// negativeCache keeps for -negative-cache-ttl the connection failures by
+// upstream address, the next dials fail fast with the same error
+var negativeCache = struct {
+	data map[string]negativeEntry
+	m    sync.Mutex
+}{data: make(map[string]negativeEntry)}
+
+// cachedFailure returns the cached failure of addr, nil if there is none
+func cachedFailure(addr string) error {
+	if negativeCacheTTL <= 0 {
+		return nil
+	}
+
+	negativeCache.m.Lock()
+	defer negativeCache.m.Unlock()
+	e, ok := negativeCache.data[addr]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		delete(negativeCache.data, addr)
+		return nil
+	}
+
+	return fmt.Errorf("upstream %s failed less than %s ago (negative cache): %w", addr, negativeCacheTTL, e.err)
+}
+
+// cacheFailure records the result of a dial of addr: a failure is cached, a
+// success forgets the previous one. The canceled dials are not failures of
+// the upstream
+func cacheFailure(ctx context.Context, addr string, err error) {
+	if negativeCacheTTL <= 0 || ctx.Err() != nil {
+		return
+	}
+
+	negativeCache.m.Lock()
+	defer negativeCache.m.Unlock()
+	if err == nil {
+		delete(negativeCache.data, addr)
+		return
+	}
+	log.Debugf("caching the failure of %s for %s: %v", addr, negativeCacheTTL, err)
+	negativeCache.data[addr] = negativeEntry{err: err, expires: time.Now().Add(negativeCacheTTL)}
+}
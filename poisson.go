@@ -0,0 +1,76 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	mathrand "math/rand"
+	"sync"
+	"time"
+)
+
+// faultArrivals is a Poisson process of faults, independent of the request
+// volume: every arrival fails the next request or, with a duration, all the
+// requests in the following duration. An arrival while the previous one is
+// still pending is merged with it
+type faultArrivals struct {
+	// mean is the mean time between two arrivals
+	mean     time.Duration
+	duration time.Duration
+	next     time.Time
+	until    time.Time
+	armed    bool
+	m        sync.Mutex
+}
+
+// maxFaultArrivalRate is the highest rate, in faults per minute, with a mean
+// time between two arrivals of at least 1ns
+const maxFaultArrivalRate = float64(time.Minute)
+
+// arrivals is the process of -fault-arrival-rate, nil when disabled
+var arrivals *faultArrivals
+
+// newFaultArrivals returns a process with the given rate, in faults per
+// minute
+func newFaultArrivals(rate float64, duration time.Duration) *faultArrivals {
+	fa := &faultArrivals{
+		mean:     time.Duration(float64(time.Minute) / rate),
+		duration: duration,
+	}
+	fa.next = time.Now().Add(fa.interval())
+	return fa
+}
+
+// interval draws the time until the next arrival
+func (fa *faultArrivals) interval() time.Duration {
+	return time.Duration(mathrand.ExpFloat64() * float64(fa.mean))
+}
+
+// trigger report if a request arriving at now must fail
+func (fa *faultArrivals) trigger(now time.Time) bool {
+	fa.m.Lock()
+	defer fa.m.Unlock()
+
+	if !now.Before(fa.next) {
+		// the process is memoryless: the last arrival before now is an
+		// interval back from it, or the first one missed, and the next
+		// arrival is an interval after now
+		last := now.Add(-fa.interval())
+		if last.Before(fa.next) {
+			last = fa.next
+		}
+		fa.armed = true
+		fa.until = last.Add(fa.duration)
+		fa.next = now.Add(fa.interval())
+	}
+
+	if fa.duration > 0 {
+		return now.Before(fa.until)
+	}
+	if fa.armed {
+		fa.armed = false
+		return true
+	}
+	return false
+}
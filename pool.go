@@ -0,0 +1,283 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// backend is one of the upstreams of a pool
+type backend struct {
+	url *url.URL
+	// down is set atomically by the health checks
+	down int32
+	// passes and failures are the consecutive results of the health
+	// checks, touched only by the checker of the backend
+	passes   int
+	failures int
+}
+
+func (b *backend) healthy() bool {
+	return atomic.LoadInt32(&b.down) == 0
+}
+
+// upstreamPool is the set of upstreams of the reverse proxy mode, the
+// requests are spread round robin across the healthy ones
+type upstreamPool struct {
+	backends []*backend
+	next     uint32
+}
+
+// parseUpstreams decodes the upstream URLs separated by "," or "|"
+func parseUpstreams(raw string) (*upstreamPool, error) {
+	p := &upstreamPool{}
+	for _, x := range strings.FieldsFunc(raw, func(c rune) bool { return c == ',' || c == '|' }) {
+		u, err := parseUpstream(strings.TrimSpace(x))
+		if err != nil {
+			return nil, err
+		}
+		p.backends = append(p.backends, &backend{url: u})
+	}
+	if len(p.backends) == 0 {
+		return nil, fmt.Errorf("bad upstream %q: no URL", raw)
+	}
+
+	return p, nil
+}
+
+func (p *upstreamPool) String() string {
+	if p == nil {
+		return ""
+	}
+
+	var xs []string
+	for _, b := range p.backends {
+		xs = append(xs, b.url.String())
+	}
+	return strings.Join(xs, ",")
+}
+
+// pick returns the upstream of the next request. When all the backends are
+// down they are all used, the requests fail as the upstreams do
+func (p *upstreamPool) pick() *url.URL {
+	if p == nil {
+		return nil
+	}
+
+	n := uint32(len(p.backends))
+	start := atomic.AddUint32(&p.next, 1)
+	for i := uint32(0); i < n; i++ {
+		if b := p.backends[(start+i)%n]; b.healthy() {
+			return b.url
+		}
+	}
+	return p.backends[start%n].url
+}
+
+// id identifies the backend in the sticky cookie, it survives the restarts
+// and the changes of the order of the upstreams
+func (b *backend) id() string {
+	h := fnv.New32a()
+	h.Write([]byte(b.url.String()))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// route returns the upstream of the origin-form request r, nil for the
+// others. With -sticky-header the requests with the same value of the header
+// go to the same backend (rendezvous hashing, only the keys of a backend
+// going down move), with -sticky-cookie the backend is the one named by the
+// cookie: the second value returned is the cookie to set when the request
+// does not carry a valid one
+func (p *upstreamPool) route(r *http.Request) (*url.URL, string) {
+	if p == nil || r.URL.Host != "" {
+		return nil, ""
+	}
+
+	if stickyHeader != "" {
+		if key := r.Header.Get(stickyHeader); key != "" {
+			if b := p.hash(key); b != nil {
+				return b.url, ""
+			}
+		}
+	}
+	if stickyCookie == "" || len(p.backends) == 1 {
+		return p.pick(), ""
+	}
+
+	if c, err := r.Cookie(stickyCookie); err == nil {
+		for _, b := range p.backends {
+			if b.id() == c.Value && b.healthy() {
+				return b.url, ""
+			}
+		}
+	}
+	u := p.pick()
+	for _, b := range p.backends {
+		if b.url == u {
+			return u, b.id()
+		}
+	}
+	return u, ""
+}
+
+// hash returns the healthy backend with the highest score for key, nil if
+// they are all down
+func (p *upstreamPool) hash(key string) *backend {
+	var best *backend
+	var bestScore uint64
+	for _, b := range p.backends {
+		if !b.healthy() {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(b.url.String()))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
+
+// backendStatus is the state of a backend reported by /backends
+type backendStatus struct {
+	URL     string `json:"url"`
+	Healthy bool   `json:"healthy"`
+}
+
+func (p *upstreamPool) status() []backendStatus {
+	var st []backendStatus
+	for _, b := range p.backends {
+		st = append(st, backendStatus{URL: b.url.String(), Healthy: b.healthy()})
+	}
+	return st
+}
+
+// healthChecker probes the backends of the pools with GET -health-path,
+// a backend is removed after -health-unhealthy failed probes in a row and
+// readmitted after -health-healthy successful ones
+type healthChecker struct {
+	client    *http.Client
+	path      string
+	interval  time.Duration
+	unhealthy int
+	healthy   int
+}
+
+// start probes every backend of the pools in its own goroutine
+func (hc *healthChecker) start(pools ...*upstreamPool) {
+	seen := make(map[*upstreamPool]bool)
+	for _, p := range pools {
+		if p == nil || seen[p] {
+			continue
+		}
+		seen[p] = true
+		for _, b := range p.backends {
+			go hc.watch(b)
+		}
+	}
+}
+
+func (hc *healthChecker) watch(b *backend) {
+	ticker := time.NewTicker(hc.interval)
+	defer ticker.Stop()
+
+	for {
+		hc.update(b, hc.probe(b))
+		<-ticker.C
+	}
+}
+
+// probe reports an error if the backend does not answer the health check
+// with a 2xx or 3xx status
+func (hc *healthChecker) probe(b *backend) error {
+	u := *b.url
+	u.Path, u.RawPath, u.RawQuery = singleJoiningSlash(b.url.Path, hc.path), "", ""
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "floki-proxy health check")
+
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 399 {
+		return fmt.Errorf("health check status %s", resp.Status)
+	}
+	return nil
+}
+
+// update counts the result of a probe, switching the backend down or up
+// when a threshold is reached
+func (hc *healthChecker) update(b *backend, err error) {
+	if err != nil {
+		b.passes = 0
+		b.failures++
+		log.Debugf("health check of %s failed (%d in a row): %v", b.url, b.failures, err)
+		if b.healthy() && b.failures >= hc.unhealthy {
+			atomic.StoreInt32(&b.down, 1)
+			log.Warnf("backend %s is down after %d failed health checks: %v", b.url, b.failures, err)
+			recordBackendEvent(b.url.String(), eventBackendDown)
+			notify(eventBackendDown, "backend %s removed after %d failed health checks: %v", b.url, b.failures, err)
+		}
+		return
+	}
+
+	b.failures = 0
+	b.passes++
+	if !b.healthy() && b.passes >= hc.healthy {
+		atomic.StoreInt32(&b.down, 0)
+		log.Warnf("backend %s is up after %d successful health checks", b.url, b.passes)
+		recordBackendEvent(b.url.String(), eventBackendUp)
+		notify(eventBackendUp, "backend %s readmitted after %d successful health checks", b.url, b.passes)
+	}
+}
+
+// pools are the upstream pools of the tenants, listed by /backends
+var pools = struct {
+	data map[string]*upstreamPool
+	m    sync.Mutex
+}{data: make(map[string]*upstreamPool)}
+
+// registerPool makes the pool of the tenant name visible to /backends
+func registerPool(name string, p *upstreamPool) {
+	if p == nil {
+		return
+	}
+
+	pools.m.Lock()
+	defer pools.m.Unlock()
+	pools.data[name] = p
+}
+
+// backendsHandler reports the health of the backends of every tenant
+func backendsHandler(w http.ResponseWriter, r *http.Request) {
+	pools.m.Lock()
+	st := make(map[string][]backendStatus, len(pools.data))
+	for name, p := range pools.data {
+		st[name] = p.status()
+	}
+	pools.m.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
@@ -0,0 +1,181 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/meox/floki-proxy/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// proxyHeaderTimeout bounds the reading of the PROXY protocol header
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyProtoListener reads the PROXY protocol header of the accepted
+// connections, which report the addresses it carries. The headers are read
+// in the background, a slow client does not hold up the others
+type proxyProtoListener struct {
+	net.Listener
+	conns chan net.Conn
+	errs  chan error
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newProxyProtoListener(l net.Listener) *proxyProtoListener {
+	pl := &proxyProtoListener{
+		Listener: l,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go pl.accept()
+
+	return pl
+}
+
+func (pl *proxyProtoListener) accept() {
+	for {
+		conn, err := pl.Listener.Accept()
+		if err != nil {
+			select {
+			case pl.errs <- err:
+			case <-pl.done:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go pl.readHeader(conn)
+	}
+}
+
+func (pl *proxyProtoListener) readHeader(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	br := bufio.NewReader(conn)
+	src, dst, err := types.ReadProxyHeader(br)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Warnf("reading PROXY protocol header from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	select {
+	case pl.conns <- &proxyConn{Conn: conn, r: br, remote: src, local: dst}:
+	case <-pl.done:
+		conn.Close()
+	}
+}
+
+func (pl *proxyProtoListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.conns:
+		return conn, nil
+	case err := <-pl.errs:
+		return nil, err
+	}
+}
+
+func (pl *proxyProtoListener) Close() error {
+	pl.once.Do(func() { close(pl.done) })
+	return pl.Listener.Close()
+}
+
+// proxyConn is a connection whose addresses come from its PROXY protocol
+// header, if any
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// NetConn returns the connection carrying the PROXY protocol header
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite half-closes the underlying connection, if it can be
+func (c *proxyConn) CloseWrite() error {
+	if tc, ok := tcpConn(c.Conn); ok {
+		return tc.CloseWrite()
+	}
+	return nil
+}
+
+// tcpConn returns the TCP connection under conn, unwrapping the PROXY
+// protocol connections, so the socket options (SO_LINGER, SO_ORIGINAL_DST)
+// still apply with -proxy-protocol
+func tcpConn(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, true
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// acceptProxyProtocol wraps l with a proxyProtoListener if -proxy-protocol
+// is set
+func acceptProxyProtocol(l net.Listener) net.Listener {
+	if !proxyProtocol {
+		return l
+	}
+	return newProxyProtoListener(l)
+}
+
+type connAddrsKey struct{}
+
+// connAddrs are the addresses of a client connection
+type connAddrs struct {
+	remote net.Addr
+	local  net.Addr
+}
+
+// withConnAddrs returns the context of conn carrying its addresses, sent to
+// the upstreams with -upstream-proxy-protocol
+func withConnAddrs(ctx context.Context, conn net.Conn) context.Context {
+	if upstreamProxyProtocol == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, connAddrsKey{}, connAddrs{remote: conn.RemoteAddr(), local: conn.LocalAddr()})
+}
+
+// sendProxyHeader writes on the upstream connection conn the PROXY protocol
+// header with the addresses of the client connection of ctx
+func sendProxyHeader(ctx context.Context, conn net.Conn, version int) error {
+	ca, _ := ctx.Value(connAddrsKey{}).(connAddrs)
+	return types.WriteProxyHeader(conn, version, ca.remote, ca.local)
+}
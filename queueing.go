@@ -0,0 +1,33 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	mathrand "math/rand"
+	"time"
+)
+
+// maxUtilization bounds the utilization of the queueing model, so that the
+// waiting time stays finite beyond the capacity
+const maxUtilization = 0.99
+
+// queueDelay returns the waiting time of a request arriving with inFlight
+// requests in flight, modelling the upstream as an M/M/1 queue: with a
+// service time S and an utilization ρ (inFlight over -queue-capacity) the
+// mean wait is S·ρ/(1-ρ), the returned one is drawn from an exponential
+// distribution with that mean. It is 0 when the model is disabled
+func queueDelay(inFlight int) time.Duration {
+	if queueServiceTime <= 0 {
+		return 0
+	}
+
+	rho := float64(inFlight) / float64(queueCapacity)
+	if rho > maxUtilization {
+		rho = maxUtilization
+	}
+	mean := float64(queueServiceTime) * rho / (1 - rho)
+
+	return time.Duration(mathrand.ExpFloat64() * mean)
+}
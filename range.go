@@ -0,0 +1,98 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// the faults of the Range requests
+const (
+	// rangeWrong shifts the Content-Range of the 206 responses by one byte
+	rangeWrong = "wrong-range"
+	// rangeShort serves half of the requested range
+	rangeShort = "short"
+	// rangeIgnore drops the Range header, the upstream answers 200
+	rangeIgnore = "ignore"
+)
+
+// contentRange is a single range of a 206 response
+type contentRange struct {
+	start, end int64
+	// total is the complete length, "*" if unknown
+	total string
+}
+
+func (cr contentRange) String() string {
+	return fmt.Sprintf("bytes %d-%d/%s", cr.start, cr.end, cr.total)
+}
+
+// parseContentRange decodes a Content-Range in the form "bytes a-b/total"
+func parseContentRange(x string) (contentRange, bool) {
+	if !strings.HasPrefix(x, "bytes ") {
+		return contentRange{}, false
+	}
+
+	tks := strings.SplitN(strings.TrimPrefix(x, "bytes "), "/", 2)
+	if len(tks) != 2 {
+		return contentRange{}, false
+	}
+	se := strings.SplitN(tks[0], "-", 2)
+	if len(se) != 2 {
+		return contentRange{}, false
+	}
+
+	start, err := strconv.ParseInt(se[0], 10, 64)
+	if err != nil {
+		return contentRange{}, false
+	}
+	end, err := strconv.ParseInt(se[1], 10, 64)
+	if err != nil || end < start {
+		return contentRange{}, false
+	}
+
+	return contentRange{start: start, end: end, total: tks[1]}, true
+}
+
+// tamperRange applies, at -range-fault-rate, the wrong-range or short fault
+// to the single range 206 response resp to r. It returns false if resp is
+// not such a response, or it is left untouched
+func tamperRange(r *http.Request, resp *http.Response, mode string) bool {
+	if resp.StatusCode != http.StatusPartialContent {
+		return false
+	}
+	cr, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if !ok {
+		return false
+	}
+	n := (cr.end - cr.start + 1) / 2
+	if mode == rangeShort && n == 0 {
+		return false
+	}
+	if !injectRequestFault(r, rangeFaultRate, "range-"+mode) {
+		return false
+	}
+
+	switch mode {
+	case rangeWrong:
+		cr.start++
+		cr.end++
+	case rangeShort:
+		cr.end = cr.start + n - 1
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(resp.Body, n), resp.Body}
+		resp.ContentLength = n
+		resp.Header.Set("Content-Length", strconv.FormatInt(n, 10))
+	}
+	resp.Header.Set("Content-Range", cr.String())
+
+	return true
+}
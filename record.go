@@ -0,0 +1,224 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// recordedFlow is a line of a recording, the bodies are truncated to
+// -record-max-body and the redacted headers are not recorded in clear.
+// Truncated reports either body truncated, BodyTruncated the request one
+type recordedFlow struct {
+	Time           time.Time   `json:"time"`
+	Method         string      `json:"method"`
+	URL            string      `json:"url"`
+	Host           string      `json:"host"`
+	Header         http.Header `json:"header"`
+	Body           []byte      `json:"body,omitempty"`
+	Status         int         `json:"status"`
+	ResponseHeader http.Header `json:"response_header,omitempty"`
+	ResponseBody   []byte      `json:"response_body,omitempty"`
+	Truncated      bool        `json:"truncated,omitempty"`
+	BodyTruncated  bool        `json:"body_truncated,omitempty"`
+	Fault          string      `json:"fault,omitempty"`
+	DurationMS     float64     `json:"duration_ms"`
+}
+
+// flowRecorder appends the flows to the recording, enc is nil when not
+// recording
+var flowRecorder = struct {
+	enc *json.Encoder
+	m   sync.Mutex
+}{}
+
+// openRecording starts recording the flows to path
+func openRecording(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	flowRecorder.enc = json.NewEncoder(f)
+	return nil
+}
+
+func recording() bool {
+	return flowRecorder.enc != nil
+}
+
+// recordFlow appends the flow f of r to the recording
+func recordFlow(r *http.Request, f *flow, status int) {
+	rf := recordedFlow{
+		Time:          f.start,
+		Method:        r.Method,
+		URL:           f.url,
+		Host:          r.Host,
+		Header:        redactedCopy(r.Header),
+		Body:          f.reqBody.buf.Bytes(),
+		Status:        status,
+		Truncated:     f.reqBody.truncated() || f.respBody.truncated(),
+		BodyTruncated: f.reqBody.truncated(),
+		Fault:         f.fault,
+		DurationMS:    float64(time.Since(f.start)) / float64(time.Millisecond),
+	}
+	if !f.hijacked {
+		rf.ResponseHeader = redactedCopy(f.Header())
+		rf.ResponseBody = f.respBody.buf.Bytes()
+	}
+
+	flowRecorder.m.Lock()
+	defer flowRecorder.m.Unlock()
+	if err := flowRecorder.enc.Encode(rf); err != nil {
+		log.Errorf("recording flow: %v", err)
+	}
+}
+
+// redactedCopy returns a copy of h with the redacted headers hidden
+func redactedCopy(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, vs := range h {
+		for _, v := range vs {
+			c.Add(k, redactHeader(k, v))
+		}
+	}
+
+	return c
+}
+
+// replay sends again the requests of a recording, reporting the ones whose
+// status differs from the recorded one. The requests whose body was
+// truncated are skipped, the redacted headers are not sent
+func replay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	in := fs.String("record-file", "flows.jsonl", "recording to replay")
+	target := fs.String("target", "", "send the requests to this base URL (http://host:port) instead of the recorded one")
+	proxy := fs.String("proxy", "", "send the requests through this HTTP proxy (http://localhost:9005)")
+	interval := fs.Duration("interval", 0, "pause between two requests")
+	fs.Parse(args)
+
+	f, err := os.Open(*in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	transport := &http.Transport{}
+	if *proxy != "" {
+		u, err := url.Parse(*proxy)
+		if err != nil {
+			log.Fatalf("bad proxy: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var base *url.URL
+	if *target != "" {
+		if base, err = url.Parse(*target); err != nil {
+			log.Fatalf("bad target: %v", err)
+		}
+	}
+
+	var total, mismatches, skipped int
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 64*1024*1024)
+	for sc.Scan() {
+		var rf recordedFlow
+		if err := json.Unmarshal(sc.Bytes(), &rf); err != nil {
+			log.Fatalf("decoding flow %d: %v", total+1, err)
+		}
+		if total > 0 && *interval > 0 {
+			time.Sleep(*interval)
+		}
+		total++
+
+		if rf.BodyTruncated {
+			skipped++
+			log.Warnf("%s %s: skipped, the recorded body is truncated", rf.Method, rf.URL)
+			continue
+		}
+		status, err := replayFlow(client, base, rf)
+		if err != nil {
+			mismatches++
+			log.Warnf("%s %s: %v", rf.Method, rf.URL, err)
+			continue
+		}
+		if status != rf.Status {
+			mismatches++
+			log.Warnf("%s %s: got %d, recorded %d", rf.Method, rf.URL, status, rf.Status)
+			continue
+		}
+		log.Infof("%s %s: %d", rf.Method, rf.URL, status)
+	}
+	if err := sc.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Infof("replayed %d requests, %d with a different outcome, %d skipped", total-skipped, mismatches, skipped)
+	if mismatches > 0 {
+		os.Exit(1)
+	}
+}
+
+func replayFlow(client *http.Client, base *url.URL, rf recordedFlow) (int, error) {
+	u, err := url.Parse(rf.URL)
+	if err != nil {
+		return 0, err
+	}
+	if base != nil {
+		u.Scheme, u.Host = base.Scheme, base.Host
+	}
+	if u.Host == "" {
+		return 0, fmt.Errorf("relative URL, a -target is required")
+	}
+
+	req, err := http.NewRequest(rf.Method, u.String(), bytes.NewReader(rf.Body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header = rf.Header.Clone()
+	for k, vs := range req.Header {
+		for _, v := range vs {
+			if v == redactedValue {
+				log.Warnf("%s %s: not sending the redacted header %s", rf.Method, rf.URL, k)
+				req.Header.Del(k)
+				break
+			}
+		}
+	}
+	req.Header.Del("Content-Length")
+	req.Header.Del("Proxy-Connection")
+	if base == nil {
+		req.Host = rf.Host
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return resp.StatusCode, nil
+}
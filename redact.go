@@ -0,0 +1,32 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+)
+
+const redactedValue = "[REDACTED]"
+
+// redactedHeaders is the set of canonical header names hidden in the logs
+// and in the dumps
+var redactedHeaders map[string]bool
+
+// setRedactedHeaders builds redactedHeaders from a comma separated list
+func setRedactedHeaders(list string) {
+	redactedHeaders = make(map[string]bool)
+	for _, h := range splitList(list) {
+		redactedHeaders[http.CanonicalHeaderKey(h)] = true
+	}
+}
+
+// redactHeader returns the value of the header to be logged
+func redactHeader(name, value string) string {
+	if redactedHeaders[http.CanonicalHeaderKey(name)] {
+		return redactedValue
+	}
+
+	return value
+}
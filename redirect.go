@@ -0,0 +1,139 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/meox/floki-proxy/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// redirectParam is the query parameter tracking the injected redirect hops,
+// its value is "hop-depth-status-mac" where depth is "loop" for endless
+// loops and mac authenticates the rest
+const redirectParam = "floki-redirect"
+
+// redirectKey is the per-process key of the macs of the hops, a parameter
+// not set by this process is left to the upstream
+var redirectKey = func() []byte {
+	k := make([]byte, 32)
+	if _, err := rand.Read(k); err != nil {
+		log.Fatal(err)
+	}
+	return k
+}()
+
+// redirectMAC returns the mac of the state x
+func redirectMAC(x string) string {
+	m := hmac.New(sha256.New, redirectKey)
+	m.Write([]byte(x))
+	return hex.EncodeToString(m.Sum(nil)[:8])
+}
+
+// redirectState is the position of a request in an injected redirect chain
+type redirectState struct {
+	hop    int
+	depth  int
+	loop   bool
+	status int
+}
+
+func (rs redirectState) String() string {
+	depth := strconv.Itoa(rs.depth)
+	if rs.loop {
+		depth = "loop"
+	}
+
+	x := fmt.Sprintf("%d-%s-%d", rs.hop, depth, rs.status)
+	return x + "-" + redirectMAC(x)
+}
+
+func parseRedirectState(x string) (redirectState, error) {
+	i := strings.LastIndexByte(x, '-')
+	if i < 0 || !hmac.Equal([]byte(x[i+1:]), []byte(redirectMAC(x[:i]))) {
+		return redirectState{}, fmt.Errorf("redirect state %s not injected by this proxy", x)
+	}
+	tks := strings.Split(x[:i], "-")
+	if len(tks) != 3 {
+		return redirectState{}, fmt.Errorf("bad redirect state %s", x)
+	}
+
+	var rs redirectState
+	var err error
+	if rs.hop, err = strconv.Atoi(tks[0]); err != nil {
+		return redirectState{}, err
+	}
+	if tks[1] == "loop" {
+		rs.loop = true
+	} else if rs.depth, err = strconv.Atoi(tks[1]); err != nil {
+		return redirectState{}, err
+	}
+	if rs.status, err = strconv.Atoi(tks[2]); err != nil {
+		return redirectState{}, err
+	}
+
+	return rs, nil
+}
+
+// startRedirect answers r with the first redirect of a chain (or loop)
+// pointing to path
+func startRedirect(w http.ResponseWriter, r *http.Request, path string, a types.Action) {
+	redirect(w, r, path, redirectState{
+		hop:    1,
+		depth:  a.Depth,
+		loop:   a.Loop,
+		status: a.Status,
+	})
+}
+
+// continueRedirect answers r with the next redirect if r is part of an
+// injected chain (or loop) returning true. Otherwise the request must be
+// forwarded, the hop tracking parameter is removed from the URL and chained
+// report if r was the last hop of a chain. A parameter not injected by this
+// process is forwarded untouched
+func continueRedirect(w http.ResponseWriter, r *http.Request) (handled bool, chained bool) {
+	q := r.URL.Query()
+	x := q.Get(redirectParam)
+	if x == "" {
+		return false, false
+	}
+
+	rs, err := parseRedirectState(x)
+	if err != nil {
+		log.Debugf("ignoring %s: %v", redirectParam, err)
+		return false, false
+	}
+	if !rs.loop && rs.hop >= rs.depth {
+		q.Del(redirectParam)
+		r.URL.RawQuery = q.Encode()
+		return false, true
+	}
+
+	if rs.loop {
+		rs.hop = rs.hop%2 + 1
+	} else {
+		rs.hop++
+	}
+	redirect(w, r, r.URL.Path, rs)
+	log.Warnf("injecting redirect %d (hop %d): %s", rs.status, rs.hop, r.RequestURI)
+
+	return true, false
+}
+
+func redirect(w http.ResponseWriter, r *http.Request, path string, rs redirectState) {
+	q := r.URL.Query()
+	q.Set(redirectParam, rs.String())
+	location := url.URL{Path: path, RawQuery: q.Encode()}
+	http.Redirect(w, r, location.String(), rs.status)
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	mathrand "math/rand"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reorderSpacing separates the release of two buffered requests, so that
+// they reach the upstream in the shuffled order
+const reorderSpacing = 10 * time.Millisecond
+
+// reorderQueue buffers the requests until window of them are waiting, or
+// wait elapses since the first one, and then releases them in a random order.
+// batch counts the released batches, every batch has its own timer
+type reorderQueue struct {
+	window  int
+	wait    time.Duration
+	pending []chan struct{}
+	batch   uint64
+	timer   *time.Timer
+	m       sync.Mutex
+}
+
+// requestQueue is the queue of -reorder-window, nil when disabled
+var requestQueue *reorderQueue
+
+func newReorderQueue(window int, wait time.Duration) *reorderQueue {
+	return &reorderQueue{window: window, wait: wait}
+}
+
+// enter blocks until the request is released or ctx is done
+func (q *reorderQueue) enter(ctx context.Context) error {
+	ch := make(chan struct{})
+
+	q.m.Lock()
+	q.pending = append(q.pending, ch)
+	if len(q.pending) >= q.window {
+		q.flushLocked()
+	} else if len(q.pending) == 1 {
+		batch := q.batch
+		q.timer = time.AfterFunc(q.wait, func() {
+			q.m.Lock()
+			defer q.m.Unlock()
+			// the timer may fire while its batch is released as full
+			if q.batch == batch {
+				q.flushLocked()
+			}
+		})
+	}
+	q.m.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *reorderQueue) flushLocked() {
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+	q.batch++
+	batch := q.pending
+	q.pending = nil
+	if len(batch) == 0 {
+		return
+	}
+
+	mathrand.Shuffle(len(batch), func(i, j int) {
+		batch[i], batch[j] = batch[j], batch[i]
+	})
+	if len(batch) > 1 {
+		log.Warnf("forwarding %d buffered requests in shuffled order", len(batch))
+	}
+
+	go func() {
+		for i, ch := range batch {
+			if i > 0 {
+				time.Sleep(reorderSpacing)
+			}
+			close(ch)
+		}
+	}()
+}
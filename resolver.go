@@ -0,0 +1,97 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// upstreamResolver resolves the upstream names with customDNS
+var upstreamResolver = net.DefaultResolver
+
+// customDNS report if the upstream names are resolved by floki, with the
+// -dns-server, the -dns-timeout and the DNS faults
+func customDNS() bool {
+	return dnsServer != "" || dnsTimeout > 0 || dnsDelayRate > 0 || dnsServfailRate > 0
+}
+
+// newResolver returns the resolver querying server, the system one if empty
+func newResolver(server string) *net.Resolver {
+	if server == "" {
+		return net.DefaultResolver
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// lookupUpstream resolves the upstream host injecting the DNS faults: the
+// slow lookups and the SERVFAIL answers
+func lookupUpstream(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if injectFault(dnsDelayRate, "dns-delay", host) {
+		select {
+		case <-time.After(dnsDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if injectFault(dnsServfailRate, "dns-servfail", host) {
+		// the error of the Go resolver on a SERVFAIL
+		return nil, &net.DNSError{Err: "server misbehaving", Name: host, Server: dnsServer, IsTemporary: true}
+	}
+
+	if dnsTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dnsTimeout)
+		defer cancel()
+	}
+	return upstreamResolver.LookupIPAddr(ctx, host)
+}
+
+// dialUpstream dials addr applying -resolve and, with customDNS, resolving
+// the host with upstreamResolver, the addresses are tried in order. With
+// -negative-cache-ttl the failures are cached by addr
+func dialUpstream(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	if err := cachedFailure(addr); err != nil {
+		return nil, err
+	}
+
+	conn, err := dialResolved(ctx, d, network, resolveAddr(addr))
+	cacheFailure(ctx, addr, err)
+	return conn, err
+}
+
+func dialResolved(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || !customDNS() || net.ParseIP(host) != nil {
+		return d.DialContext(ctx, network, addr)
+	}
+
+	ips, err := lookupUpstream(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("resolved %s to %v", host, ips)
+
+	errDial := errors.New("no address for " + host)
+	for _, ip := range ips {
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errDial = err
+	}
+	return nil, errDial
+}
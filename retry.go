@@ -0,0 +1,128 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// retryPolicy is how a retrying gateway sends a request to the upstream
+// again: up to count more times, waiting backoff (doubled at every retry),
+// after a connection error or a response with one of the statuses
+type retryPolicy struct {
+	count    int
+	backoff  time.Duration
+	statuses map[int]bool
+	methods  map[string]bool
+}
+
+// newRetryPolicy returns the policy with the comma separated statuses and
+// methods
+func newRetryPolicy(count int, backoff time.Duration, statuses, methods string) (*retryPolicy, error) {
+	p := &retryPolicy{
+		count:    count,
+		backoff:  backoff,
+		statuses: make(map[int]bool),
+		methods:  make(map[string]bool),
+	}
+	for _, s := range splitList(statuses) {
+		code, err := strconv.Atoi(s)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("bad retry status %q", s)
+		}
+		p.statuses[code] = true
+	}
+	for _, m := range splitList(methods) {
+		p.methods[strings.ToUpper(m)] = true
+	}
+
+	return p, nil
+}
+
+func (p *retryPolicy) String() string {
+	if p == nil || p.count <= 0 {
+		return "disabled"
+	}
+
+	var statuses, methods []string
+	for code := range p.statuses {
+		statuses = append(statuses, strconv.Itoa(code))
+	}
+	for m := range p.methods {
+		methods = append(methods, m)
+	}
+	sort.Strings(statuses)
+	sort.Strings(methods)
+	return fmt.Sprintf("%d (backoff %s, statuses %s, methods %s)", p.count, p.backoff, strings.Join(statuses, ","), strings.Join(methods, ","))
+}
+
+// retryable report if the outcome of an attempt is to be retried
+func (p *retryPolicy) retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return p.statuses[resp.StatusCode]
+}
+
+// doUpstream sends req to the upstream retrying it with the policy p. The
+// body is buffered to be sent again, up to max bytes: a larger one, or a
+// method not in the policy, is sent once. So is the body of an "Expect:
+// 100-continue" request, reading it would send the interim 100 to the
+// client before the upstream
+func doUpstream(req *http.Request, p *retryPolicy, max int64) (*http.Response, error) {
+	if p == nil || p.count <= 0 || !p.methods[req.Method] || expectsContinue(req) {
+		return upstreamClient.Do(req)
+	}
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		b, err := ioutil.ReadAll(io.LimitReader(req.Body, max+1))
+		if err != nil {
+			return nil, err
+		}
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), req.Body), req.Body}
+		if int64(len(b)) > max {
+			log.Debugf("request body too large to be retried: %s", req.URL)
+			return upstreamClient.Do(req)
+		}
+		body = b
+	}
+
+	backoff := p.backoff
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		resp, err := upstreamClient.Do(req)
+		if attempt == p.count || !p.retryable(resp, err) || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		if err != nil {
+			log.Warnf("retrying %s %s (%d/%d) in %s: %v", req.Method, req.URL, attempt+1, p.count, backoff, err)
+		} else {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			log.Warnf("retrying %s %s (%d/%d) in %s: %s", req.Method, req.URL, attempt+1, p.count, backoff, resp.Status)
+		}
+		if sleepContext(req.Context(), backoff) != nil {
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+	}
+}
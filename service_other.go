@@ -0,0 +1,13 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+// runAsService is a no-op outside Windows
+func runAsService(run func() error) bool {
+	return false
+}
@@ -0,0 +1,69 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+)
+
+const serviceName = "floki-proxy"
+
+// serviceExitCode is the service specific exit code reported when the proxy
+// fails
+const serviceExitCode = 1
+
+// windowsService runs the proxy under the Windows service manager
+type windowsService struct {
+	run func() error
+}
+
+func (s *windowsService) Execute(args []string, reqs <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.run()
+	}()
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-errs:
+			// the service manager reports it stopped, with the exit code
+			if err != nil {
+				log.Errorf("running the proxy: %v", err)
+				return true, serviceExitCode
+			}
+			return false, 0
+		case c := <-reqs:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				log.Infof("stopping the service")
+				changes <- svc.Status{State: svc.StopPending}
+				notifyStopped("Windows service stopped")
+				return false, 0
+			}
+		}
+	}
+}
+
+// runAsService runs run as a Windows service if the process was started by
+// the service manager, it returns false otherwise
+func runAsService(run func() error) bool {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false
+	}
+
+	if err := svc.Run(serviceName, &windowsService{run: run}); err != nil {
+		log.Fatalf("running the service: %v", err)
+	}
+	return true
+}
@@ -0,0 +1,186 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	sniActionDelay     = "delay"
+	sniActionReset     = "reset"
+	sniActionBlackhole = "blackhole"
+	sniActionRoute     = "route"
+)
+
+var errSNIPeeked = errors.New("sni peeked")
+
+// sniRule is the action applied to a CONNECT tunnel whose ClientHello
+// carries a given server name
+type sniRule struct {
+	action string
+	delay  time.Duration
+	route  string
+}
+
+// parseSNIRule decodes "delay=2s", "reset", "blackhole" or "route=host:port"
+func parseSNIRule(x string) (sniRule, error) {
+	pair := strings.SplitN(x, "=", 2)
+	switch pair[0] {
+	case sniActionReset, sniActionBlackhole:
+		if len(pair) != 1 {
+			return sniRule{}, fmt.Errorf("bad sni rule %s: %s takes no argument", x, pair[0])
+		}
+		return sniRule{action: pair[0]}, nil
+	case sniActionDelay:
+		if len(pair) != 2 {
+			return sniRule{}, fmt.Errorf("bad sni rule %s: missing delay", x)
+		}
+		d, err := time.ParseDuration(pair[1])
+		if err != nil {
+			return sniRule{}, fmt.Errorf("bad sni rule %s: %w", x, err)
+		}
+		return sniRule{action: sniActionDelay, delay: d}, nil
+	case sniActionRoute:
+		if len(pair) != 2 {
+			return sniRule{}, fmt.Errorf("bad sni rule %s: missing address", x)
+		}
+		if _, _, err := net.SplitHostPort(pair[1]); err != nil {
+			return sniRule{}, fmt.Errorf("bad sni rule %s: %w", x, err)
+		}
+		return sniRule{action: sniActionRoute, route: pair[1]}, nil
+	}
+
+	return sniRule{}, fmt.Errorf("bad sni rule %s: expected delay, reset, blackhole or route", x)
+}
+
+// recordingConn is a read-only net.Conn keeping a copy of everything read,
+// writes are discarded
+type recordingConn struct {
+	net.Conn
+	r   io.Reader
+	buf bytes.Buffer
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.buf.Write(p[:n])
+	return n, err
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// peekSNI reads the TLS ClientHello from r returning the server name and
+// the bytes consumed, which must be forwarded to the upstream
+func peekSNI(conn net.Conn, r io.Reader) (string, []byte, error) {
+	rc := &recordingConn{Conn: conn, r: r}
+
+	var name string
+	err := tls.Server(rc, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errSNIPeeked
+		},
+	}).Handshake()
+	if name == "" && !errors.Is(err, errSNIPeeked) {
+		return "", rc.buf.Bytes(), err
+	}
+
+	return name, rc.buf.Bytes(), nil
+}
+
+// tunnel forwards a CONNECT request to target applying the SNI rules, the
+// ClientHello is peeked only if there are any
+func tunnel(conn net.Conn, r io.Reader, target string) {
+	defer conn.Close()
+
+	var name string
+	var hello []byte
+	if len(sniRules) > 0 {
+		var err error
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		name, hello, err = peekSNI(conn, r)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			log.Warnf("peeking SNI for %s: %v", target, err)
+		}
+	}
+
+	if rule, ok := sniRules[name]; ok && injectFault(100, "sni-"+rule.action, name) {
+		log.Warnf("applying sni rule %s to %s", rule.action, name)
+		switch rule.action {
+		case sniActionDelay:
+			time.Sleep(rule.delay)
+		case sniActionReset:
+			if tc, ok := tcpConn(conn); ok {
+				tc.SetLinger(0)
+			}
+			return
+		case sniActionBlackhole:
+			io.Copy(ioutil.Discard, r)
+			return
+		case sniActionRoute:
+			target = rule.route
+		}
+	}
+
+	up, err := dialUpstream(context.Background(), &net.Dialer{Timeout: 10 * time.Second}, "tcp", target)
+	if err != nil {
+		log.Errorf("dialing %s: %v", target, err)
+		return
+	}
+	defer up.Close()
+
+	if _, err := up.Write(hello); err != nil {
+		return
+	}
+
+	// each side half-closes the other when done, so the response to a
+	// client which has finished sending is still delivered
+	done := make(chan struct{}, 2)
+	go func() {
+		relay(up, r, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		relay(conn, up, up)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+
+	log.Infof("tunnel to %s (sni: %s) closed", target, name)
+}
+
+// relay copies src, read from the connection from, to dst half-closing it
+// at the end. After an error both the connections are closed
+func relay(dst net.Conn, src io.Reader, from net.Conn) {
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		from.Close()
+		return
+	}
+	closeWrite(dst)
+}
+
+// closeWrite shuts down the writing side of c, if it can be half-closed
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
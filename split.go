@@ -0,0 +1,114 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/meox/floki-proxy/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// canarySplit sends a percentage of the origin-form requests of the default
+// tenant to the canary upstreams, the rest go to -upstream as usual. The
+// weight is stored atomically, it can be changed at runtime with /split,
+// and comes first to be 64-bit aligned on the 32-bit platforms
+var canarySplit struct {
+	weightBits uint64
+	pool       *upstreamPool
+}
+
+func canaryWeight() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&canarySplit.weightBits))
+}
+
+func setCanaryWeight(w float64) {
+	atomic.StoreUint64(&canarySplit.weightBits, math.Float64bits(w))
+}
+
+// canaryTarget returns the canary upstream of the request r of the tenant
+// t, nil if it goes to the primary upstreams
+func canaryTarget(t *tenant, r *http.Request) *url.URL {
+	if t != defaultTenant || canarySplit.pool == nil || r.URL.Host != "" || !sampled(canaryWeight()) {
+		return nil
+	}
+	return canarySplit.pool.pick()
+}
+
+// headerRoute sends the requests matching spec to pool
+type headerRoute struct {
+	spec types.RouteSpec
+	pool *upstreamPool
+}
+
+// headerRoutes are the -route of the default tenant, checked in order
+var headerRoutes []headerRoute
+
+// newHeaderRoutes returns the routes of the specs
+func newHeaderRoutes(specs types.RouteSpecs) ([]headerRoute, error) {
+	var routes []headerRoute
+	for _, spec := range specs {
+		p, err := parseUpstreams(spec.Upstream)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", spec.Name, err)
+		}
+		routes = append(routes, headerRoute{spec: spec, pool: p})
+	}
+
+	return routes, nil
+}
+
+// routeTarget returns the upstream of the first route matching the request
+// r of the tenant t, nil if there is none
+func routeTarget(t *tenant, r *http.Request) *url.URL {
+	if t != defaultTenant || r.URL.Host != "" {
+		return nil
+	}
+	for _, hr := range headerRoutes {
+		if hr.spec.Matches(r) {
+			log.Debugf("routing %s to %s (route %s)", r.RequestURI, hr.pool, hr.spec.Name)
+			return hr.pool.pick()
+		}
+	}
+
+	return nil
+}
+
+type splitStatus struct {
+	Canary string  `json:"canary"`
+	Weight float64 `json:"weight"`
+}
+
+// splitHandler reports (GET) and changes (POST, weight=0..100) the
+// percentage of the requests sent to the canary
+func splitHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		weight, err := strconv.ParseFloat(r.FormValue("weight"), 64)
+		if err != nil || weight < 0 || weight > 100 {
+			http.Error(w, "bad weight: expected a value in the range [0, 100]", http.StatusBadRequest)
+			return
+		}
+		if canarySplit.pool == nil {
+			http.Error(w, "no canary upstream", http.StatusConflict)
+			return
+		}
+		setCanaryWeight(weight)
+		log.Warnf("canary weight set to %g%% (%s)", weight, apiActor(r))
+	default:
+		http.Error(w, "expected GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(splitStatus{Canary: canarySplit.pool.String(), Weight: canaryWeight()})
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// isEventStream report if resp is a stream of server-sent events
+func isEventStream(resp *http.Response) bool {
+	mt, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && mt == "text/event-stream"
+}
+
+// sseFaultsEnabled report if any of the event faults can trigger
+func sseFaultsEnabled() bool {
+	return sseDropRate > 0 || sseDuplicateRate > 0 || sseDelayRate > 0
+}
+
+// sseStream wraps the body of an event stream applying the event faults:
+// the events (carrying data) can be dropped, duplicated or delayed. The
+// comments, the other fields and an incomplete last event pass untouched
+type sseStream struct {
+	r       *http.Request
+	br      *bufio.Reader
+	body    io.Closer
+	pending []byte
+	err     error
+}
+
+func newSSEStream(r *http.Request, body io.ReadCloser) *sseStream {
+	return &sseStream{r: r, br: bufio.NewReader(body), body: body}
+}
+
+func (s *sseStream) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		s.next()
+	}
+
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *sseStream) Close() error {
+	return s.body.Close()
+}
+
+// next reads the next event into pending
+func (s *sseStream) next() {
+	var ev []byte
+	var data bool
+	for {
+		line, err := s.br.ReadBytes('\n')
+		ev = append(ev, line...)
+		if bytes.HasPrefix(line, []byte("data")) {
+			data = true
+		}
+		if err != nil {
+			s.err = err
+			s.pending = ev
+			return
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+	}
+
+	s.pending = ev
+	if !data {
+		return
+	}
+
+	uri := s.r.RequestURI
+	if injectRequestFault(s.r, sseDropRate, "sse-drop") {
+		log.Warnf("dropping event: %s", uri)
+		s.pending = nil
+		return
+	}
+	if injectRequestFault(s.r, sseDelayRate, "sse-delay") {
+		log.Warnf("delaying event by %s: %s", sseDelay, uri)
+		if err := sleepContext(s.r.Context(), sseDelay); err != nil {
+			s.err = err
+			return
+		}
+	}
+	if injectRequestFault(s.r, sseDuplicateRate, "sse-duplicate") {
+		log.Warnf("duplicating event: %s", uri)
+		s.pending = append(ev, ev...)
+	}
+}
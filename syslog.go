@@ -0,0 +1,155 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/syslog"
+	"net"
+	"strings"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	syslogTag      = "floki"
+	journaldSocket = "/run/systemd/journal/socket"
+)
+
+// syslogHook sends the entries to a syslog daemon
+type syslogHook struct {
+	w *syslog.Writer
+}
+
+// newSyslogHook connects to the syslog daemon at addr ("udp://host:514",
+// "tcp://host:514"), the local one if addr is empty
+func newSyslogHook(addr string) (log.Hook, error) {
+	network, raddr := "", ""
+	if addr != "" {
+		i := strings.Index(addr, "://")
+		if i < 0 {
+			return nil, fmt.Errorf("bad syslog address %s: expected network://host:port", addr)
+		}
+		network, raddr = addr[:i], addr[i+3:]
+	}
+
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, syslogTag)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to syslog: %w", err)
+	}
+
+	return &syslogHook{w: w}, nil
+}
+
+func (h *syslogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *syslogHook) Fire(e *log.Entry) error {
+	b, err := e.Bytes()
+	if err != nil || len(b) == 0 {
+		// dropped by the sampling
+		return err
+	}
+
+	line := string(bytes.TrimSuffix(b, []byte("\n")))
+	switch e.Level {
+	case log.PanicLevel:
+		return h.w.Emerg(line)
+	case log.FatalLevel:
+		return h.w.Crit(line)
+	case log.ErrorLevel:
+		return h.w.Err(line)
+	case log.WarnLevel:
+		return h.w.Warning(line)
+	case log.InfoLevel:
+		return h.w.Info(line)
+	default:
+		return h.w.Debug(line)
+	}
+}
+
+// journaldHook sends the entries to the systemd journal using its native
+// protocol, the fields of the entry become journal fields
+type journaldHook struct {
+	conn *net.UnixConn
+}
+
+func newJournaldHook() (log.Hook, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the journal: %w", err)
+	}
+
+	return &journaldHook{conn: conn}, nil
+}
+
+func (h *journaldHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *journaldHook) Fire(e *log.Entry) error {
+	if b, err := e.Bytes(); err != nil || len(b) == 0 {
+		return err
+	}
+
+	var msg bytes.Buffer
+	writeJournalField(&msg, "MESSAGE", e.Message)
+	writeJournalField(&msg, "PRIORITY", fmt.Sprint(journalPriority(e.Level)))
+	writeJournalField(&msg, "SYSLOG_IDENTIFIER", syslogTag)
+	for k, v := range e.Data {
+		writeJournalField(&msg, "FLOKI_"+journalFieldName(k), fmt.Sprint(v))
+	}
+
+	_, err := h.conn.Write(msg.Bytes())
+	return err
+}
+
+func journalPriority(lvl log.Level) syslog.Priority {
+	switch lvl {
+	case log.PanicLevel:
+		return syslog.LOG_EMERG
+	case log.FatalLevel:
+		return syslog.LOG_CRIT
+	case log.ErrorLevel:
+		return syslog.LOG_ERR
+	case log.WarnLevel:
+		return syslog.LOG_WARNING
+	case log.InfoLevel:
+		return syslog.LOG_INFO
+	default:
+		return syslog.LOG_DEBUG
+	}
+}
+
+// journalFieldName maps a logrus field to the journal alphabet: upper case
+// letters, digits and underscores
+func journalFieldName(k string) string {
+	return strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, k)
+}
+
+// writeJournalField encodes a field, the values with a newline use the
+// length prefixed form
+func writeJournalField(b *bytes.Buffer, k, v string) {
+	if !strings.Contains(v, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", k, v)
+		return
+	}
+
+	b.WriteString(k + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(v)))
+	b.WriteString(v + "\n")
+}
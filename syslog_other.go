@@ -0,0 +1,22 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func newSyslogHook(addr string) (log.Hook, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+func newJournaldHook() (log.Hook, error) {
+	return nil, errors.New("the systemd journal is not supported on this platform")
+}
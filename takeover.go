@@ -0,0 +1,103 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+)
+
+// takeOver takes over the HTTP/1.x connection of the flow f: the body of r
+// is read directly from the connection and the response is written on it by
+// the returned connWriter, which replaces the writer of f. The returned
+// function closes the connection. A connection already taken over is reused
+func takeOver(f *flow, r *http.Request) (*connWriter, func(), error) {
+	if cw, ok := f.ResponseWriter.(*connWriter); ok {
+		return cw, func() {}, nil
+	}
+
+	conn, brw, err := hijack(f.ResponseWriter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var body io.Reader = io.LimitReader(brw.Reader, r.ContentLength)
+	if len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked" {
+		body = httputil.NewChunkedReader(brw.Reader)
+	}
+	if f.reqBody != nil {
+		body = io.TeeReader(body, f.reqBody)
+	}
+	// closed by the transport once sent, the connection is still needed
+	r.Body = ioutil.NopCloser(body)
+
+	cw := &connWriter{conn: conn, bw: brw.Writer, header: make(http.Header), head: r.Method == http.MethodHead}
+	f.ResponseWriter = cw
+	return cw, func() { conn.Close() }, nil
+}
+
+// connWriter is a ResponseWriter writing an HTTP/1.1 response on a taken
+// over connection, the body is delimited by the closing of the connection.
+// Like the server, it discards the body of the responses to HEAD and of
+// the 204 and 304 responses
+type connWriter struct {
+	conn   net.Conn
+	bw     *bufio.Writer
+	header http.Header
+	head   bool
+	status int
+	noBody bool
+}
+
+func (cw *connWriter) Header() http.Header {
+	return cw.header
+}
+
+// writeInterim sends an informational (1xx) response with the headers h
+func (cw *connWriter) writeInterim(status int, h http.Header) error {
+	fmt.Fprintf(cw.bw, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	h.Write(cw.bw)
+	cw.bw.WriteString("\r\n")
+	return cw.bw.Flush()
+}
+
+func (cw *connWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+	cw.status = status
+	cw.noBody = cw.head || status == http.StatusNoContent || status == http.StatusNotModified
+
+	cw.header.Set("Connection", "close")
+	cw.header.Del("Transfer-Encoding")
+	fmt.Fprintf(cw.bw, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	cw.header.Write(cw.bw)
+	cw.bw.WriteString("\r\n")
+	cw.bw.Flush()
+}
+
+func (cw *connWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.noBody {
+		return len(p), nil
+	}
+
+	n, err := cw.bw.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, cw.bw.Flush()
+}
+
+func (cw *connWriter) Flush() {
+	cw.bw.Flush()
+}
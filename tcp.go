@@ -0,0 +1,160 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"time"
+
+	"github.com/meox/floki-proxy/types"
+	log "github.com/sirupsen/logrus"
+)
+
+var errTCPDisconnect = errors.New("tcp disconnect injected")
+
+// listenTCP starts the TCP proxy p, forwarding the accepted connections to
+// its target with the byte level faults
+func listenTCP(p types.Forward) error {
+	l, err := net.Listen("tcp", bindAddr(p.Port))
+	if err != nil {
+		return err
+	}
+	l = acceptProxyProtocol(l)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Errorf("accepting tcp connection on %d: %v", p.Port, err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			go proxyTCP(conn, p.Target)
+		}
+	}()
+
+	return nil
+}
+
+// proxyTCP forwards conn to target until both the sides close the
+// connection, a side done sending half-closes the other, or a disconnect
+// fault resets both
+func proxyTCP(conn net.Conn, target string) {
+	defer conn.Close()
+
+	up, err := net.DialTimeout("tcp", target, 10*time.Second)
+	if err != nil {
+		log.Errorf("dialing %s: %v", target, err)
+		return
+	}
+	defer up.Close()
+	if upstreamProxyProtocol > 0 {
+		if err := types.WriteProxyHeader(up, upstreamProxyProtocol, conn.RemoteAddr(), conn.LocalAddr()); err != nil {
+			log.Errorf("sending PROXY protocol header to %s: %v", target, err)
+			return
+		}
+	}
+
+	start := time.Now()
+	done := make(chan error, 2)
+	go func() { done <- pipeTCP(up, conn, target) }()
+	go func() { done <- pipeTCP(conn, up, target) }()
+	for i := 0; i < 2; i++ {
+		err := <-done
+		if err == nil {
+			continue
+		}
+		if err == errTCPDisconnect {
+			for _, c := range []net.Conn{conn, up} {
+				if tc, ok := tcpConn(c); ok {
+					tc.SetLinger(0)
+				}
+			}
+		}
+		// the other pipe is stopped too
+		conn.Close()
+		up.Close()
+	}
+
+	log.Infof("tcp connection from %s to %s closed after %s", conn.RemoteAddr(), target, time.Since(start).Round(time.Millisecond))
+}
+
+// tcpChunk is a chunk of data read by pipeTCP, at its arrival time
+type tcpChunk struct {
+	data []byte
+	at   time.Time
+	err  error
+}
+
+// readChunks sends the chunks read from src to chunks, until a read error
+// (sent as the last chunk) or quit is closed
+func readChunks(src net.Conn, chunks chan<- tcpChunk, quit <-chan struct{}) {
+	for {
+		buf := make([]byte, 32*1024)
+		n, err := src.Read(buf)
+		select {
+		case chunks <- tcpChunk{data: buf[:n], at: time.Now(), err: err}:
+		case <-quit:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// pipeTCP copies src to dst, chunk by chunk, delaying, throttling and
+// corrupting the chunks. Every chunk is delayed from its arrival, the
+// reads go on meanwhile, so the delay is a latency and not a throughput
+// cap. At the end of src dst is half-closed and nil returned, it returns
+// errTCPDisconnect if the connection must be reset
+func pipeTCP(dst, src net.Conn, target string) error {
+	var bucket *types.TokenBucket
+	if tcpBandwidth > 0 {
+		bucket = types.NewTokenBucket(tcpBandwidth)
+	}
+
+	chunks := make(chan tcpChunk, 64)
+	quit := make(chan struct{})
+	defer close(quit)
+	go readChunks(src, chunks, quit)
+
+	for c := range chunks {
+		if n := len(c.data); n > 0 {
+			chunk := c.data
+			if tcpDelay > 0 {
+				time.Sleep(time.Until(c.at.Add(tcpDelay)))
+			}
+			if bucket != nil {
+				bucket.Wait(context.Background(), n)
+			}
+			if injectFault(tcpCorruptRate, "tcp-corrupt", target) {
+				i := mathrand.Intn(n)
+				chunk[i] ^= byte(1 + mathrand.Intn(255))
+				log.Warnf("corrupting byte %d of a %d bytes chunk: %s", i, n, target)
+			}
+			if injectFault(tcpDisconnectRate, "tcp-disconnect", target) {
+				log.Warnf("resetting tcp connection: %s", target)
+				return errTCPDisconnect
+			}
+			if _, err := dst.Write(chunk); err != nil {
+				return err
+			}
+		}
+		if c.err == io.EOF {
+			closeWrite(dst)
+			return nil
+		}
+		if c.err != nil {
+			return c.err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/meox/floki-proxy/types"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const defaultTenantName = "default"
+
+type tenantKey struct{}
+
+// tenant is a virtual proxy instance listening on its own port, with its
+// own rules, rewrites and counters. The main listener is the default tenant,
+// configured by the flags
+type tenant struct {
+	name            string
+	addrs           []string
+	ruleSet         *types.RuleSet
+	requestHeaders  types.RewriteRules
+	responseHeaders types.RewriteRules
+	queryRewrites   types.RewriteRules
+	pathRewrites    types.PathRewrites
+	counters        *types.MethodCounters
+	load            *types.LoadMeter
+	// upstream are the targets of the origin-form requests
+	upstream *upstreamPool
+	// hosts are the Host headers selecting a virtual host
+	hosts []string
+}
+
+var (
+	defaultTenant *tenant
+	virtualHosts  []*tenant
+)
+
+// checkTenantPorts validates the ports of the tenants against the other
+// listeners of the process: the proxy addrs, the admin server and the TCP
+// proxies
+func checkTenantPorts(specs types.TenantSpecs, addrs []string) error {
+	used := make(map[int]string)
+	for _, addr := range addrs {
+		_, p, _ := net.SplitHostPort(addr)
+		n, _ := strconv.Atoi(p)
+		used[n] = "the proxy address " + addr
+	}
+	if adminPort != 0 {
+		used[adminPort] = "the admin server"
+	}
+	for _, p := range tcpProxies {
+		used[p.Port] = fmt.Sprintf("the TCP proxy to %s", p.Target)
+	}
+
+	for _, spec := range specs {
+		if what, ok := used[spec.Port]; ok {
+			return fmt.Errorf("bad tenant %s: port %d already used by %s", spec.Name, spec.Port, what)
+		}
+	}
+
+	return nil
+}
+
+// loadTenant builds a tenant whose rules and rewrites come from its rules
+// file
+func loadTenant(spec types.TenantSpec) (*tenant, error) {
+	t := &tenant{
+		name:     spec.Name,
+		addrs:    []string{bindAddr(spec.Port)},
+		counters: types.NewMethodCounters(),
+		load:     types.NewLoadMeter(),
+		upstream: upstream,
+		hosts:    spec.Hosts,
+	}
+	if spec.Upstream != "" {
+		p, err := parseUpstreams(spec.Upstream)
+		if err != nil {
+			return nil, err
+		}
+		t.upstream = p
+	}
+
+	mode := types.ModeFirst
+	var rules []*types.Rule
+	if spec.RulesFile != "" {
+		rf, err := types.LoadRulesFile(spec.RulesFile)
+		if err != nil {
+			return nil, err
+		}
+		if rf.Mode != "" {
+			mode = rf.Mode
+		}
+		rules = rf.Rules
+		auditRules(auditArmed, fmt.Sprintf("rules file %s (tenant %s)", spec.RulesFile, spec.Name), rf.Rules...)
+		t.requestHeaders = rf.RequestHeaders
+		t.responseHeaders = rf.ResponseHeaders
+		t.queryRewrites = rf.Query
+		t.pathRewrites = rf.Paths
+	}
+
+	rs, err := types.NewRuleSet(mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := rs.Add(rules...); err != nil {
+		return nil, err
+	}
+	t.ruleSet = rs
+
+	return t, nil
+}
+
+// virtualHost returns the virtual host serving the requests with the given
+// Host header, nil if there is none. A "*.example.com" host matches all the
+// subdomains
+func virtualHost(host string) *tenant {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	for _, t := range virtualHosts {
+		for _, h := range t.hosts {
+			h = strings.ToLower(h)
+			if h == host || (strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:])) {
+				return t
+			}
+		}
+	}
+
+	return nil
+}
+
+// tenantOf returns the tenant serving the request with context ctx
+func tenantOf(ctx context.Context) *tenant {
+	if t, ok := ctx.Value(tenantKey{}).(*tenant); ok {
+		return t
+	}
+
+	return defaultTenant
+}
+
+func withTenant(ctx context.Context, t *tenant) context.Context {
+	return context.WithValue(ctx, tenantKey{}, t)
+}
+
+// newServer returns the server of the tenant t, with h2c the server also
+// accepts cleartext HTTP/2 (e.g. for gRPC). The server is stopped by the drain
+func newServer(t *tenant, tlsConfig *tls.Config, h2cEnabled bool) *http.Server {
+	var handler http.Handler = http.HandlerFunc(proxyHandler)
+	if h2cEnabled {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+
+	srv := &http.Server{
+		Addr:      t.addrs[0],
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+		BaseContext: func(net.Listener) context.Context {
+			return withTenant(context.Background(), t)
+		},
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return withConnAddrs(withOriginalDst(ctx, conn, t.addrs), conn)
+		},
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			countConn(state)
+			limitClientConns(conn, state)
+		},
+	}
+	trackServer(srv)
+
+	return srv
+}
+
+// serveListener serves srv on l, reading first the PROXY protocol header of
+// the connections with -proxy-protocol
+func serveListener(srv *http.Server, l net.Listener, tlsConfig *tls.Config) error {
+	l = acceptProxyProtocol(l)
+	if tlsConfig == nil {
+		return srv.Serve(l)
+	}
+	return srv.ServeTLS(l, "", "")
+}
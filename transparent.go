@@ -0,0 +1,68 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// transparent modes: the connections are diverted to the proxy by the
+// iptables REDIRECT or TPROXY target
+const (
+	transparentRedirect = "redirect"
+	transparentTProxy   = "tproxy"
+)
+
+var errTransparent = errors.New("transparent mode is only supported on Linux")
+
+type originalDstKey struct{}
+
+// withOriginalDst returns the context of a connection accepted on one of
+// the addrs, in transparent mode it carries the original destination of the
+// connection intercepted by iptables (REDIRECT or TPROXY)
+func withOriginalDst(ctx context.Context, conn net.Conn, addrs []string) context.Context {
+	if transparentMode == "" {
+		return ctx
+	}
+	tc, ok := tcpConn(conn)
+	if !ok {
+		return ctx
+	}
+
+	dst, err := originalDst(tc)
+	if err != nil {
+		return ctx
+	}
+	// not intercepted, the client connected to the proxy
+	_, p, _ := net.SplitHostPort(dst)
+	for _, addr := range addrs {
+		if _, lp, _ := net.SplitHostPort(addr); lp == p {
+			return ctx
+		}
+	}
+
+	return context.WithValue(ctx, originalDstKey{}, dst)
+}
+
+// transparentTarget points an origin-form request intercepted in transparent
+// mode to the host it was sent to, it returns the original destination of
+// the connection, to be dialed in place of the host. It returns an empty
+// string for the other requests
+func transparentTarget(r *http.Request) string {
+	dst, _ := r.Context().Value(originalDstKey{}).(string)
+	if dst == "" || r.URL.Host != "" {
+		return ""
+	}
+
+	r.URL.Scheme = "http"
+	r.URL.Host = r.Host
+	if r.URL.Host == "" {
+		r.URL.Host = dst
+	}
+	return dst
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// transparentSupported report if the transparent mode is available
+const transparentSupported = true
+
+// soOriginalDst is SO_ORIGINAL_DST (and IP6T_SO_ORIGINAL_DST) of netfilter
+const soOriginalDst = 80
+
+// originalDst returns the destination of conn before the REDIRECT of
+// iptables, with TPROXY (no NAT) it is the local address of conn
+func originalDst(conn *net.TCPConn) (string, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	dst := ""
+	var errOpt error
+	err = raw.Control(func(fd uintptr) {
+		if ip4 := conn.LocalAddr().(*net.TCPAddr).IP.To4(); ip4 != nil {
+			// a sockaddr_in fits in an ip_mreq
+			mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+			if err != nil {
+				errOpt = err
+				return
+			}
+			b := mreq.Multiaddr
+			dst = net.JoinHostPort(net.IP(b[4:8]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(b[2:4]))))
+			return
+		}
+
+		// a sockaddr_in6 fits in an ip6_mtuinfo
+		info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst)
+		if err != nil {
+			errOpt = err
+			return
+		}
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))[:]
+		dst = net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	})
+	if err != nil {
+		return "", err
+	}
+	if errOpt != nil {
+		return conn.LocalAddr().String(), nil
+	}
+
+	return dst, nil
+}
+
+// listenTransparent listens on addr with IP_TRANSPARENT, accepting the
+// connections diverted by TPROXY to any address (it requires CAP_NET_ADMIN)
+func listenTransparent(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var errOpt error
+			err := c.Control(func(fd uintptr) {
+				errOpt = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return errOpt
+		},
+	}
+
+	return lc.Listen(context.Background(), "tcp", addr)
+}
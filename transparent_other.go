@@ -0,0 +1,23 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import "net"
+
+// transparentSupported report if the transparent mode is available
+const transparentSupported = false
+
+// originalDst is not supported outside Linux
+func originalDst(conn *net.TCPConn) (string, error) {
+	return "", errTransparent
+}
+
+// listenTransparent is not supported outside Linux
+func listenTransparent(addr string) (net.Listener, error) {
+	return nil, errTransparent
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"strings"
+)
+
+// URLList is a comma separated list of entries in the form "host",
+// "host/path-prefix" or "/path-prefix". An host starting with "." (or "*.")
+// matches all its subdomains
+type URLList []string
+
+func (ul URLList) String() string {
+	return strings.Join(ul, ",")
+}
+
+func (ul *URLList) Set(x string) error {
+	for _, e := range strings.Split(x, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			*ul = append(*ul, e)
+		}
+	}
+
+	return nil
+}
+
+// Match returns the first entry matching host and path
+func (ul URLList) Match(host, path string) (string, bool) {
+	host = strings.ToLower(host)
+	for _, e := range ul {
+		h, p := e, ""
+		if i := strings.IndexByte(e, '/'); i >= 0 {
+			h, p = e[:i], e[i:]
+		}
+
+		if h != "" && !matchHost(strings.ToLower(h), host) {
+			continue
+		}
+		if strings.HasPrefix(path, p) {
+			return e, true
+		}
+	}
+
+	return "", false
+}
+
+func matchHost(pattern, host string) bool {
+	pattern = strings.TrimPrefix(pattern, "*")
+	if strings.HasPrefix(pattern, ".") {
+		return strings.HasSuffix(host, pattern) || host == pattern[1:]
+	}
+
+	return pattern == host
+}
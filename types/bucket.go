@@ -0,0 +1,54 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TokenBucket limits the throughput to rate bytes per second, allowing
+// bursts of up to one second of traffic
+type TokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	m      sync.Mutex
+}
+
+func NewTokenBucket(rate int64) *TokenBucket {
+	return &TokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Wait reserves n bytes blocking until they can be sent or ctx is done
+func (tb *TokenBucket) Wait(ctx context.Context, n int) error {
+	tb.m.Lock()
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.rate {
+		tb.tokens = tb.rate
+	}
+	tb.last = now
+	tb.tokens -= float64(n)
+	deficit := -tb.tokens
+	tb.m.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(time.Duration(deficit / tb.rate * float64(time.Second)))
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"container/list"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CachedResponse is a response stored in the ResponseCache
+type CachedResponse struct {
+	Key        string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Stored     time.Time
+}
+
+// ResponseCache is a LRU cache of responses. The expired entries are not
+// removed until evicted, so they can still be served when requested
+type ResponseCache struct {
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+	m     sync.Mutex
+}
+
+func NewResponseCache(size int, ttl time.Duration) *ResponseCache {
+	return &ResponseCache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the entry stored for key and if it is still fresh
+func (rc *ResponseCache) Get(key string) (*CachedResponse, bool, bool) {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+
+	e, ok := rc.items[key]
+	if !ok {
+		return nil, false, false
+	}
+	rc.ll.MoveToFront(e)
+
+	cr := e.Value.(*CachedResponse)
+	return cr, time.Since(cr.Stored) < rc.ttl, true
+}
+
+// Other returns a random entry stored for a key different from key
+func (rc *ResponseCache) Other(key string) (*CachedResponse, bool) {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+
+	var candidates []*CachedResponse
+	for k, e := range rc.items {
+		if k != key {
+			candidates = append(candidates, e.Value.(*CachedResponse))
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, false
+	}
+
+	return candidates[rand.Intn(len(candidates))], true
+}
+
+// Put stores cr evicting the least recently used entry if the cache is full
+func (rc *ResponseCache) Put(cr *CachedResponse) {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+
+	if e, ok := rc.items[cr.Key]; ok {
+		e.Value = cr
+		rc.ll.MoveToFront(e)
+		return
+	}
+
+	rc.items[cr.Key] = rc.ll.PushFront(cr)
+	if rc.ll.Len() > rc.size {
+		last := rc.ll.Back()
+		rc.ll.Remove(last)
+		delete(rc.items, last.Value.(*CachedResponse).Key)
+	}
+}
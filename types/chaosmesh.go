@@ -0,0 +1,211 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// chaosMeshKind is the kind of the Chaos Mesh manifests injecting HTTP faults
+const chaosMeshKind = "HTTPChaos"
+
+// the subset of an HTTPChaos manifest translated into rules and rewrites
+type chaosManifest struct {
+	Kind     string `yaml:"kind"`
+	Metadata struct {
+		Name string `yaml:"name"`
+	} `yaml:"metadata"`
+	Spec struct {
+		Target          string            `yaml:"target"`
+		Method          string            `yaml:"method"`
+		Path            string            `yaml:"path"`
+		Port            int               `yaml:"port"`
+		Code            *int              `yaml:"code"`
+		RequestHeaders  map[string]string `yaml:"request_headers"`
+		ResponseHeaders map[string]string `yaml:"response_headers"`
+		Abort           bool              `yaml:"abort"`
+		Delay           string            `yaml:"delay"`
+		Replace         *struct {
+			Path    string            `yaml:"path"`
+			Method  string            `yaml:"method"`
+			Code    int               `yaml:"code"`
+			Body    string            `yaml:"body"`
+			Headers map[string]string `yaml:"headers"`
+			Queries map[string]string `yaml:"queries"`
+		} `yaml:"replace"`
+		Patch *struct {
+			Headers [][]string  `yaml:"headers"`
+			Queries [][]string  `yaml:"queries"`
+			Body    interface{} `yaml:"body"`
+		} `yaml:"patch"`
+		Duration string `yaml:"duration"`
+	} `yaml:"spec"`
+}
+
+// isChaosMesh report if raw (JSON or YAML) is a Chaos Mesh HTTPChaos
+// manifest
+func isChaosMesh(raw []byte) bool {
+	var probe struct {
+		Kind string `yaml:"kind"`
+	}
+	return yaml.Unmarshal(raw, &probe) == nil && probe.Kind == chaosMeshKind
+}
+
+// decodeChaosMesh translates one or more HTTPChaos manifests: abort resets
+// the connection (after the upstream response for the Response target),
+// delay adds the latency, replace and patch become header, query and path
+// rewrites. The settings selecting the pods are ignored and
+// the ones without a floki equivalent are rejected
+func decodeChaosMesh(raw []byte, fs *fileSchema) error {
+	// the delays combine with the aborts, as in Chaos Mesh
+	fs.Mode = ModeAll
+
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	for i := 0; ; i++ {
+		var cm chaosManifest
+		err := dec.Decode(&cm)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := cm.Metadata.Name
+		if name == "" {
+			name = fmt.Sprintf("http-chaos-%d", i)
+		}
+		if err := cm.translate(name, fs); err != nil {
+			return fmt.Errorf("%s %s: %w", chaosMeshKind, name, err)
+		}
+	}
+}
+
+// chaosPrefix converts the path of an HTTPChaos, possibly ending with "*",
+// into a path prefix
+func chaosPrefix(path string) (string, error) {
+	prefix := strings.TrimSuffix(path, "*")
+	if strings.Contains(prefix, "*") {
+		return "", fmt.Errorf("path %s: only a trailing wildcard is supported", path)
+	}
+
+	return prefix, nil
+}
+
+func (cm chaosManifest) translate(name string, fs *fileSchema) error {
+	s := cm.Spec
+	if cm.Kind != chaosMeshKind {
+		return fmt.Errorf("unsupported kind %q", cm.Kind)
+	}
+	response := false
+	switch s.Target {
+	case "Request":
+	case "Response":
+		response = true
+	default:
+		return fmt.Errorf("bad target %q, expected Request or Response", s.Target)
+	}
+	if s.Code != nil || len(s.ResponseHeaders) > 0 {
+		return errors.New("matching the response code or headers is not supported")
+	}
+
+	prefix, err := chaosPrefix(s.Path)
+	if err != nil {
+		return err
+	}
+	match := fileMatch{PathPrefix: prefix, Headers: s.RequestHeaders}
+	if s.Method != "" {
+		match.Methods = []string{s.Method}
+	}
+
+	if s.Delay != "" {
+		fs.Rules = append(fs.Rules, fileRule{
+			Name:   name + ":delay",
+			Match:  match,
+			Action: fileAction{Type: ActionDelay, Delay: s.Delay},
+			TTL:    s.Duration,
+		})
+	}
+	if s.Abort {
+		mode := ResetRequest
+		if response {
+			mode = ResetResponse
+		}
+		fs.Rules = append(fs.Rules, fileRule{
+			Name:   name + ":abort",
+			Match:  match,
+			Action: fileAction{Type: ActionReset, Mode: mode},
+			TTL:    s.Duration,
+		})
+	}
+
+	if s.Replace == nil && s.Patch == nil {
+		return nil
+	}
+	// the rewrites only select the requests by path
+	if s.Method != "" || len(s.RequestHeaders) > 0 || s.Duration != "" {
+		return errors.New("replace and patch support only the path match, without a duration")
+	}
+
+	headers := &fs.Rewrites.RequestHeaders
+	if response {
+		headers = &fs.Rewrites.ResponseHeaders
+	}
+	if r := s.Replace; r != nil {
+		switch {
+		case r.Method != "", r.Body != "", r.Code != 0:
+			return errors.New("replacing the method, the body or the code is not supported")
+		case r.Path != "" && response:
+			return errors.New("replacing the path of a response is not possible")
+		}
+		if response && len(r.Queries) > 0 {
+			return errors.New("replacing the queries of a response is not possible")
+		}
+		if r.Path != "" {
+			fs.Rewrites.Paths = append(fs.Rewrites.Paths, fmt.Sprintf("regex:^%s.*=%s", regexp.QuoteMeta(prefix), r.Path))
+		}
+		*headers = append(*headers, chaosRewrites(prefix, OpSet, r.Headers)...)
+		fs.Rewrites.Query = append(fs.Rewrites.Query, chaosRewrites(prefix, OpSet, r.Queries)...)
+	}
+	if p := s.Patch; p != nil {
+		if p.Body != nil {
+			return errors.New("patching the body is not supported")
+		}
+		if response && len(p.Queries) > 0 {
+			return errors.New("patching the queries of a response is not possible")
+		}
+		for _, lists := range []struct {
+			pairs [][]string
+			dst   *[]string
+		}{{p.Headers, headers}, {p.Queries, &fs.Rewrites.Query}} {
+			for _, kv := range lists.pairs {
+				if len(kv) != 2 {
+					return fmt.Errorf("bad patch %q, expected [name, value]", kv)
+				}
+				*lists.dst = append(*lists.dst, fmt.Sprintf("%s:%s:%s=%s", prefix, OpAdd, kv[0], kv[1]))
+			}
+		}
+	}
+
+	return nil
+}
+
+// chaosRewrites returns the rewrite rules applying op to the keys of kv,
+// sorted by name
+func chaosRewrites(prefix, op string, kv map[string]string) []string {
+	var rules []string
+	for k, v := range kv {
+		rules = append(rules, fmt.Sprintf("%s:%s:%s=%s", prefix, op, k, v))
+	}
+	sort.Strings(rules)
+
+	return rules
+}
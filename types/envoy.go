@@ -0,0 +1,269 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envoyFaultType is the type of the Envoy HTTP fault filter configuration
+const envoyFaultType = "type.googleapis.com/envoy.extensions.filters.http.fault.v3.HTTPFault"
+
+// priorityEnvoyRoute is the priority of the faults configured on a route,
+// above the ones of the whole listener
+const priorityEnvoyRoute = 10
+
+// the subset of the HTTPFault message translated into rules
+type envoyFault struct {
+	Abort *struct {
+		HTTPStatus  int           `yaml:"http_status"`
+		GRPCStatus  int           `yaml:"grpc_status"`
+		HeaderAbort interface{}   `yaml:"header_abort"`
+		Percentage  *envoyPercent `yaml:"percentage"`
+	} `yaml:"abort"`
+	Delay *struct {
+		FixedDelay  string        `yaml:"fixed_delay"`
+		HeaderDelay interface{}   `yaml:"header_delay"`
+		Percentage  *envoyPercent `yaml:"percentage"`
+	} `yaml:"delay"`
+	Headers           []envoyHeader `yaml:"headers"`
+	UpstreamCluster   string        `yaml:"upstream_cluster"`
+	DownstreamNodes   []string      `yaml:"downstream_nodes"`
+	MaxActiveFaults   interface{}   `yaml:"max_active_faults"`
+	ResponseRateLimit interface{}   `yaml:"response_rate_limit"`
+}
+
+type envoyPercent struct {
+	Numerator   float64 `yaml:"numerator"`
+	Denominator string  `yaml:"denominator"`
+}
+
+type envoyHeader struct {
+	Name         string `yaml:"name"`
+	ExactMatch   string `yaml:"exact_match"`
+	PresentMatch bool   `yaml:"present_match"`
+	StringMatch  *struct {
+		Exact string `yaml:"exact"`
+	} `yaml:"string_match"`
+	PrefixMatch    string      `yaml:"prefix_match"`
+	SuffixMatch    string      `yaml:"suffix_match"`
+	SafeRegexMatch interface{} `yaml:"safe_regex_match"`
+	InvertMatch    bool        `yaml:"invert_match"`
+}
+
+// percent converts a fractional percent into a percentage, Envoy defaults
+// to 0 when it is missing
+func (p *envoyPercent) percent() (float64, error) {
+	if p == nil {
+		return 0, nil
+	}
+
+	switch p.Denominator {
+	case "", "HUNDRED":
+		return p.Numerator, nil
+	case "TEN_THOUSAND":
+		return p.Numerator / 100, nil
+	case "MILLION":
+		return p.Numerator / 10000, nil
+	}
+	return 0, fmt.Errorf("bad percentage denominator %q", p.Denominator)
+}
+
+// value returns the value of a floki header match, "*" for the presence
+func (h envoyHeader) value() (string, error) {
+	switch {
+	case h.InvertMatch:
+		return "", fmt.Errorf("header %s: inverted matches are not supported", h.Name)
+	case h.ExactMatch != "":
+		return h.ExactMatch, nil
+	case h.StringMatch != nil && h.StringMatch.Exact != "":
+		return h.StringMatch.Exact, nil
+	case h.PresentMatch:
+		return "*", nil
+	}
+	return "", fmt.Errorf("header %s: only the exact and present matches are supported", h.Name)
+}
+
+// envoyImporter collects the rules translated from an Envoy configuration
+type envoyImporter struct {
+	rules    []fileRule
+	warnings []string
+}
+
+// ImportEnvoy translates the HTTP fault filters found in an Envoy
+// configuration (JSON or YAML), either a full bootstrap or a single filter,
+// into a rules file in YAML. The filters of the routes match the prefix (or
+// the path) of the route. The settings without a floki equivalent are
+// skipped and reported in the returned warnings
+func ImportEnvoy(raw []byte) ([]byte, []string, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, nil, fmt.Errorf("decoding the Envoy configuration: %w", err)
+	}
+
+	imp := &envoyImporter{}
+	if m, ok := doc.(map[string]interface{}); ok && m["@type"] == nil && (m["abort"] != nil || m["delay"] != nil) {
+		// a bare HTTPFault message
+		m["@type"] = envoyFaultType
+	}
+	if err := imp.walk(doc, "", ""); err != nil {
+		return nil, nil, err
+	}
+	if len(imp.rules) == 0 {
+		return nil, nil, fmt.Errorf("no %s configuration found", envoyFaultType)
+	}
+
+	// the delays of Envoy combine with the aborts
+	fs := fileSchema{Mode: ModeAll, Rules: imp.rules}
+	if _, err := fs.compile(); err != nil {
+		return nil, nil, fmt.Errorf("translating the Envoy configuration: %w", err)
+	}
+	out, err := yaml.Marshal(fs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, imp.warnings, nil
+}
+
+// walk looks for the fault filters in v, prefix is the path prefix of the
+// enclosing route, if any
+func (imp *envoyImporter) walk(v interface{}, where, prefix string) error {
+	switch x := v.(type) {
+	case []interface{}:
+		for i, e := range x {
+			if err := imp.walk(e, fmt.Sprintf("%s[%d]", where, i), prefix); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		if x["@type"] == envoyFaultType {
+			return imp.translate(x, where, prefix)
+		}
+
+		if m, ok := x["match"].(map[string]interface{}); ok {
+			switch {
+			case m["prefix"] != nil:
+				prefix = fmt.Sprint(m["prefix"])
+			case m["path"] != nil:
+				prefix = fmt.Sprint(m["path"])
+				imp.warnf("%s: the path %s of the route is matched as a prefix", where, prefix)
+			default:
+				imp.warnf("%s: unsupported route match, the faults of the route are skipped", where)
+				return nil
+			}
+		}
+		// sorted, for a stable order of the rules
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := imp.walk(x[k], where+"."+k, prefix); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (imp *envoyImporter) warnf(format string, args ...interface{}) {
+	imp.warnings = append(imp.warnings, fmt.Sprintf(format, args...))
+}
+
+// translate converts a fault filter into at most a delay and an abort rule
+func (imp *envoyImporter) translate(m map[string]interface{}, where, prefix string) error {
+	raw, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	var ef envoyFault
+	if err := yaml.Unmarshal(raw, &ef); err != nil {
+		return fmt.Errorf("%s: %w", where, err)
+	}
+
+	match := fileMatch{PathPrefix: prefix}
+	for _, h := range ef.Headers {
+		v, err := h.value()
+		if err != nil {
+			imp.warnf("%s: %v, the fault is skipped", where, err)
+			return nil
+		}
+		if match.Headers == nil {
+			match.Headers = make(map[string]string)
+		}
+		match.Headers[h.Name] = v
+	}
+	if ef.UpstreamCluster != "" || len(ef.DownstreamNodes) > 0 {
+		imp.warnf("%s: upstream_cluster and downstream_nodes are ignored", where)
+	}
+	if ef.MaxActiveFaults != nil {
+		imp.warnf("%s: max_active_faults is ignored", where)
+	}
+	if ef.ResponseRateLimit != nil {
+		imp.warnf("%s: response_rate_limit is not supported, use -max-throughput", where)
+	}
+
+	name := "envoy"
+	priority := 0
+	if prefix != "" {
+		name += ":" + prefix
+		priority = priorityEnvoyRoute
+	}
+
+	if d := ef.Delay; d != nil {
+		switch {
+		case d.HeaderDelay != nil:
+			imp.warnf("%s: header_delay is not supported", where)
+		case d.FixedDelay == "":
+			imp.warnf("%s: delay without fixed_delay", where)
+		default:
+			if _, err := time.ParseDuration(d.FixedDelay); err != nil {
+				return fmt.Errorf("%s.delay.fixed_delay: %w", where, err)
+			}
+			p, err := d.Percentage.percent()
+			if err != nil {
+				return fmt.Errorf("%s.delay: %w", where, err)
+			}
+			imp.rules = append(imp.rules, fileRule{
+				Name:        name + ":delay",
+				Priority:    priority,
+				Probability: &p,
+				Match:       match,
+				Action:      fileAction{Type: ActionDelay, Delay: d.FixedDelay},
+			})
+		}
+	}
+
+	if a := ef.Abort; a != nil {
+		action := fileAction{Type: ActionAbort, Status: a.HTTPStatus}
+		if a.GRPCStatus != 0 {
+			action = fileAction{Type: ActionGRPCStatus, Status: a.GRPCStatus}
+		}
+		switch {
+		case a.HeaderAbort != nil:
+			imp.warnf("%s: header_abort is not supported", where)
+		case action.Status == 0:
+			imp.warnf("%s: abort without http_status or grpc_status", where)
+		default:
+			p, err := a.Percentage.percent()
+			if err != nil {
+				return fmt.Errorf("%s.abort: %w", where, err)
+			}
+			imp.rules = append(imp.rules, fileRule{
+				Name:        name + ":abort",
+				Priority:    priority,
+				Probability: &p,
+				Match:       match,
+				Action:      action,
+			})
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// eventBatch is the largest batch of messages published at once
+	eventBatch = 500
+	// eventQueue is the number of messages waiting to be published, the
+	// next ones are dropped
+	eventQueue = 8192
+)
+
+// Publisher sends batches of messages to a broker
+type Publisher interface {
+	Publish(msgs [][]byte) error
+	Close() error
+}
+
+// publishers maps the URL schemes to the constructors of their Publisher,
+// the URL path names the subject or the topic
+var publishers = map[string]func(addr, name string) (Publisher, error){
+	"nats":  NewNATSPublisher,
+	"kafka": NewKafkaPublisher,
+}
+
+// EventStream publishes the messages in batches, by a background goroutine,
+// dropping them if the broker cannot keep up. A failed batch is reported to
+// onError and lost, the next one reconnects
+type EventStream struct {
+	newPub  func() (Publisher, error)
+	msgs    chan []byte
+	onError func(error)
+}
+
+// CheckEventStream reports if rawurl is a valid event stream, without
+// connecting to the broker
+func CheckEventStream(rawurl string) error {
+	_, err := parseEventStream(rawurl)
+	return err
+}
+
+// parseEventStream returns the constructor of the Publisher of rawurl
+func parseEventStream(rawurl string) (func() (Publisher, error), error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	newPub, ok := publishers[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("bad event stream %s: unknown scheme, expected nats or kafka", rawurl)
+	}
+	name := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || name == "" {
+		return nil, fmt.Errorf("bad event stream %s: expected %s://host:port/name", rawurl, u.Scheme)
+	}
+
+	return func() (Publisher, error) { return newPub(u.Host, name) }, nil
+}
+
+// NewEventStream returns a stream publishing to the broker of rawurl, in
+// the form nats://host:4222/subject or kafka://host:9092/topic
+func NewEventStream(rawurl string, onError func(error)) (*EventStream, error) {
+	newPub, err := parseEventStream(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	es := &EventStream{
+		newPub:  newPub,
+		msgs:    make(chan []byte, eventQueue),
+		onError: onError,
+	}
+	pub, err := es.newPub()
+	if err != nil {
+		return nil, err
+	}
+	go es.loop(pub, 100*time.Millisecond)
+
+	return es, nil
+}
+
+// Send queues msg, it never blocks
+func (es *EventStream) Send(msg []byte) {
+	select {
+	case es.msgs <- msg:
+	default:
+	}
+}
+
+func (es *EventStream) loop(pub Publisher, interval time.Duration) {
+	var batch [][]byte
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if pub == nil {
+			var err error
+			if pub, err = es.newPub(); err != nil {
+				es.onError(err)
+				batch = batch[:0]
+				return
+			}
+		}
+		if err := pub.Publish(batch); err != nil {
+			es.onError(err)
+			pub.Close()
+			pub = nil
+		}
+		batch = batch[:0]
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-es.msgs:
+			batch = append(batch, msg)
+			if len(batch) >= eventBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
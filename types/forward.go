@@ -0,0 +1,51 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Forward is a TCP or UDP proxy, forwarding the traffic received on Port to
+// Target (host:port)
+type Forward struct {
+	Port   int
+	Target string
+}
+
+// Forwards is a repeatable flag value in the form "5433:db.internal:5432"
+type Forwards []Forward
+
+func (tp Forwards) String() string {
+	var xs []string
+	for _, p := range tp {
+		xs = append(xs, fmt.Sprintf("%d:%s", p.Port, p.Target))
+	}
+
+	return strings.Join(xs, ",")
+}
+
+func (tp *Forwards) Set(x string) error {
+	pair := strings.SplitN(x, ":", 2)
+	if len(pair) != 2 {
+		return fmt.Errorf("decoding forward %s: expected port:host:port", x)
+	}
+	port, err := strconv.Atoi(pair[0])
+	if err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("decoding forward %s: bad port %s", x, pair[0])
+	}
+	if _, _, err := net.SplitHostPort(pair[1]); err != nil {
+		return fmt.Errorf("decoding forward %s: %w", x, err)
+	}
+	for _, p := range *tp {
+		if p.Port == port {
+			return fmt.Errorf("decoding forward %s: duplicated port", x)
+		}
+	}
+
+	*tp = append(*tp, Forward{Port: port, Target: pair[1]})
+	return nil
+}
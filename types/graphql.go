@@ -0,0 +1,378 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// GraphQL operation types
+const (
+	GraphQLQuery        = "query"
+	GraphQLMutation     = "mutation"
+	GraphQLSubscription = "subscription"
+)
+
+// GraphQLOperation is the operation executed by a GraphQL request
+type GraphQLOperation struct {
+	Type string
+	Name string
+	// Fields are the top-level fields selected by the operation, the ones
+	// of the fragments included
+	Fields []GraphQLField
+}
+
+// GraphQLField is a top-level field, Key is its name in the response data
+// (the alias, if any)
+type GraphQLField struct {
+	Name string
+	Key  string
+}
+
+func (op *GraphQLOperation) String() string {
+	if op.Name == "" {
+		return op.Type
+	}
+	return op.Type + " " + op.Name
+}
+
+// Matches report if the operation is selected by x: "mutation CreateOrder",
+// "CreateOrder" or "mutation"
+func (op *GraphQLOperation) Matches(x string) bool {
+	xs := strings.Fields(x)
+	switch {
+	case len(xs) == 2:
+		return xs[0] == op.Type && xs[1] == op.Name
+	case len(xs) == 1 && isGraphQLOperationType(xs[0]):
+		return xs[0] == op.Type
+	case len(xs) == 1:
+		return xs[0] == op.Name
+	}
+
+	return false
+}
+
+// Selects report if the operation selects any of the top-level fields
+func (op *GraphQLOperation) Selects(fields []string) bool {
+	for _, f := range op.Fields {
+		for _, name := range fields {
+			if f.Name == name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+type graphqlKey struct{}
+
+// WithGraphQL returns a copy of ctx carrying the GraphQL operation op
+func WithGraphQL(ctx context.Context, op *GraphQLOperation) context.Context {
+	return context.WithValue(ctx, graphqlKey{}, op)
+}
+
+// GraphQLOf returns the GraphQL operation carried by ctx, nil if there is
+// none
+func GraphQLOf(ctx context.Context) *GraphQLOperation {
+	op, _ := ctx.Value(graphqlKey{}).(*GraphQLOperation)
+	return op
+}
+
+// ParseGraphQLRequest decodes the JSON body of a GraphQL request, the object
+// with the query and the operationName. The batches are not supported
+func ParseGraphQLRequest(body []byte) (*GraphQLOperation, error) {
+	var req struct {
+		Query         string `json:"query"`
+		OperationName string `json:"operationName"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("decoding GraphQL request: %w", err)
+	}
+	if req.Query == "" {
+		return nil, errors.New("decoding GraphQL request: missing query")
+	}
+
+	return ParseGraphQL(req.Query, req.OperationName)
+}
+
+// ParseGraphQL returns the operation of the query document selected by
+// operationName, the first one if empty
+func ParseGraphQL(query, operationName string) (*GraphQLOperation, error) {
+	toks, err := lexGraphQL(query)
+	if err != nil {
+		return nil, fmt.Errorf("parsing GraphQL query: %w", err)
+	}
+
+	d := &graphqlDoc{toks: toks, fragments: make(map[string]int)}
+	type definition struct {
+		op  GraphQLOperation
+		sel int
+	}
+	var ops []definition
+	for i := 0; i < len(toks); {
+		t := toks[i]
+		switch {
+		case t.is("{"):
+			// the query shorthand
+			ops = append(ops, definition{op: GraphQLOperation{Type: GraphQLQuery}, sel: i})
+		case t.kind == tokName && isGraphQLOperationType(t.text):
+			def := definition{op: GraphQLOperation{Type: t.text}}
+			i++
+			if d.tok(i).kind == tokName {
+				def.op.Name = d.tok(i).text
+			}
+			def.sel = d.next(i, "{")
+			ops = append(ops, def)
+			i = def.sel
+		case t.kind == tokName && t.text == "fragment":
+			name := d.tok(i + 1).text
+			i = d.next(i+1, "{")
+			d.fragments[name] = i
+		default:
+			return nil, fmt.Errorf("parsing GraphQL query: unexpected %q", t.text)
+		}
+
+		if i, err = d.skip(i); err != nil {
+			return nil, fmt.Errorf("parsing GraphQL query: %w", err)
+		}
+	}
+
+	for _, def := range ops {
+		if operationName != "" && def.op.Name != operationName {
+			continue
+		}
+		op := def.op
+		if op.Fields, err = d.fields(def.sel, map[string]bool{}); err != nil {
+			return nil, fmt.Errorf("parsing GraphQL query: %w", err)
+		}
+		return &op, nil
+	}
+
+	if operationName != "" {
+		return nil, fmt.Errorf("parsing GraphQL query: unknown operation %s", operationName)
+	}
+	return nil, errors.New("parsing GraphQL query: no operation")
+}
+
+func isGraphQLOperationType(x string) bool {
+	return x == GraphQLQuery || x == GraphQLMutation || x == GraphQLSubscription
+}
+
+// kinds of the GraphQL tokens
+const (
+	tokName = iota
+	tokPunct
+	tokValue
+)
+
+type graphqlToken struct {
+	kind int
+	text string
+}
+
+func (t graphqlToken) is(punct string) bool {
+	return t.kind == tokPunct && t.text == punct
+}
+
+// lexGraphQL splits the query into names, punctuators and values (strings
+// and numbers), the ignored tokens (white spaces, commas and comments) are
+// dropped
+func lexGraphQL(q string) ([]graphqlToken, error) {
+	var toks []graphqlToken
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case strings.HasPrefix(q[i:], "\ufeff"):
+			i += len("\ufeff")
+		case c == '#':
+			for i < len(q) && q[i] != '\n' && q[i] != '\r' {
+				i++
+			}
+		case c == '_' || isLetter(c):
+			j := i + 1
+			for j < len(q) && (q[j] == '_' || isLetter(q[j]) || isDigit(q[j])) {
+				j++
+			}
+			toks = append(toks, graphqlToken{tokName, q[i:j]})
+			i = j
+		case strings.HasPrefix(q[i:], "..."):
+			toks = append(toks, graphqlToken{tokPunct, "..."})
+			i += 3
+		case strings.HasPrefix(q[i:], `"""`):
+			j := i + 3
+			for j < len(q) && !strings.HasPrefix(q[j:], `"""`) {
+				if strings.HasPrefix(q[j:], `\"""`) {
+					j += 4
+					continue
+				}
+				j++
+			}
+			if j >= len(q) {
+				return nil, errors.New("unterminated block string")
+			}
+			toks = append(toks, graphqlToken{tokValue, q[i : j+3]})
+			i = j + 3
+		case c == '"':
+			j := i + 1
+			for j < len(q) && q[j] != '"' {
+				if q[j] == '\n' || q[j] == '\r' {
+					return nil, errors.New("unterminated string")
+				}
+				if q[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(q) {
+				return nil, errors.New("unterminated string")
+			}
+			toks = append(toks, graphqlToken{tokValue, q[i : j+1]})
+			i = j + 1
+		case c == '-' || isDigit(c):
+			j := i + 1
+			for j < len(q) && (isDigit(q[j]) || isLetter(q[j]) || q[j] == '.' || q[j] == '+' || q[j] == '-') {
+				j++
+			}
+			toks = append(toks, graphqlToken{tokValue, q[i:j]})
+			i = j
+		case strings.IndexByte("!$&()[]{}:=@|", c) >= 0:
+			toks = append(toks, graphqlToken{tokPunct, string(c)})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character %q", c)
+		}
+	}
+
+	return toks, nil
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// graphqlDoc walks the tokens of a query document, fragments maps the
+// fragment names to their selection set
+type graphqlDoc struct {
+	toks      []graphqlToken
+	fragments map[string]int
+}
+
+// tok returns the i-th token, an empty one past the end
+func (d *graphqlDoc) tok(i int) graphqlToken {
+	if i >= len(d.toks) {
+		return graphqlToken{kind: tokPunct}
+	}
+	return d.toks[i]
+}
+
+// next returns the position of the first punct from i, skipping the blocks
+// (variables, arguments, default values) on the way
+func (d *graphqlDoc) next(i int, punct string) int {
+	for i < len(d.toks) && !d.toks[i].is(punct) {
+		if d.toks[i].is("(") || d.toks[i].is("[") {
+			j, err := d.skip(i)
+			if err != nil {
+				return len(d.toks)
+			}
+			i = j
+			continue
+		}
+		i++
+	}
+
+	return i
+}
+
+// skip returns the position after the block opened at i, or after the
+// token at i if it does not open a block
+func (d *graphqlDoc) skip(i int) (int, error) {
+	depth := 0
+	for ; i < len(d.toks); i++ {
+		t := d.toks[i]
+		switch {
+		case t.is("{") || t.is("(") || t.is("["):
+			depth++
+		case t.is("}") || t.is(")") || t.is("]"):
+			depth--
+		}
+		if depth <= 0 {
+			return i + 1, nil
+		}
+	}
+
+	return i, errors.New("unbalanced brackets")
+}
+
+// fields returns the fields of the selection set at i, the fragments
+// already included (seen) are not expanded again
+func (d *graphqlDoc) fields(i int, seen map[string]bool) ([]GraphQLField, error) {
+	if !d.tok(i).is("{") {
+		return nil, errors.New("expected a selection set")
+	}
+
+	var fields []GraphQLField
+	for i++; i < len(d.toks) && !d.toks[i].is("}"); {
+		t := d.toks[i]
+		switch {
+		case t.is("..."):
+			i++
+			if n := d.tok(i); n.kind == tokName && n.text != "on" {
+				// a fragment spread
+				i++
+				if sel, ok := d.fragments[n.text]; ok && !seen[n.text] {
+					seen[n.text] = true
+					fs, err := d.fields(sel, seen)
+					if err != nil {
+						return nil, err
+					}
+					fields = append(fields, fs...)
+				}
+				break
+			}
+			// an inline fragment, its fields are expanded in place
+			i = d.next(i, "{")
+			fs, err := d.fields(i, seen)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, fs...)
+		case t.kind == tokName:
+			f := GraphQLField{Name: t.text, Key: t.text}
+			i++
+			if d.tok(i).is(":") {
+				f.Name = d.tok(i + 1).text
+				i += 2
+			}
+			fields = append(fields, f)
+		default:
+			return nil, fmt.Errorf("unexpected %q in selection set", t.text)
+		}
+
+		// the arguments, the directives and the sub-selection
+		for {
+			if n := d.tok(i); n.is("(") || n.is("{") {
+				var err error
+				if i, err = d.skip(i); err != nil {
+					return nil, err
+				}
+			} else if n.is("@") {
+				i += 2
+			} else {
+				break
+			}
+		}
+	}
+
+	return fields, nil
+}
@@ -0,0 +1,228 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// kafkaTimeout bounds the connection and every produce request
+	kafkaTimeout = 5 * time.Second
+	// kafkaClientID identifies the proxy to the broker
+	kafkaClientID = "floki-proxy"
+	// kafkaNotLeader is the error code of a broker not leading the partition
+	kafkaNotLeader = 6
+	// kafkaMaxResponse bounds the size of a produce response, a larger one
+	// is not from a Kafka broker
+	kafkaMaxResponse = 1024 * 1024
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// KafkaPublisher produces the messages on the partition 0 of a Kafka topic,
+// the broker must be its leader: there is no metadata lookup
+type KafkaPublisher struct {
+	conn          net.Conn
+	br            *bufio.Reader
+	topic         string
+	correlationID int32
+}
+
+// NewKafkaPublisher connects to the Kafka broker at addr (host:port)
+func NewKafkaPublisher(addr, topic string) (Publisher, error) {
+	conn, err := net.DialTimeout("tcp", addr, kafkaTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KafkaPublisher{conn: conn, br: bufio.NewReader(conn), topic: topic}, nil
+}
+
+// Publish sends a produce request (v3, acks 1) with the messages in a single
+// record batch and waits for the acknowledgement of the leader
+func (p *KafkaPublisher) Publish(msgs [][]byte) error {
+	p.correlationID++
+	p.conn.SetDeadline(time.Now().Add(kafkaTimeout))
+
+	var req kafkaBuffer
+	req.int16(0) // produce
+	req.int16(3)
+	req.int32(p.correlationID)
+	req.string(kafkaClientID)
+	req.int16(-1) // no transactional id
+	req.int16(1)  // acks
+	req.int32(int32(kafkaTimeout / time.Millisecond))
+	req.int32(1)
+	req.string(p.topic)
+	req.int32(1)
+	req.int32(0) // partition
+	batch := recordBatch(msgs, time.Now())
+	req.int32(int32(len(batch)))
+	req.Write(batch)
+
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(req.Len()))
+	if _, err := p.conn.Write(append(size, req.Bytes()...)); err != nil {
+		return err
+	}
+
+	return p.readResponse()
+}
+
+// readResponse checks the error codes of a produce response
+func (p *KafkaPublisher) readResponse() error {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(p.br, size); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(size)
+	if n > kafkaMaxResponse {
+		return fmt.Errorf("kafka: response of %d bytes, expected at most %d", n, kafkaMaxResponse)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(p.br, body); err != nil {
+		return err
+	}
+
+	resp := kafkaReader{b: body}
+	if id := resp.int32(); id != p.correlationID {
+		return fmt.Errorf("kafka: unexpected correlation id %d, expected %d", id, p.correlationID)
+	}
+	for topics := resp.int32(); topics > 0; topics-- {
+		topic := resp.string()
+		for partitions := resp.int32(); partitions > 0; partitions-- {
+			partition := resp.int32()
+			code := resp.int16()
+			resp.skip(8 + 8) // base offset and log append time
+			switch {
+			case code == kafkaNotLeader:
+				return fmt.Errorf("kafka: the broker is not the leader of %s/%d, use the address of the leader", topic, partition)
+			case code != 0:
+				return fmt.Errorf("kafka: producing to %s/%d: error code %d", topic, partition, code)
+			}
+		}
+	}
+
+	return resp.err
+}
+
+func (p *KafkaPublisher) Close() error {
+	return p.conn.Close()
+}
+
+// recordBatch encodes the messages as a record batch (magic 2), without keys
+// and compression
+func recordBatch(msgs [][]byte, ts time.Time) []byte {
+	millis := ts.UnixNano() / int64(time.Millisecond)
+
+	var records kafkaBuffer
+	for i, m := range msgs {
+		var rec kafkaBuffer
+		rec.WriteByte(0) // attributes
+		rec.varint(0)    // timestamp delta
+		rec.varint(int64(i))
+		rec.varint(-1) // no key
+		rec.varint(int64(len(m)))
+		rec.Write(m)
+		rec.varint(0) // no headers
+		records.varint(int64(rec.Len()))
+		records.Write(rec.Bytes())
+	}
+
+	// the part covered by the crc
+	var tail kafkaBuffer
+	tail.int16(0) // attributes
+	tail.int32(int32(len(msgs) - 1))
+	tail.int64(millis)
+	tail.int64(millis)
+	tail.int64(-1) // producer id
+	tail.int16(-1) // producer epoch
+	tail.int32(-1) // base sequence
+	tail.int32(int32(len(msgs)))
+	tail.Write(records.Bytes())
+
+	var b kafkaBuffer
+	b.int64(0) // base offset
+	b.int32(int32(4 + 1 + 4 + tail.Len()))
+	b.int32(-1) // partition leader epoch
+	b.WriteByte(2)
+	b.int32(int32(crc32.Checksum(tail.Bytes(), castagnoli)))
+	b.Write(tail.Bytes())
+
+	return b.Bytes()
+}
+
+// kafkaBuffer writes the primitive types of the Kafka protocol
+type kafkaBuffer struct {
+	bytes.Buffer
+}
+
+func (b *kafkaBuffer) int16(v int16) {
+	binary.Write(b, binary.BigEndian, v)
+}
+
+func (b *kafkaBuffer) int32(v int32) {
+	binary.Write(b, binary.BigEndian, v)
+}
+
+func (b *kafkaBuffer) int64(v int64) {
+	binary.Write(b, binary.BigEndian, v)
+}
+
+func (b *kafkaBuffer) string(s string) {
+	b.int16(int16(len(s)))
+	b.WriteString(s)
+}
+
+func (b *kafkaBuffer) varint(v int64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	b.Write(buf[:binary.PutVarint(buf, v)])
+}
+
+// kafkaReader reads the primitive types of the Kafka protocol, keeping the
+// first error
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	if len(r.b) < n {
+		r.err = fmt.Errorf("kafka: truncated response")
+		return make([]byte, n)
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *kafkaReader) skip(n int) {
+	r.next(n)
+}
+
+func (r *kafkaReader) int16() int16 {
+	return int16(binary.BigEndian.Uint16(r.next(2)))
+}
+
+func (r *kafkaReader) int32() int32 {
+	return int32(binary.BigEndian.Uint32(r.next(4)))
+}
+
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
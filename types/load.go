@@ -0,0 +1,69 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"sync"
+	"time"
+)
+
+// loadSlots are the slots, of loadSlot each, of the sliding window of the
+// request rate
+const (
+	loadSlots = 10
+	loadSlot  = 100 * time.Millisecond
+)
+
+// Load is the load of a proxy instance when a request arrives
+type Load struct {
+	// InFlight is the number of requests being served, the current one
+	// included
+	InFlight int
+	// RPS is the rate of the requests over the last second
+	RPS float64
+}
+
+// LoadMeter tracks the in-flight requests and the recent request rate
+type LoadMeter struct {
+	inFlight int
+	counts   [loadSlots]int
+	slots    [loadSlots]int64
+	m        sync.Mutex
+}
+
+func NewLoadMeter() *LoadMeter {
+	return &LoadMeter{}
+}
+
+// Start records the arrival of a request and returns the load, Done must
+// be called when the request is over
+func (lm *LoadMeter) Start() Load {
+	lm.m.Lock()
+	defer lm.m.Unlock()
+
+	slot := time.Now().UnixNano() / int64(loadSlot)
+	i := slot % loadSlots
+	if lm.slots[i] != slot {
+		lm.slots[i] = slot
+		lm.counts[i] = 0
+	}
+	lm.counts[i]++
+	lm.inFlight++
+
+	n := 0
+	for j := range lm.counts {
+		if slot-lm.slots[j] < loadSlots {
+			n += lm.counts[j]
+		}
+	}
+
+	return Load{InFlight: lm.inFlight, RPS: float64(n) * float64(time.Second) / float64(loadSlots*loadSlot)}
+}
+
+// Done records the end of a request
+func (lm *LoadMeter) Done() {
+	lm.m.Lock()
+	defer lm.m.Unlock()
+
+	lm.inFlight--
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsTimeout bounds the connection and every batch
+const natsTimeout = 5 * time.Second
+
+// NATSPublisher publishes the messages on a NATS subject with the core
+// protocol, answering the keepalive pings of the server
+type NATSPublisher struct {
+	conn    net.Conn
+	subject string
+	bw      *bufio.Writer
+	// m guards bw, shared with the pong replies
+	m   sync.Mutex
+	err error
+}
+
+// NewNATSPublisher connects to the NATS server at addr (host:port)
+func NewNATSPublisher(addr, subject string) (Publisher, error) {
+	conn, err := net.DialTimeout("tcp", addr, natsTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(natsTimeout))
+	br := bufio.NewReader(conn)
+	info, err := br.ReadString('\n')
+	if err != nil || !strings.HasPrefix(info, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("connecting to NATS %s: expected INFO, got %q (%v)", addr, info, err)
+	}
+	if strings.Contains(info, `"tls_required":true`) {
+		conn.Close()
+		return nil, fmt.Errorf("connecting to NATS %s: TLS is not supported", addr)
+	}
+	conn.SetDeadline(time.Time{})
+
+	p := &NATSPublisher{conn: conn, subject: subject, bw: bufio.NewWriter(conn)}
+	fmt.Fprint(p.bw, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"floki-proxy\"}\r\n")
+	if err := p.bw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go p.read(br)
+
+	return p, nil
+}
+
+// read answers the pings of the server and keeps the last error it reports
+func (p *NATSPublisher) read(br *bufio.Reader) {
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		p.m.Lock()
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			p.bw.WriteString("PONG\r\n")
+			p.bw.Flush()
+		case strings.HasPrefix(line, "-ERR"):
+			p.err = fmt.Errorf("NATS: %s", strings.TrimSpace(line))
+		}
+		p.m.Unlock()
+	}
+}
+
+func (p *NATSPublisher) Publish(msgs [][]byte) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if p.err != nil {
+		return p.err
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(natsTimeout))
+	for _, m := range msgs {
+		fmt.Fprintf(p.bw, "PUB %s %d\r\n", p.subject, len(m))
+		p.bw.Write(m)
+		p.bw.WriteString("\r\n")
+	}
+
+	return p.bw.Flush()
+}
+
+func (p *NATSPublisher) Close() error {
+	return p.conn.Close()
+}
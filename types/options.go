@@ -4,16 +4,35 @@ package types
 
 import (
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
-type FailingPrefixCode map[string]int
+// PrefixFailure is the failure associated to a path prefix. A zero Deadline
+// means that the failure never expires.
+type PrefixFailure struct {
+	Code     int
+	TTL      time.Duration
+	Deadline time.Time
+}
+
+// Active report if the failure is still armed at the given time
+func (pf PrefixFailure) Active(now time.Time) bool {
+	return pf.Deadline.IsZero() || now.Before(pf.Deadline)
+}
+
+type FailingPrefixCode map[string]PrefixFailure
 
 func (fp FailingPrefixCode) String() string {
 	var rs []string
 	for k, v := range fp {
-		rs = append(rs, fmt.Sprintf("%s:%d", k, v))
+		if v.TTL > 0 {
+			rs = append(rs, fmt.Sprintf("%s:%d:%s", k, v.Code, v.TTL))
+			continue
+		}
+		rs = append(rs, fmt.Sprintf("%s:%d", k, v.Code))
 	}
 
 	return strings.Join(rs, ";")
@@ -24,21 +43,150 @@ func (fp *FailingPrefixCode) Set(x string) error {
 		return nil
 	}
 
-	m := make(map[string]int)
+	m := make(map[string]PrefixFailure)
 	tks := strings.Split(x, ";")
 
 	for _, e := range tks {
 		pair := strings.Split(e, ":")
-		if len(pair) != 2 {
+		if len(pair) != 2 && len(pair) != 3 {
 			return fmt.Errorf("decoding %s", x)
 		}
 		code, err := strconv.Atoi(pair[1])
 		if err != nil {
 			return fmt.Errorf("canno convert %s to int: %w", pair[1], err)
 		}
-		m[pair[0]] = code
+
+		pf := PrefixFailure{Code: code}
+		if len(pair) == 3 {
+			ttl, err := time.ParseDuration(pair[2])
+			if err != nil {
+				return fmt.Errorf("cannot convert %s to duration: %w", pair[2], err)
+			}
+			pf.TTL = ttl
+			pf.Deadline = time.Now().Add(ttl)
+		}
+		m[pair[0]] = pf
 	}
 
 	*fp = m
 	return nil
 }
+
+// StringMap is a flag value in the form "key:value;key:value"
+type StringMap map[string]string
+
+func (sm StringMap) String() string {
+	var rs []string
+	for k, v := range sm {
+		rs = append(rs, fmt.Sprintf("%s:%s", k, v))
+	}
+
+	return strings.Join(rs, ";")
+}
+
+func (sm *StringMap) Set(x string) error {
+	if x == "" {
+		return nil
+	}
+
+	m := make(map[string]string)
+	for _, e := range strings.Split(x, ";") {
+		pair := strings.SplitN(e, ":", 2)
+		if len(pair) != 2 {
+			return fmt.Errorf("decoding %s", x)
+		}
+		m[pair[0]] = pair[1]
+	}
+
+	*sm = m
+	return nil
+}
+
+// RateMap is a flag value associating a failure rate to a key, in the form
+// "key:rate,key:rate"
+type RateMap map[string]float64
+
+func (rm RateMap) String() string {
+	var rs []string
+	for k, v := range rm {
+		rs = append(rs, fmt.Sprintf("%s:%g", k, v))
+	}
+
+	return strings.Join(rs, ",")
+}
+
+func (rm *RateMap) Set(x string) error {
+	if x == "" {
+		return nil
+	}
+
+	m := make(map[string]float64)
+	for _, e := range strings.Split(x, ",") {
+		i := strings.LastIndexByte(e, ':')
+		if i < 0 {
+			return fmt.Errorf("decoding %s", x)
+		}
+		rate, err := strconv.ParseFloat(e[i+1:], 64)
+		if err != nil {
+			return fmt.Errorf("cannot convert %s to float: %w", e[i+1:], err)
+		}
+		if rate < 0 || rate > 100 {
+			return fmt.Errorf("bad rate %s: expected a value in the range [0, 100]", e[i+1:])
+		}
+		m[strings.TrimSpace(e[:i])] = rate
+	}
+
+	*rm = m
+	return nil
+}
+
+// ResolveMap is a repeatable flag value sending the connections to a host,
+// or to a host:port, to another address, in the form
+// "api.example.com=10.0.0.7:8443,cdn.example.com:443=10.0.0.8". The port
+// of the connection is kept if the address has none
+type ResolveMap map[string]string
+
+func (rm ResolveMap) String() string {
+	var rs []string
+	for k, v := range rm {
+		rs = append(rs, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	return strings.Join(rs, ",")
+}
+
+func (rm *ResolveMap) Set(x string) error {
+	if *rm == nil {
+		*rm = make(map[string]string)
+	}
+	for _, e := range strings.Split(x, ",") {
+		pair := strings.SplitN(strings.TrimSpace(e), "=", 2)
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			return fmt.Errorf("decoding resolve %s: expected host=address", e)
+		}
+		(*rm)[strings.ToLower(pair[0])] = pair[1]
+	}
+
+	return nil
+}
+
+// Resolve returns the address replacing addr (host:port), if any
+func (rm ResolveMap) Resolve(addr string) (string, bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", false
+	}
+	host = strings.ToLower(host)
+
+	to, ok := rm[net.JoinHostPort(host, port)]
+	if !ok {
+		if to, ok = rm[host]; !ok {
+			return "", false
+		}
+	}
+	if _, _, err := net.SplitHostPort(to); err != nil {
+		to = net.JoinHostPort(to, port)
+	}
+
+	return to, true
+}
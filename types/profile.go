@@ -0,0 +1,79 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// NetworkProfile describes the conditions of a network link: the latency
+// (with a uniformly distributed jitter) added to every request, the
+// percentage of transferred chunks stalling for Stall and the bandwidth
+// (bytes/sec) available to every response
+type NetworkProfile struct {
+	Latency   time.Duration
+	Jitter    time.Duration
+	StallRate float64
+	Stall     time.Duration
+	Bandwidth int64
+}
+
+// NetworkProfiles are the built-in profiles selectable by name
+var NetworkProfiles = map[string]NetworkProfile{
+	"3g": {
+		Latency:   300 * time.Millisecond,
+		Jitter:    100 * time.Millisecond,
+		StallRate: 1,
+		Stall:     time.Second,
+		Bandwidth: 96 * 1024,
+	},
+	"4g": {
+		Latency:   80 * time.Millisecond,
+		Jitter:    30 * time.Millisecond,
+		Bandwidth: 2 * 1024 * 1024,
+	},
+	"satellite": {
+		Latency:   600 * time.Millisecond,
+		Jitter:    50 * time.Millisecond,
+		StallRate: 2,
+		Stall:     2 * time.Second,
+		Bandwidth: 128 * 1024,
+	},
+	"eu-to-ap": {
+		Latency:   250 * time.Millisecond,
+		Jitter:    20 * time.Millisecond,
+		Bandwidth: 1024 * 1024,
+	},
+	"us-to-eu": {
+		Latency:   90 * time.Millisecond,
+		Jitter:    10 * time.Millisecond,
+		Bandwidth: 4 * 1024 * 1024,
+	},
+}
+
+// NetworkProfileNames returns the sorted names of the built-in profiles
+func NetworkProfileNames() []string {
+	var names []string
+	for k := range NetworkProfiles {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Delay returns the latency of a single request, jitter included
+func (np NetworkProfile) Delay() time.Duration {
+	if np.Jitter <= 0 {
+		return np.Latency
+	}
+
+	d := np.Latency + time.Duration(rand.Int63n(int64(2*np.Jitter))) - np.Jitter
+	if d < 0 {
+		return 0
+	}
+
+	return d
+}
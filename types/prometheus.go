@@ -0,0 +1,343 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the latency buckets
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// OpenMetricsType is the content type of the OpenMetrics text format
+const OpenMetricsType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// maxExemplarRunes is the longest label set of an exemplar allowed by
+// OpenMetrics
+const maxExemplarRunes = 128
+
+type metric interface {
+	// write exposes the metric in the Prometheus text format or, with
+	// openMetrics, in the OpenMetrics one
+	write(w io.Writer, openMetrics bool)
+}
+
+// Registry collects the metrics exposed in the Prometheus text format or in
+// the OpenMetrics one
+type Registry struct {
+	metrics []metric
+}
+
+// NewCounter registers a counter with the given label names
+func (reg *Registry) NewCounter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{name: name, help: help, labels: labels},
+		values: make(map[string]*counterValue),
+	}
+	reg.metrics = append(reg.metrics, c)
+
+	return c
+}
+
+// NewHistogram registers an histogram with the given bucket upper bounds
+// and label names
+func (reg *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+	reg.metrics = append(reg.metrics, h)
+
+	return h
+}
+
+// Expose writes all the metrics in the Prometheus text format
+func (reg *Registry) Expose(w io.Writer) {
+	for _, m := range reg.metrics {
+		m.write(w, false)
+	}
+}
+
+// ExposeOpenMetrics writes all the metrics in the OpenMetrics text format,
+// the histograms carry their exemplars
+func (reg *Registry) ExposeOpenMetrics(w io.Writer) {
+	for _, m := range reg.metrics {
+		m.write(w, true)
+	}
+	fmt.Fprint(w, "# EOF\n")
+}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+// header writes the metadata of the metric family, in OpenMetrics the name
+// of a counter family has no _total suffix
+func (d desc) header(w io.Writer, kind string, openMetrics bool) {
+	name := d.name
+	if openMetrics && kind == "counter" {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n", name, d.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// labelPairs formats the labels, extra is appended as it is
+func (d desc) labelPairs(values []string, extra string) string {
+	var xs []string
+	for i, l := range d.labels {
+		xs = append(xs, fmt.Sprintf(`%s="%s"`, l, labelEscaper.Replace(values[i])))
+	}
+	if extra != "" {
+		xs = append(xs, extra)
+	}
+	if len(xs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(xs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func sortedKeys(n int, key func(i int) string) []int {
+	idx := make([]int, n)
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(i, j int) bool { return key(idx[i]) < key(idx[j]) })
+
+	return idx
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	desc
+	m      sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	v      float64
+}
+
+// Add adds v to the counter with the given label values
+func (c *CounterVec) Add(v float64, labels ...string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	k := labelKey(labels)
+	cv, ok := c.values[k]
+	if !ok {
+		cv = &counterValue{labels: labels}
+		c.values[k] = cv
+	}
+	cv.v += v
+}
+
+func (c *CounterVec) write(w io.Writer, openMetrics bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.header(w, "counter", openMetrics)
+	var vs []*counterValue
+	for _, cv := range c.values {
+		vs = append(vs, cv)
+	}
+	for _, i := range sortedKeys(len(vs), func(i int) string { return labelKey(vs[i].labels) }) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(vs[i].labels, ""), formatFloat(vs[i].v))
+	}
+}
+
+// HistogramVec is an histogram partitioned by labels
+type HistogramVec struct {
+	desc
+	buckets []float64
+	m       sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+	// exemplars holds the latest exemplar of every bucket, +Inf included
+	exemplars []*exemplar
+}
+
+// exemplar links an observation to the trace that produced it
+type exemplar struct {
+	traceID string
+	value   float64
+	ts      time.Time
+}
+
+func (e *exemplar) String() string {
+	return fmt.Sprintf(` # {trace_id="%s"} %s %.3f`, labelEscaper.Replace(e.traceID), formatFloat(e.value), float64(e.ts.UnixNano())/1e9)
+}
+
+// Observe adds an observation to the histogram with the given label values
+func (h *HistogramVec) Observe(v float64, labels ...string) {
+	h.ObserveWithExemplar(v, "", labels...)
+}
+
+// ObserveWithExemplar adds an observation to the histogram with the given
+// label values, a non empty traceID becomes the exemplar of the bucket of
+// the observation
+func (h *HistogramVec) ObserveWithExemplar(v float64, traceID string, labels ...string) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	k := labelKey(labels)
+	hv, ok := h.values[k]
+	if !ok {
+		hv = &histogramValue{
+			labels:    labels,
+			counts:    make([]uint64, len(h.buckets)),
+			exemplars: make([]*exemplar, len(h.buckets)+1),
+		}
+		h.values[k] = hv
+	}
+	bucket := len(h.buckets)
+	for i, b := range h.buckets {
+		if v <= b {
+			hv.counts[i]++
+			if i < bucket {
+				bucket = i
+			}
+		}
+	}
+	hv.sum += v
+	hv.count++
+
+	if traceID != "" && utf8.RuneCountInString("trace_id"+traceID) <= maxExemplarRunes {
+		hv.exemplars[bucket] = &exemplar{traceID: traceID, value: v, ts: time.Now()}
+	}
+}
+
+func (h *HistogramVec) write(w io.Writer, openMetrics bool) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	h.header(w, "histogram", openMetrics)
+	var vs []*histogramValue
+	for _, hv := range h.values {
+		vs = append(vs, hv)
+	}
+	for _, i := range sortedKeys(len(vs), func(i int) string { return labelKey(vs[i].labels) }) {
+		hv := vs[i]
+		ex := func(j int) string {
+			if !openMetrics || hv.exemplars[j] == nil {
+				return ""
+			}
+			return hv.exemplars[j].String()
+		}
+		for j, b := range h.buckets {
+			le := fmt.Sprintf("le=%q", formatFloat(b))
+			fmt.Fprintf(w, "%s_bucket%s %d%s\n", h.name, h.labelPairs(hv.labels, le), hv.counts[j], ex(j))
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d%s\n", h.name, h.labelPairs(hv.labels, `le="+Inf"`), hv.count, ex(len(h.buckets)))
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(hv.labels, ""), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(hv.labels, ""), hv.count)
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Buckets is a comma separated, strictly increasing, list of bucket upper
+// bounds
+type Buckets []float64
+
+func (b Buckets) String() string {
+	var xs []string
+	for _, v := range b {
+		xs = append(xs, formatFloat(v))
+	}
+
+	return strings.Join(xs, ",")
+}
+
+func (b *Buckets) Set(x string) error {
+	var bs Buckets
+	for _, e := range strings.Split(x, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(e), 64)
+		if err != nil {
+			return fmt.Errorf("bad bucket %s: %w", e, err)
+		}
+		if len(bs) > 0 && v <= bs[len(bs)-1] {
+			return fmt.Errorf("bad bucket %s: the buckets must be increasing", e)
+		}
+		bs = append(bs, v)
+	}
+
+	*b = bs
+	return nil
+}
+
+// PathTemplates maps the request paths to a bounded set of templates, in
+// the form "/users/:id/orders" where a ":name" segment matches any segment
+// and a trailing "*" matches the rest of the path
+type PathTemplates []string
+
+func (pt PathTemplates) String() string {
+	return strings.Join(pt, ",")
+}
+
+func (pt *PathTemplates) Set(x string) error {
+	for _, e := range strings.Split(x, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			if !strings.HasPrefix(e, "/") {
+				return fmt.Errorf("bad path template %s: expected an absolute path", e)
+			}
+			*pt = append(*pt, e)
+		}
+	}
+
+	return nil
+}
+
+// Match returns the first template matching path, "other" if none does
+func (pt PathTemplates) Match(path string) string {
+	segs := strings.Split(strings.Trim(path, "/"), "/")
+	for _, t := range pt {
+		if matchTemplate(strings.Split(strings.Trim(t, "/"), "/"), segs) {
+			return t
+		}
+	}
+
+	return "other"
+}
+
+func matchTemplate(tmpl, segs []string) bool {
+	for i, t := range tmpl {
+		if t == "*" && i == len(tmpl)-1 {
+			return true
+		}
+		if i >= len(segs) {
+			return false
+		}
+		if !strings.HasPrefix(t, ":") && t != segs[i] {
+			return false
+		}
+	}
+
+	return len(tmpl) == len(segs)
+}
@@ -0,0 +1,187 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// proxyV2Signature starts the binary (v2) PROXY protocol header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// proxyV1MaxLength is the longest v1 header, CRLF included
+	proxyV1MaxLength = 107
+
+	proxyV2Local    = 0x20
+	proxyV2Proxy    = 0x21
+	proxyV2TCP4     = 0x11
+	proxyV2TCP6     = 0x21
+	proxyV2Unspec   = 0x00
+	proxyV2AddrLen4 = 12
+	proxyV2AddrLen6 = 36
+)
+
+var errNoProxyHeader = errors.New("missing PROXY protocol header")
+
+// ReadProxyHeader reads a PROXY protocol header (v1 or v2) from br returning
+// the addresses of the client and of the server it connected to, nil if the
+// header carries none (LOCAL command or UNKNOWN protocol)
+func ReadProxyHeader(br *bufio.Reader) (src, dst net.Addr, err error) {
+	sig, err := br.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(br)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyV1(br)
+	}
+
+	return nil, nil, errNoProxyHeader
+}
+
+// readProxyV1 decodes "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"
+func readProxyV1(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("PROXY v1 header too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("bad PROXY v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	src, err := proxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := proxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return src, dst, nil
+}
+
+func proxyV1Addr(ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, fmt.Errorf("bad PROXY v1 address %q", ip)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return nil, fmt.Errorf("bad PROXY v1 port %q", port)
+	}
+
+	return &net.TCPAddr{IP: addr, Port: p}, nil
+}
+
+// readProxyV2 decodes the binary header, the TLVs are skipped
+func readProxyV2(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	head := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return nil, nil, err
+	}
+	verCmd, family := head[12], head[13]
+	body := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case verCmd == proxyV2Local:
+		return nil, nil, nil
+	case verCmd != proxyV2Proxy:
+		return nil, nil, fmt.Errorf("bad PROXY v2 version and command 0x%02x", verCmd)
+	}
+
+	switch family {
+	case proxyV2TCP4:
+		if len(body) < proxyV2AddrLen4 {
+			return nil, nil, errors.New("truncated PROXY v2 addresses")
+		}
+		src := &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+		dst := &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}
+		return src, dst, nil
+	case proxyV2TCP6:
+		if len(body) < proxyV2AddrLen6 {
+			return nil, nil, errors.New("truncated PROXY v2 addresses")
+		}
+		src := &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+		dst := &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}
+		return src, dst, nil
+	}
+
+	// UDP and unix sockets are not proxied
+	return nil, nil, nil
+}
+
+// WriteProxyHeader writes the PROXY protocol header of the given version (1
+// or 2) announcing a connection from src to dst. If they are not TCP
+// addresses of the same family the header carries no address
+func WriteProxyHeader(w io.Writer, version int, src, dst net.Addr) error {
+	s, _ := src.(*net.TCPAddr)
+	d, _ := dst.(*net.TCPAddr)
+	known := s != nil && d != nil && (s.IP.To4() != nil) == (d.IP.To4() != nil)
+	ipv4 := known && s.IP.To4() != nil
+
+	var b bytes.Buffer
+	switch version {
+	case 1:
+		switch {
+		case !known:
+			b.WriteString("PROXY UNKNOWN\r\n")
+		case ipv4:
+			fmt.Fprintf(&b, "PROXY TCP4 %s %s %d %d\r\n", s.IP, d.IP, s.Port, d.Port)
+		default:
+			fmt.Fprintf(&b, "PROXY TCP6 %s %s %d %d\r\n", s.IP, d.IP, s.Port, d.Port)
+		}
+	case 2:
+		b.Write(proxyV2Signature)
+		switch {
+		case !known:
+			b.Write([]byte{proxyV2Local, proxyV2Unspec, 0, 0})
+		case ipv4:
+			b.Write([]byte{proxyV2Proxy, proxyV2TCP4, 0, proxyV2AddrLen4})
+			b.Write(s.IP.To4())
+			b.Write(d.IP.To4())
+		default:
+			b.Write([]byte{proxyV2Proxy, proxyV2TCP6, 0, proxyV2AddrLen6})
+			b.Write(s.IP.To16())
+			b.Write(d.IP.To16())
+		}
+		if known {
+			binary.Write(&b, binary.BigEndian, uint16(s.Port))
+			binary.Write(&b, binary.BigEndian, uint16(d.Port))
+		}
+	default:
+		return fmt.Errorf("bad PROXY protocol version %d: expected 1 or 2", version)
+	}
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
@@ -0,0 +1,230 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	OpAdd = "add"
+	OpSet = "set"
+	OpDel = "del"
+)
+
+// RewriteRule adds, sets or removes a key (an header or a query parameter)
+// on the requests whose path starts with Prefix
+type RewriteRule struct {
+	Prefix string
+	Op     string
+	Name   string
+	Value  string
+}
+
+func (rr RewriteRule) String() string {
+	if rr.Op == OpDel {
+		return fmt.Sprintf("%s:%s:%s", rr.Prefix, rr.Op, rr.Name)
+	}
+
+	return fmt.Sprintf("%s:%s:%s=%s", rr.Prefix, rr.Op, rr.Name, rr.Value)
+}
+
+// ParseRewriteRule decodes "prefix:op:name[=value]", an empty prefix matches
+// every path
+func ParseRewriteRule(x string) (RewriteRule, error) {
+	tks := strings.SplitN(x, ":", 3)
+	if len(tks) != 3 {
+		return RewriteRule{}, fmt.Errorf("decoding %s: expected prefix:op:name[=value]", x)
+	}
+
+	rr := RewriteRule{Prefix: tks[0], Op: tks[1]}
+	kv := strings.SplitN(tks[2], "=", 2)
+	rr.Name = kv[0]
+	if len(kv) == 2 {
+		rr.Value = kv[1]
+	}
+
+	switch {
+	case rr.Name == "":
+		return RewriteRule{}, fmt.Errorf("decoding %s: missing name", x)
+	case rr.Op == OpDel && len(kv) == 2:
+		return RewriteRule{}, fmt.Errorf("decoding %s: del takes no value", x)
+	case rr.Op != OpAdd && rr.Op != OpSet && rr.Op != OpDel:
+		return RewriteRule{}, fmt.Errorf("decoding %s: bad operation %s, expected add, set or del", x, rr.Op)
+	}
+
+	return rr, nil
+}
+
+// RewriteRules is a repeatable flag value, every occurrence can carry more
+// rules separated by ";"
+type RewriteRules []RewriteRule
+
+func (rs RewriteRules) String() string {
+	var xs []string
+	for _, r := range rs {
+		xs = append(xs, r.String())
+	}
+
+	return strings.Join(xs, ";")
+}
+
+func (rs *RewriteRules) Set(x string) error {
+	for _, e := range strings.Split(x, ";") {
+		if e == "" {
+			continue
+		}
+		rr, err := ParseRewriteRule(e)
+		if err != nil {
+			return err
+		}
+		*rs = append(*rs, rr)
+	}
+
+	return nil
+}
+
+// ApplyHeaders applies, in order, the rules matching path to h returning
+// the number of applied rules
+func (rs RewriteRules) ApplyHeaders(h http.Header, path string) int {
+	n := 0
+	for _, r := range rs {
+		if !strings.HasPrefix(path, r.Prefix) {
+			continue
+		}
+
+		switch r.Op {
+		case OpAdd:
+			h.Add(r.Name, r.Value)
+		case OpSet:
+			h.Set(r.Name, r.Value)
+		case OpDel:
+			h.Del(r.Name)
+		}
+		n++
+	}
+
+	return n
+}
+
+// ApplyQuery applies, in order, the rules matching path to the query
+// parameters q returning the number of applied rules
+func (rs RewriteRules) ApplyQuery(q url.Values, path string) int {
+	n := 0
+	for _, r := range rs {
+		if !strings.HasPrefix(path, r.Prefix) {
+			continue
+		}
+
+		switch r.Op {
+		case OpAdd:
+			q.Add(r.Name, r.Value)
+		case OpSet:
+			q.Set(r.Name, r.Value)
+		case OpDel:
+			q.Del(r.Name)
+		}
+		n++
+	}
+
+	return n
+}
+
+// PathRewrite replaces the path prefix From with To or, when Regexp is set,
+// substitutes all the matches of the regular expression with To
+type PathRewrite struct {
+	From   string
+	To     string
+	Regexp *regexp.Regexp
+}
+
+func (pr PathRewrite) String() string {
+	if pr.Regexp != nil {
+		return fmt.Sprintf("regex:%s=%s", pr.Regexp, pr.To)
+	}
+
+	return fmt.Sprintf("prefix:%s=%s", pr.From, pr.To)
+}
+
+// Apply returns the rewritten path and true if the rule matched
+func (pr PathRewrite) Apply(path string) (string, bool) {
+	if pr.Regexp != nil {
+		if !pr.Regexp.MatchString(path) {
+			return path, false
+		}
+		return pr.Regexp.ReplaceAllString(path, pr.To), true
+	}
+
+	if !strings.HasPrefix(path, pr.From) {
+		return path, false
+	}
+
+	rewritten := pr.To + strings.TrimPrefix(path, pr.From)
+	if !strings.HasPrefix(rewritten, "/") {
+		rewritten = "/" + rewritten
+	}
+
+	return rewritten, true
+}
+
+// PathRewrites is a repeatable flag value in the form "prefix:/from=/to" or
+// "regex:pattern=replacement", every occurrence can carry more rules
+// separated by ";"
+type PathRewrites []PathRewrite
+
+func (ps PathRewrites) String() string {
+	var xs []string
+	for _, p := range ps {
+		xs = append(xs, p.String())
+	}
+
+	return strings.Join(xs, ";")
+}
+
+func (ps *PathRewrites) Set(x string) error {
+	for _, e := range strings.Split(x, ";") {
+		if e == "" {
+			continue
+		}
+
+		kind := strings.SplitN(e, ":", 2)
+		if len(kind) != 2 {
+			return fmt.Errorf("decoding %s: expected prefix:/from=/to or regex:pattern=replacement", e)
+		}
+		pair := strings.SplitN(kind[1], "=", 2)
+		if len(pair) != 2 {
+			return fmt.Errorf("decoding %s: missing replacement", e)
+		}
+
+		switch kind[0] {
+		case "prefix":
+			*ps = append(*ps, PathRewrite{From: pair[0], To: pair[1]})
+		case "regex":
+			re, err := regexp.Compile(pair[0])
+			if err != nil {
+				return fmt.Errorf("decoding %s: %w", e, err)
+			}
+			*ps = append(*ps, PathRewrite{Regexp: re, To: pair[1]})
+		default:
+			return fmt.Errorf("decoding %s: bad kind %s, expected prefix or regex", e, kind[0])
+		}
+	}
+
+	return nil
+}
+
+// Apply applies, in order, all the rules to path
+func (ps PathRewrites) Apply(path string) (string, bool) {
+	rewritten := false
+	for _, p := range ps {
+		var ok bool
+		path, ok = p.Apply(path)
+		rewritten = rewritten || ok
+	}
+
+	return path, rewritten
+}
@@ -0,0 +1,126 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// RouteSpec sends the requests carrying Header (or Cookie) to Upstream. An
+// empty or "*" value only requires the header (or the cookie) to be present
+type RouteSpec struct {
+	Name        string
+	Header      string
+	HeaderValue string
+	Cookie      string
+	CookieValue string
+	Upstream    string
+}
+
+// Matches report if the request r carries the header or the cookie of the
+// route
+func (rs RouteSpec) Matches(r *http.Request) bool {
+	if rs.Header != "" {
+		got := r.Header.Get(rs.Header)
+		if got == "" || (rs.HeaderValue != "" && rs.HeaderValue != "*" && !strings.EqualFold(got, rs.HeaderValue)) {
+			return false
+		}
+	}
+	if rs.Cookie != "" {
+		c, err := r.Cookie(rs.Cookie)
+		if err != nil || (rs.CookieValue != "" && rs.CookieValue != "*" && c.Value != rs.CookieValue) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// criterion returns the printable header or cookie of the route
+func (rs RouteSpec) criterion() string {
+	var xs []string
+	if rs.Header != "" {
+		xs = append(xs, fmt.Sprintf("header %s:%s", rs.Header, rs.HeaderValue))
+	}
+	if rs.Cookie != "" {
+		xs = append(xs, fmt.Sprintf("cookie %s=%s", rs.Cookie, rs.CookieValue))
+	}
+
+	return strings.Join(xs, " and ")
+}
+
+func (rs RouteSpec) String() string {
+	return fmt.Sprintf("%s(%s to %s)", rs.Name, rs.criterion(), rs.Upstream)
+}
+
+// parseRouteSpec decodes the "key=value,key=value" form of -route. The keys
+// are name, header (name:value), cookie (name=value) and upstream, the
+// upstream URLs are separated by "|"
+func parseRouteSpec(x string) (RouteSpec, error) {
+	var rs RouteSpec
+	for _, e := range strings.Split(x, ",") {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 {
+			return rs, fmt.Errorf("decoding %s: expected key=value, got %s", x, e)
+		}
+
+		k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch k {
+		case "name":
+			rs.Name = v
+		case "header":
+			hv := strings.SplitN(v, ":", 2)
+			rs.Header = strings.TrimSpace(hv[0])
+			if len(hv) == 2 {
+				rs.HeaderValue = strings.TrimSpace(hv[1])
+			}
+		case "cookie":
+			cv := strings.SplitN(v, "=", 2)
+			rs.Cookie = strings.TrimSpace(cv[0])
+			if len(cv) == 2 {
+				rs.CookieValue = strings.TrimSpace(cv[1])
+			}
+		case "upstream":
+			rs.Upstream = v
+		default:
+			return rs, fmt.Errorf("decoding %s: unknown key %s", x, k)
+		}
+	}
+
+	return rs, nil
+}
+
+// RouteSpecs is a repeatable flag value in the form
+// "name=qa,header=X-Canary:true,upstream=http://qa.internal", the routes are
+// checked in order
+type RouteSpecs []RouteSpec
+
+func (rs RouteSpecs) String() string {
+	var xs []string
+	for _, r := range rs {
+		xs = append(xs, r.String())
+	}
+
+	return strings.Join(xs, ";")
+}
+
+func (rs *RouteSpecs) Set(x string) error {
+	r, err := parseRouteSpec(x)
+	if err != nil {
+		return fmt.Errorf("route: %w", err)
+	}
+	if r.Header == "" && r.Cookie == "" {
+		return fmt.Errorf("decoding route %s: header or cookie is required", x)
+	}
+	if r.Upstream == "" {
+		return fmt.Errorf("decoding route %s: upstream is required", x)
+	}
+	if r.Name == "" {
+		r.Name = r.criterion()
+	}
+
+	*rs = append(*rs, r)
+	return nil
+}
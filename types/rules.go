@@ -0,0 +1,664 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Rule actions
+const (
+	ActionAbort       = "abort"
+	ActionDelay       = "delay"
+	ActionRedirect    = "redirect"
+	ActionHang        = "hang"
+	ActionWrongLength = "wrong-length"
+	ActionBadChunked  = "bad-chunked"
+	ActionGarbage     = "garbage"
+	ActionGRPCStatus  = "grpc-status"
+	ActionGRPCCut     = "grpc-cut"
+	ActionHold        = "hold"
+	ActionReset       = "reset"
+	ActionHTTP10      = "http10"
+	ActionProtocolErr = "protocol-error"
+	ActionTimeout     = "timeout"
+	ActionOverride    = "override"
+	ActionGraphQLPart = "graphql-partial"
+)
+
+// Modes of the reset action: the connection is closed before contacting
+// the upstream (the default) or once its response arrives
+const (
+	ResetRequest  = "request"
+	ResetResponse = "response"
+)
+
+// Modes of the protocol-error action: the protocol version of the status
+// line is invalid, the status code is not a number or a header has illegal
+// bytes
+const (
+	ProtocolErrorStatusLine = "status-line"
+	ProtocolErrorStatusCode = "status-code"
+	ProtocolErrorHeader     = "header"
+)
+
+// Evaluation modes of a RuleSet
+const (
+	// ModeFirst stops at the first triggered rule
+	ModeFirst = "first"
+	// ModeAll accumulates the triggered rules until a terminal one
+	ModeAll = "all"
+)
+
+// Match selects the requests a Rule applies to, an empty field matches
+// every request
+type Match struct {
+	Methods    []string
+	Hosts      []string
+	PathPrefix string
+	// Headers maps an header name to its expected value, "*" only
+	// requires the header to be present
+	Headers map[string]string
+	// MinInFlight and MinRPS, when positive, select the requests arriving
+	// with at least the given in-flight requests or requests per second
+	MinInFlight int
+	MinRPS      float64
+	// GraphQLOperations ("mutation CreateOrder", "CreateOrder" or
+	// "mutation") and GraphQLFields (top-level fields) select the GraphQL
+	// requests, see GraphQLOf
+	GraphQLOperations []string
+	GraphQLFields     []string
+}
+
+// InspectsGraphQL report if the match needs the GraphQL operation of the
+// requests
+func (m Match) InspectsGraphQL() bool {
+	return len(m.GraphQLOperations) > 0 || len(m.GraphQLFields) > 0
+}
+
+// Loaded report if the load reaches the thresholds of the match
+func (m Match) Loaded(load Load) bool {
+	if m.MinInFlight > 0 && load.InFlight < m.MinInFlight {
+		return false
+	}
+
+	return m.MinRPS <= 0 || load.RPS >= m.MinRPS
+}
+
+// Matches report if the request r, directed to host (with or without the
+// port) and path, is selected
+func (m Match) Matches(r *http.Request, host, path string) bool {
+	if len(m.Methods) > 0 && !containsFold(m.Methods, r.Method) {
+		return false
+	}
+	if len(m.Hosts) > 0 {
+		host = strings.ToLower(host)
+		hostname := host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			hostname = h
+		}
+
+		found := false
+		for _, h := range m.Hosts {
+			h = strings.ToLower(h)
+			if matchHost(h, host) || matchHost(h, hostname) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !strings.HasPrefix(path, m.PathPrefix) {
+		return false
+	}
+	for k, v := range m.Headers {
+		got := r.Header.Get(k)
+		if got == "" || (v != "*" && got != v) {
+			return false
+		}
+	}
+	if m.InspectsGraphQL() {
+		op := GraphQLOf(r.Context())
+		if op == nil || (len(m.GraphQLFields) > 0 && !op.Selects(m.GraphQLFields)) {
+			return false
+		}
+		if len(m.GraphQLOperations) > 0 && !matchesAny(op, m.GraphQLOperations) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchesAny(op *GraphQLOperation, xs []string) bool {
+	for _, x := range xs {
+		if op.Matches(x) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Action is what a triggered Rule does to the request
+type Action struct {
+	Type string
+	// Status is the status code of abort and redirect and the gRPC status
+	// code of grpc-status and grpc-cut (status mode)
+	Status int
+	// Message is the grpc-message of grpc-status and grpc-cut
+	Message string
+	// Delay is the latency added by delay, the time hold keeps the
+	// upstream response before sending it and the upstream timeout of
+	// timeout
+	Delay time.Duration
+	// Mode is the variant of hang (headers, body), bad-chunked (size,
+	// unterminated), grpc-cut (reset, status) and reset (request, response)
+	Mode string
+	// Bytes is the Content-Length delta of wrong-length and the number of
+	// random bytes of garbage
+	Bytes int
+	// Depth is the length of a redirect chain, Loop makes it endless
+	Depth int
+	Loop  bool
+	// Messages and After cut the stream of grpc-cut after the given number
+	// of response messages or time, whichever comes first
+	Messages int
+	After    time.Duration
+	// Timeout, Retries and Buffer of override replace, when set, the
+	// upstream timeout, the number of retries and the size of the buffer
+	// the response body is copied with
+	Timeout time.Duration
+	Retries *int
+	Buffer  int
+	// Fields are the top-level fields graphql-partial sets to null, with
+	// Message as the error
+	Fields []string
+}
+
+func (a Action) String() string {
+	switch a.Type {
+	case ActionAbort:
+		return fmt.Sprintf("%s %d", a.Type, a.Status)
+	case ActionDelay, ActionHold, ActionTimeout:
+		return fmt.Sprintf("%s %s", a.Type, a.Delay)
+	case ActionRedirect:
+		if a.Loop {
+			return fmt.Sprintf("%s %d (loop)", a.Type, a.Status)
+		}
+		return fmt.Sprintf("%s %d (depth %d)", a.Type, a.Status, a.Depth)
+	case ActionHang, ActionBadChunked, ActionProtocolErr:
+		return fmt.Sprintf("%s %s", a.Type, a.Mode)
+	case ActionWrongLength:
+		return fmt.Sprintf("%s %+d", a.Type, a.Bytes)
+	case ActionGarbage:
+		return fmt.Sprintf("%s %d bytes", a.Type, a.Bytes)
+	case ActionGRPCStatus:
+		return fmt.Sprintf("%s %d", a.Type, a.Status)
+	case ActionGRPCCut:
+		var when []string
+		if a.Messages > 0 {
+			when = append(when, fmt.Sprintf("%d messages", a.Messages))
+		}
+		if a.After > 0 {
+			when = append(when, a.After.String())
+		}
+		return fmt.Sprintf("%s %s after %s", a.Type, a.Mode, strings.Join(when, " or "))
+	case ActionOverride:
+		var set []string
+		if a.Timeout > 0 {
+			set = append(set, "timeout "+a.Timeout.String())
+		}
+		if a.Retries != nil {
+			set = append(set, fmt.Sprintf("retries %d", *a.Retries))
+		}
+		if a.Buffer > 0 {
+			set = append(set, fmt.Sprintf("buffer %d", a.Buffer))
+		}
+		return fmt.Sprintf("%s %s", a.Type, strings.Join(set, ", "))
+	case ActionGraphQLPart:
+		if len(a.Fields) > 0 {
+			return fmt.Sprintf("%s %s", a.Type, strings.Join(a.Fields, ","))
+		}
+	}
+
+	return a.Type
+}
+
+// Terminal report if no other rule can be applied after the action
+func (a Action) Terminal() bool {
+	return a.Type != ActionDelay && !a.Setting()
+}
+
+// Setting report if the action changes the handling of the request (timeout
+// and override) rather than injecting a fault, see RuleSet.Settings
+func (a Action) Setting() bool {
+	return a.Type == ActionTimeout || a.Type == ActionOverride
+}
+
+// Rule injects Action on Probability percent of the requests selected by
+// Match or, with ScopeClients (ScopeResources), on all the requests of
+// Probability percent of the clients identified by ClientKey (of the
+// paths). The rules are evaluated by decreasing Priority, a zero Deadline
+// means the rule never expires. With Windows the rule is armed only during
+// any of them
+type Rule struct {
+	// adjustedBits holds the probability set at runtime in place of
+	// Probability, flagged by adjusted. It is accessed atomically and comes
+	// first to be 64-bit aligned on the 32-bit platforms
+	adjustedBits uint64
+
+	Name        string
+	Priority    int
+	Probability float64
+	Scope       string
+	ClientKey   string
+	Match       Match
+	Action      Action
+	Deadline    time.Time
+	Windows     []TimeWindow
+	// disabled is set atomically, the rules can be toggled at runtime
+	disabled int32
+	adjusted int32
+}
+
+// Active report if the rule is enabled and armed at the given time
+func (r *Rule) Active(now time.Time) bool {
+	if !r.Enabled() || (!r.Deadline.IsZero() && !now.Before(r.Deadline)) {
+		return false
+	}
+	if len(r.Windows) == 0 {
+		return true
+	}
+
+	for _, w := range r.Windows {
+		if w.Contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Enabled report if the rule has not been switched off
+func (r *Rule) Enabled() bool {
+	return atomic.LoadInt32(&r.disabled) == 0
+}
+
+// CurrentProbability returns the probability of the rule, as adjusted at
+// runtime if it was
+func (r *Rule) CurrentProbability() float64 {
+	if atomic.LoadInt32(&r.adjusted) == 0 {
+		return r.Probability
+	}
+
+	return math.Float64frombits(atomic.LoadUint64(&r.adjustedBits))
+}
+
+// AdjustProbability replaces at runtime the probability of the rule
+func (r *Rule) AdjustProbability(p float64) {
+	atomic.StoreUint64(&r.adjustedBits, math.Float64bits(p))
+	atomic.StoreInt32(&r.adjusted, 1)
+}
+
+// SetEnabled switches the rule on or off
+func (r *Rule) SetEnabled(enabled bool) {
+	var v int32
+	if !enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&r.disabled, v)
+}
+
+func (r *Rule) String() string {
+	if r.Scope != "" && r.Scope != ScopeRequests {
+		return fmt.Sprintf("%s(%s %g%% of %s)", r.Name, r.Action.Type, r.CurrentProbability(), r.Scope)
+	}
+	return fmt.Sprintf("%s(%s %g%%)", r.Name, r.Action.Type, r.CurrentProbability())
+}
+
+// triggered report if the rule fires for the request req of path. roll
+// decides, given a probability, for the requests scope; the other scopes
+// pick always the same share of the clients or of the paths, still rolling
+// a 100% chance so that the global conditions (e.g. the failure TTL) apply
+func (r *Rule) triggered(req *http.Request, path string, roll func(float64) bool) bool {
+	p := r.CurrentProbability()
+	switch r.Scope {
+	case ScopeClients:
+		key := r.ClientKey
+		if key == "" {
+			key = DefaultClientKey
+		}
+		// the rule name spreads the rules on different clients
+		return p > 0 && percentile(r.Name+"\x00"+ClientIdentity(req, key)) < p && roll(100)
+	case ScopeResources:
+		return p > 0 && percentile(r.Name+"\x00"+path) < p && roll(100)
+	}
+
+	return roll(p)
+}
+
+// Validate checks the consistency of the rule
+func (r *Rule) Validate() error {
+	if r.Probability < 0 || r.Probability > 100 {
+		return fmt.Errorf("rule %s: bad probability %g, expected a value in the range [0, 100]", r.Name, r.Probability)
+	}
+	switch r.Scope {
+	case "", ScopeRequests, ScopeClients, ScopeResources:
+	default:
+		return fmt.Errorf("rule %s: bad scope %q, expected requests, clients or resources", r.Name, r.Scope)
+	}
+	if r.ClientKey != "" {
+		if err := CheckClientKey(r.ClientKey); err != nil {
+			return fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+	}
+	if r.Match.MinInFlight < 0 || r.Match.MinRPS < 0 {
+		return fmt.Errorf("rule %s: load thresholds must not be negative", r.Name)
+	}
+
+	a := r.Action
+	switch a.Type {
+	case ActionAbort:
+		if a.Status < 100 || a.Status > 599 {
+			return fmt.Errorf("rule %s: bad abort status %d", r.Name, a.Status)
+		}
+	case ActionRedirect:
+		if a.Status < 300 || a.Status > 399 {
+			return fmt.Errorf("rule %s: bad redirect status %d, expected a 3xx status", r.Name, a.Status)
+		}
+		if a.Depth <= 0 && !a.Loop {
+			return fmt.Errorf("rule %s: redirect depth must be positive", r.Name)
+		}
+	case ActionDelay, ActionHold, ActionTimeout:
+		if a.Delay <= 0 {
+			return fmt.Errorf("rule %s: %s delay must be positive", r.Name, a.Type)
+		}
+	case ActionHang:
+		if a.Mode != "headers" && a.Mode != "body" {
+			return fmt.Errorf("rule %s: bad hang mode %q, expected headers or body", r.Name, a.Mode)
+		}
+	case ActionBadChunked:
+		if a.Mode != "size" && a.Mode != "unterminated" {
+			return fmt.Errorf("rule %s: bad chunked mode %q, expected size or unterminated", r.Name, a.Mode)
+		}
+	case ActionProtocolErr:
+		if a.Mode != ProtocolErrorStatusLine && a.Mode != ProtocolErrorStatusCode && a.Mode != ProtocolErrorHeader {
+			return fmt.Errorf("rule %s: bad protocol error mode %q, expected status-line, status-code or header", r.Name, a.Mode)
+		}
+	case ActionGarbage:
+		if a.Bytes <= 0 {
+			return fmt.Errorf("rule %s: garbage bytes must be positive", r.Name)
+		}
+	case ActionGRPCStatus:
+		if a.Status < 1 || a.Status > 16 {
+			return fmt.Errorf("rule %s: bad gRPC status %d, expected a code in the range [1, 16]", r.Name, a.Status)
+		}
+	case ActionGRPCCut:
+		if a.Messages <= 0 && a.After <= 0 {
+			return fmt.Errorf("rule %s: grpc-cut requires a positive number of messages or time", r.Name)
+		}
+		switch a.Mode {
+		case "reset":
+		case "status":
+			if a.Status < 1 || a.Status > 16 {
+				return fmt.Errorf("rule %s: bad gRPC status %d, expected a code in the range [1, 16]", r.Name, a.Status)
+			}
+		default:
+			return fmt.Errorf("rule %s: bad grpc-cut mode %q, expected reset or status", r.Name, a.Mode)
+		}
+	case ActionReset:
+		if a.Mode != "" && a.Mode != ResetRequest && a.Mode != ResetResponse {
+			return fmt.Errorf("rule %s: bad reset mode %q, expected request or response", r.Name, a.Mode)
+		}
+	case ActionOverride:
+		if a.Timeout < 0 || a.Buffer < 0 || (a.Retries != nil && *a.Retries < 0) {
+			return fmt.Errorf("rule %s: override timeout, retries and buffer must not be negative", r.Name)
+		}
+		if a.Timeout == 0 && a.Retries == nil && a.Buffer == 0 {
+			return fmt.Errorf("rule %s: override requires a timeout, retries or buffer", r.Name)
+		}
+	case ActionWrongLength, ActionHTTP10, ActionGraphQLPart:
+	default:
+		return fmt.Errorf("rule %s: unknown action %q", r.Name, a.Type)
+	}
+
+	return nil
+}
+
+// RuleSet is an ordered collection of rules
+type RuleSet struct {
+	Mode  string
+	rules []*Rule
+}
+
+func NewRuleSet(mode string) (*RuleSet, error) {
+	if mode != ModeFirst && mode != ModeAll {
+		return nil, fmt.Errorf("bad rules mode %q: expected first or all", mode)
+	}
+
+	return &RuleSet{Mode: mode}, nil
+}
+
+// Add validates and inserts the rules keeping the evaluation order: by
+// decreasing priority and, with the same priority, by insertion
+func (rs *RuleSet) Add(rules ...*Rule) error {
+	for _, r := range rules {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+	}
+
+	rs.rules = append(rs.rules, rules...)
+	sort.SliceStable(rs.rules, func(i, j int) bool {
+		return rs.rules[i].Priority > rs.rules[j].Priority
+	})
+
+	return nil
+}
+
+// Rules returns the rules in evaluation order
+func (rs *RuleSet) Rules() []*Rule {
+	return rs.rules
+}
+
+// InspectsGraphQL report if any rule needs the GraphQL operation of the
+// requests
+func (rs *RuleSet) InspectsGraphQL() bool {
+	for _, r := range rs.rules {
+		if r.Match.InspectsGraphQL() || r.Action.Type == ActionGraphQLPart {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Evaluate returns the rules triggered by the request r, directed to host
+// and path, arrived with the given load. roll decides, given a probability,
+// if a matching rule triggers (see triggered). With ModeFirst at most one
+// rule is returned, with ModeAll the triggered rules are accumulated until
+// the first terminal action. The settings are left to Settings
+func (rs *RuleSet) Evaluate(r *http.Request, host, path string, load Load, roll func(float64) bool) []*Rule {
+	var fired []*Rule
+
+	now := time.Now()
+	for _, rule := range rs.rules {
+		if rule.Action.Setting() || !rule.Active(now) || !rule.Match.Matches(r, host, path) || !rule.Match.Loaded(load) || !rule.triggered(r, path, roll) {
+			continue
+		}
+
+		fired = append(fired, rule)
+		if rs.Mode == ModeFirst || rule.Action.Terminal() {
+			break
+		}
+	}
+
+	return fired
+}
+
+// Settings returns all the setting rules (timeout and override) triggered
+// by the request r, in evaluation order, whatever the mode: they are not
+// faults and never stop the evaluation of the other rules
+func (rs *RuleSet) Settings(r *http.Request, host, path string, load Load, roll func(float64) bool) []*Rule {
+	var fired []*Rule
+
+	now := time.Now()
+	for _, rule := range rs.rules {
+		if rule.Action.Setting() && rule.Active(now) && rule.Match.Matches(r, host, path) && rule.Match.Loaded(load) && rule.triggered(r, path, roll) {
+			fired = append(fired, rule)
+		}
+	}
+
+	return fired
+}
+
+// ParseRule decodes a rule in the form "key=value,key=value". The keys are
+// name, priority, probability, scope (requests, clients or resources),
+// client-key, method (repeatable, separated by "|"), host (same), prefix,
+// header (name:value), min-inflight, min-rps, graphql-operation (same),
+// graphql-field (same), action, status, message, delay, mode, bytes, depth,
+// loop, messages, after, timeout, retries, buffer, fields (same), ttl and
+// window (same)
+func ParseRule(x string) (*Rule, error) {
+	r := &Rule{Probability: 100}
+	for _, e := range strings.Split(x, ",") {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("decoding rule %s: expected key=value, got %s", x, e)
+		}
+
+		k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		var err error
+		switch k {
+		case "name":
+			r.Name = v
+		case "priority":
+			r.Priority, err = strconv.Atoi(v)
+		case "probability":
+			r.Probability, err = strconv.ParseFloat(v, 64)
+		case "scope":
+			r.Scope = v
+		case "client-key":
+			r.ClientKey = v
+		case "method":
+			r.Match.Methods = append(r.Match.Methods, strings.Split(v, "|")...)
+		case "host":
+			r.Match.Hosts = append(r.Match.Hosts, strings.Split(v, "|")...)
+		case "prefix":
+			r.Match.PathPrefix = v
+		case "header":
+			hv := strings.SplitN(v, ":", 2)
+			if len(hv) != 2 {
+				return nil, fmt.Errorf("decoding rule %s: expected header=name:value", x)
+			}
+			if r.Match.Headers == nil {
+				r.Match.Headers = make(map[string]string)
+			}
+			r.Match.Headers[hv[0]] = hv[1]
+		case "min-inflight":
+			r.Match.MinInFlight, err = strconv.Atoi(v)
+		case "min-rps":
+			r.Match.MinRPS, err = strconv.ParseFloat(v, 64)
+		case "graphql-operation":
+			r.Match.GraphQLOperations = append(r.Match.GraphQLOperations, strings.Split(v, "|")...)
+		case "graphql-field":
+			r.Match.GraphQLFields = append(r.Match.GraphQLFields, strings.Split(v, "|")...)
+		case "action":
+			r.Action.Type = v
+		case "status":
+			r.Action.Status, err = strconv.Atoi(v)
+		case "message":
+			r.Action.Message = v
+		case "delay":
+			r.Action.Delay, err = time.ParseDuration(v)
+		case "mode":
+			r.Action.Mode = v
+		case "bytes":
+			r.Action.Bytes, err = strconv.Atoi(v)
+		case "depth":
+			r.Action.Depth, err = strconv.Atoi(v)
+		case "loop":
+			r.Action.Loop, err = strconv.ParseBool(v)
+		case "messages":
+			r.Action.Messages, err = strconv.Atoi(v)
+		case "after":
+			r.Action.After, err = time.ParseDuration(v)
+		case "timeout":
+			r.Action.Timeout, err = time.ParseDuration(v)
+		case "retries":
+			var n int
+			n, err = strconv.Atoi(v)
+			r.Action.Retries = &n
+		case "buffer":
+			r.Action.Buffer, err = strconv.Atoi(v)
+		case "fields":
+			r.Action.Fields = append(r.Action.Fields, strings.Split(v, "|")...)
+		case "ttl":
+			var ttl time.Duration
+			ttl, err = time.ParseDuration(v)
+			r.Deadline = time.Now().Add(ttl)
+		case "window":
+			for _, x := range strings.Split(v, "|") {
+				var w TimeWindow
+				if w, err = ParseTimeWindow(x); err != nil {
+					break
+				}
+				r.Windows = append(r.Windows, w)
+			}
+		default:
+			return nil, fmt.Errorf("decoding rule %s: unknown key %s", x, k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decoding rule %s: bad %s: %w", x, k, err)
+		}
+	}
+
+	if r.Name == "" {
+		r.Name = r.Action.Type
+	}
+
+	return r, r.Validate()
+}
+
+// RuleFlags is a repeatable flag value, each occurrence is decoded with
+// ParseRule
+type RuleFlags []*Rule
+
+func (rf RuleFlags) String() string {
+	var xs []string
+	for _, r := range rf {
+		xs = append(xs, r.String())
+	}
+
+	return strings.Join(xs, ";")
+}
+
+func (rf *RuleFlags) Set(x string) error {
+	r, err := ParseRule(x)
+	if err != nil {
+		return err
+	}
+
+	*rf = append(*rf, r)
+	return nil
+}
+
+func containsFold(xs []string, x string) bool {
+	for _, e := range xs {
+		if strings.EqualFold(e, x) {
+			return true
+		}
+	}
+
+	return false
+}
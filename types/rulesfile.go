@@ -0,0 +1,265 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RulesFile is the content of a rules file. The rewrite rules use the same
+// syntax of the corresponding flags
+type RulesFile struct {
+	Mode            string
+	Rules           []*Rule
+	RequestHeaders  RewriteRules
+	ResponseHeaders RewriteRules
+	Query           RewriteRules
+	Paths           PathRewrites
+}
+
+// the on-disk schema of the rules file, shared by the JSON and YAML formats
+type fileSchema struct {
+	Mode     string       `json:"mode,omitempty" yaml:"mode,omitempty"`
+	Rules    []fileRule   `json:"rules,omitempty" yaml:"rules,omitempty"`
+	Rewrites fileRewrites `json:"rewrites,omitempty" yaml:"rewrites,omitempty"`
+}
+
+type fileRule struct {
+	Name        string     `json:"name,omitempty" yaml:"name,omitempty"`
+	Priority    int        `json:"priority,omitempty" yaml:"priority,omitempty"`
+	Probability *float64   `json:"probability,omitempty" yaml:"probability,omitempty"`
+	Scope       string     `json:"scope,omitempty" yaml:"scope,omitempty"`
+	ClientKey   string     `json:"client_key,omitempty" yaml:"client_key,omitempty"`
+	Match       fileMatch  `json:"match,omitempty" yaml:"match,omitempty"`
+	Action      fileAction `json:"action,omitempty" yaml:"action,omitempty"`
+	TTL         string     `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	Windows     []string   `json:"windows,omitempty" yaml:"windows,omitempty"`
+}
+
+type fileMatch struct {
+	Methods           []string          `json:"methods,omitempty" yaml:"methods,omitempty"`
+	Hosts             []string          `json:"hosts,omitempty" yaml:"hosts,omitempty"`
+	PathPrefix        string            `json:"path_prefix,omitempty" yaml:"path_prefix,omitempty"`
+	Headers           map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	MinInFlight       int               `json:"min_inflight,omitempty" yaml:"min_inflight,omitempty"`
+	MinRPS            float64           `json:"min_rps,omitempty" yaml:"min_rps,omitempty"`
+	GraphQLOperations []string          `json:"graphql_operations,omitempty" yaml:"graphql_operations,omitempty"`
+	GraphQLFields     []string          `json:"graphql_fields,omitempty" yaml:"graphql_fields,omitempty"`
+}
+
+type fileAction struct {
+	Type     string   `json:"type,omitempty" yaml:"type,omitempty"`
+	Status   int      `json:"status,omitempty" yaml:"status,omitempty"`
+	Message  string   `json:"message,omitempty" yaml:"message,omitempty"`
+	Delay    string   `json:"delay,omitempty" yaml:"delay,omitempty"`
+	Mode     string   `json:"mode,omitempty" yaml:"mode,omitempty"`
+	Bytes    int      `json:"bytes,omitempty" yaml:"bytes,omitempty"`
+	Depth    int      `json:"depth,omitempty" yaml:"depth,omitempty"`
+	Loop     bool     `json:"loop,omitempty" yaml:"loop,omitempty"`
+	Messages int      `json:"messages,omitempty" yaml:"messages,omitempty"`
+	After    string   `json:"after,omitempty" yaml:"after,omitempty"`
+	Timeout  string   `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	Retries  *int     `json:"retries,omitempty" yaml:"retries,omitempty"`
+	Buffer   int      `json:"buffer,omitempty" yaml:"buffer,omitempty"`
+	Fields   []string `json:"fields,omitempty" yaml:"fields,omitempty"`
+}
+
+type fileRewrites struct {
+	RequestHeaders  []string `json:"request_headers,omitempty" yaml:"request_headers,omitempty"`
+	ResponseHeaders []string `json:"response_headers,omitempty" yaml:"response_headers,omitempty"`
+	Query           []string `json:"query,omitempty" yaml:"query,omitempty"`
+	Paths           []string `json:"paths,omitempty" yaml:"paths,omitempty"`
+}
+
+// LoadRulesFile reads and validates a rules file, the format (JSON or YAML)
+// is selected by the extension. A Chaos Mesh HTTPChaos manifest is accepted
+// too
+func LoadRulesFile(path string) (*RulesFile, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fs fileSchema
+	ext := strings.ToLower(filepath.Ext(path))
+	switch {
+	case isChaosMesh(raw):
+		err = decodeChaosMesh(raw, &fs)
+	case ext == ".json":
+		err = decodeJSON(raw, &fs)
+	case ext == ".yaml", ext == ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(raw))
+		dec.KnownFields(true)
+		err = dec.Decode(&fs)
+	default:
+		return nil, fmt.Errorf("%s: unknown format, expected a .json, .yaml or .yml file", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	rf, err := fs.compile()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return rf, nil
+}
+
+// decodeJSON decodes raw rejecting the unknown fields and reporting the
+// position of the syntax errors
+func decodeJSON(raw []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(v)
+	var se *json.SyntaxError
+	if errors.As(err, &se) {
+		line, col := position(raw, se.Offset)
+		return fmt.Errorf("line %d, column %d: %w", line, col, err)
+	}
+	var te *json.UnmarshalTypeError
+	if errors.As(err, &te) {
+		line, col := position(raw, te.Offset)
+		return fmt.Errorf("line %d, column %d: field %s: expected %s, got %s", line, col, te.Field, te.Type, te.Value)
+	}
+
+	return err
+}
+
+func position(raw []byte, offset int64) (int, int) {
+	if offset > int64(len(raw)) {
+		offset = int64(len(raw))
+	}
+
+	before := raw[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := int(offset) - bytes.LastIndexByte(before, '\n')
+
+	return line, col
+}
+
+func (fs fileSchema) compile() (*RulesFile, error) {
+	rf := &RulesFile{Mode: fs.Mode}
+	if rf.Mode != "" && rf.Mode != ModeFirst && rf.Mode != ModeAll {
+		return nil, fmt.Errorf("mode: bad value %q, expected first or all", rf.Mode)
+	}
+
+	for i, fr := range fs.Rules {
+		r, err := fr.compile()
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d] (%s): %w", i, fr.Name, err)
+		}
+		rf.Rules = append(rf.Rules, r)
+	}
+
+	lists := []struct {
+		name  string
+		items []string
+		dst   interface{ Set(string) error }
+	}{
+		{"rewrites.request_headers", fs.Rewrites.RequestHeaders, &rf.RequestHeaders},
+		{"rewrites.response_headers", fs.Rewrites.ResponseHeaders, &rf.ResponseHeaders},
+		{"rewrites.query", fs.Rewrites.Query, &rf.Query},
+		{"rewrites.paths", fs.Rewrites.Paths, &rf.Paths},
+	}
+	for _, l := range lists {
+		for i, x := range l.items {
+			if err := l.dst.Set(x); err != nil {
+				return nil, fmt.Errorf("%s[%d]: %w", l.name, i, err)
+			}
+		}
+	}
+
+	return rf, nil
+}
+
+func (fr fileRule) compile() (*Rule, error) {
+	if fr.Action.Type == "" {
+		return nil, errors.New("action.type is required")
+	}
+
+	r := &Rule{
+		Name:        fr.Name,
+		Priority:    fr.Priority,
+		Probability: 100,
+		Scope:       fr.Scope,
+		ClientKey:   fr.ClientKey,
+		Match: Match{
+			Methods:           fr.Match.Methods,
+			Hosts:             fr.Match.Hosts,
+			PathPrefix:        fr.Match.PathPrefix,
+			Headers:           fr.Match.Headers,
+			MinInFlight:       fr.Match.MinInFlight,
+			MinRPS:            fr.Match.MinRPS,
+			GraphQLOperations: fr.Match.GraphQLOperations,
+			GraphQLFields:     fr.Match.GraphQLFields,
+		},
+		Action: Action{
+			Type:     fr.Action.Type,
+			Status:   fr.Action.Status,
+			Message:  fr.Action.Message,
+			Mode:     fr.Action.Mode,
+			Bytes:    fr.Action.Bytes,
+			Depth:    fr.Action.Depth,
+			Loop:     fr.Action.Loop,
+			Messages: fr.Action.Messages,
+			Retries:  fr.Action.Retries,
+			Buffer:   fr.Action.Buffer,
+			Fields:   fr.Action.Fields,
+		},
+	}
+	if r.Name == "" {
+		r.Name = r.Action.Type
+	}
+	if fr.Probability != nil {
+		r.Probability = *fr.Probability
+	}
+
+	if fr.Action.Delay != "" {
+		d, err := time.ParseDuration(fr.Action.Delay)
+		if err != nil {
+			return nil, fmt.Errorf("action.delay: %w", err)
+		}
+		r.Action.Delay = d
+	}
+	if fr.Action.After != "" {
+		d, err := time.ParseDuration(fr.Action.After)
+		if err != nil {
+			return nil, fmt.Errorf("action.after: %w", err)
+		}
+		r.Action.After = d
+	}
+	if fr.Action.Timeout != "" {
+		d, err := time.ParseDuration(fr.Action.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("action.timeout: %w", err)
+		}
+		r.Action.Timeout = d
+	}
+	if fr.TTL != "" {
+		ttl, err := time.ParseDuration(fr.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("ttl: %w", err)
+		}
+		r.Deadline = time.Now().Add(ttl)
+	}
+	for _, x := range fr.Windows {
+		w, err := ParseTimeWindow(x)
+		if err != nil {
+			return nil, fmt.Errorf("windows: %w", err)
+		}
+		r.Windows = append(r.Windows, w)
+	}
+
+	return r, r.Validate()
+}
@@ -0,0 +1,65 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Scopes of the probability of a Rule: a share of the requests (the
+// default), of the unique clients or of the resources (paths), always the
+// same ones
+const (
+	ScopeRequests  = "requests"
+	ScopeClients   = "clients"
+	ScopeResources = "resources"
+)
+
+// DefaultClientKey identifies the clients by IP
+const DefaultClientKey = "ip"
+
+// ClientIdentity returns the identifier of the client of r selected by key:
+// "ip", "header:name" or "cookie:name". Without the header or the cookie
+// the client is identified by its IP
+func ClientIdentity(r *http.Request, key string) string {
+	switch {
+	case strings.HasPrefix(key, "header:"):
+		if v := r.Header.Get(key[len("header:"):]); v != "" {
+			return v
+		}
+	case strings.HasPrefix(key, "cookie:"):
+		if c, err := r.Cookie(key[len("cookie:"):]); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// CheckClientKey validates the client identifier of ClientIdentity
+func CheckClientKey(key string) error {
+	if key == DefaultClientKey || (strings.HasPrefix(key, "header:") && len(key) > len("header:")) || (strings.HasPrefix(key, "cookie:") && len(key) > len("cookie:")) {
+		return nil
+	}
+	return fmt.Errorf("bad client key %q: expected ip, header:name or cookie:name", key)
+}
+
+// StableHash maps x to one of n buckets, always the same
+func StableHash(x string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(x))
+	return int(h.Sum32() % uint32(n))
+}
+
+// percentile places x in [0, 100), always at the same point
+func percentile(x string) float64 {
+	return float64(StableHash(x, 10000)) / 100
+}
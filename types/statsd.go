@@ -0,0 +1,100 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// statsdPacketSize keeps the datagrams below the usual MTU
+const statsdPacketSize = 1432
+
+// StatsD is a client of a StatsD server supporting the DogStatsD tags. The
+// metrics are sent in batches, by a background goroutine, and dropped if
+// the server cannot keep up
+type StatsD struct {
+	conn   net.Conn
+	prefix string
+	tags   string
+	lines  chan string
+}
+
+// NewStatsD returns a client sending the metrics to addr (host:port) over
+// UDP, the names are prefixed with prefix and the tags are added to every
+// metric
+func NewStatsD(addr, prefix string, tags []string) (*StatsD, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &StatsD{
+		conn:   conn,
+		prefix: prefix,
+		tags:   strings.Join(tags, ","),
+		lines:  make(chan string, 4096),
+	}
+	go s.loop(100 * time.Millisecond)
+
+	return s, nil
+}
+
+// Count adds v to the counter name
+func (s *StatsD) Count(name string, v int64, tags ...string) {
+	s.send(fmt.Sprintf("%s%s:%d|c", s.prefix, name, v), tags)
+}
+
+// Timing records a duration, in milliseconds
+func (s *StatsD) Timing(name string, d time.Duration, tags ...string) {
+	ms := float64(d) / float64(time.Millisecond)
+	s.send(fmt.Sprintf("%s%s:%g|ms", s.prefix, name, ms), tags)
+}
+
+func (s *StatsD) send(line string, tags []string) {
+	all := s.tags
+	if len(tags) > 0 {
+		if all != "" {
+			all += ","
+		}
+		all += strings.Join(tags, ",")
+	}
+	if all != "" {
+		line += "|#" + all
+	}
+
+	select {
+	case s.lines <- line:
+	default:
+	}
+}
+
+func (s *StatsD) loop(interval time.Duration) {
+	var buf bytes.Buffer
+	flush := func() {
+		if buf.Len() > 0 {
+			s.conn.Write(buf.Bytes())
+			buf.Reset()
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case line := <-s.lines:
+			if buf.Len() > 0 && buf.Len()+1+len(line) > statsdPacketSize {
+				flush()
+			}
+			if buf.Len() > 0 {
+				buf.WriteByte('\n')
+			}
+			buf.WriteString(line)
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
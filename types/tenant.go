@@ -0,0 +1,121 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// TenantSpec describes a virtual proxy instance, selected by Port or, for
+// the virtual hosts, by the Hosts of the requests
+type TenantSpec struct {
+	Name      string
+	Port      int
+	Hosts     []string
+	Upstream  string
+	RulesFile string
+}
+
+// parseTenantSpec decodes the "key=value,key=value" form of -tenant and
+// -vhost. The keys are name, port, host (repeatable, separated by "|"),
+// upstream and rules-file
+func parseTenantSpec(x string) (TenantSpec, error) {
+	var t TenantSpec
+	for _, e := range strings.Split(x, ",") {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 {
+			return t, fmt.Errorf("decoding %s: expected key=value, got %s", x, e)
+		}
+
+		k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch k {
+		case "name":
+			t.Name = v
+		case "port":
+			p, err := strconv.Atoi(v)
+			if err != nil {
+				return t, fmt.Errorf("decoding %s: bad port: %w", x, err)
+			}
+			t.Port = p
+		case "host":
+			t.Hosts = append(t.Hosts, strings.Split(v, "|")...)
+		case "upstream":
+			t.Upstream = v
+		case "rules-file":
+			t.RulesFile = v
+		default:
+			return t, fmt.Errorf("decoding %s: unknown key %s", x, k)
+		}
+	}
+
+	return t, nil
+}
+
+// TenantSpecs is a repeatable flag value in the form
+// "name=team-a,port=9101,rules-file=team-a.yaml"
+type TenantSpecs []TenantSpec
+
+func (ts TenantSpecs) String() string {
+	var xs []string
+	for _, t := range ts {
+		xs = append(xs, fmt.Sprintf("%s:%d", t.Name, t.Port))
+	}
+
+	return strings.Join(xs, ";")
+}
+
+func (ts *TenantSpecs) Set(x string) error {
+	t, err := parseTenantSpec(x)
+	if err != nil {
+		return fmt.Errorf("tenant: %w", err)
+	}
+	if t.Name == "" || t.Port == 0 {
+		return fmt.Errorf("decoding tenant %s: name and port are required", x)
+	}
+	if len(t.Hosts) > 0 {
+		return fmt.Errorf("decoding tenant %s: the hosts are selected with -vhost", x)
+	}
+	for _, o := range *ts {
+		if o.Name == t.Name || o.Port == t.Port {
+			return fmt.Errorf("decoding tenant %s: duplicated name or port", x)
+		}
+	}
+
+	*ts = append(*ts, t)
+	return nil
+}
+
+// VirtualHostSpecs is a repeatable flag value in the form
+// "host=api.example.com|www.example.com,upstream=http://api.internal,rules-file=api.yaml",
+// the name defaults to the first host
+type VirtualHostSpecs []TenantSpec
+
+func (vs VirtualHostSpecs) String() string {
+	var xs []string
+	for _, v := range vs {
+		xs = append(xs, fmt.Sprintf("%s:%s", strings.Join(v.Hosts, "|"), v.Upstream))
+	}
+
+	return strings.Join(xs, ";")
+}
+
+func (vs *VirtualHostSpecs) Set(x string) error {
+	v, err := parseTenantSpec(x)
+	if err != nil {
+		return fmt.Errorf("virtual host: %w", err)
+	}
+	if len(v.Hosts) == 0 {
+		return fmt.Errorf("decoding virtual host %s: host is required", x)
+	}
+	if v.Port != 0 {
+		return fmt.Errorf("decoding virtual host %s: the virtual hosts share the listeners, port is not allowed", x)
+	}
+	if v.Name == "" {
+		v.Name = v.Hosts[0]
+	}
+
+	*vs = append(*vs, v)
+	return nil
+}
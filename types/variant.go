@@ -0,0 +1,95 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// VariantSpec is one of the stub responses served for the paths starting
+// with Prefix, the body is read from File
+type VariantSpec struct {
+	Prefix      string
+	Name        string
+	Status      int
+	File        string
+	ContentType string
+}
+
+// parseVariantSpec decodes the "key=value,key=value" form of -variant. The
+// keys are prefix, name, status, file and content-type
+func parseVariantSpec(x string) (VariantSpec, error) {
+	v := VariantSpec{Status: 200}
+	for _, e := range strings.Split(x, ",") {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 {
+			return v, fmt.Errorf("decoding %s: expected key=value, got %s", x, e)
+		}
+
+		k, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch k {
+		case "prefix":
+			v.Prefix = val
+		case "name":
+			v.Name = val
+		case "status":
+			s, err := strconv.Atoi(val)
+			if err != nil || s < 100 || s > 599 {
+				return v, fmt.Errorf("decoding %s: bad status %q", x, val)
+			}
+			v.Status = s
+		case "file":
+			v.File = val
+		case "content-type":
+			v.ContentType = val
+		default:
+			return v, fmt.Errorf("decoding %s: unknown key %s", x, k)
+		}
+	}
+
+	return v, nil
+}
+
+// VariantSpecs is a repeatable flag value in the form
+// "prefix=/api/profile,name=b,status=200,file=profile-b.json", the variants
+// of a prefix are kept in order
+type VariantSpecs []VariantSpec
+
+func (vs VariantSpecs) String() string {
+	var xs []string
+	for _, v := range vs {
+		xs = append(xs, fmt.Sprintf("%s:%s", v.Prefix, v.Name))
+	}
+
+	return strings.Join(xs, ";")
+}
+
+func (vs *VariantSpecs) Set(x string) error {
+	v, err := parseVariantSpec(x)
+	if err != nil {
+		return fmt.Errorf("variant: %w", err)
+	}
+	if v.Prefix == "" || v.File == "" {
+		return fmt.Errorf("decoding variant %s: prefix and file are required", x)
+	}
+	n := 0
+	for _, o := range *vs {
+		if o.Prefix == v.Prefix {
+			n++
+		}
+	}
+	if v.Name == "" {
+		// a, b, c... in order of definition
+		v.Name = string(rune('a' + n%26))
+	}
+	for _, o := range *vs {
+		if o.Prefix == v.Prefix && o.Name == v.Name {
+			return fmt.Errorf("decoding variant %s: duplicated name", x)
+		}
+	}
+
+	*vs = append(*vs, v)
+	return nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+
+package types
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// TimeWindow is a daily time range, in local time, optionally restricted to
+// some days of the week. A range ending before its start spans midnight and
+// belongs to the day it starts
+type TimeWindow struct {
+	// From and To are the minutes since midnight, To excluded
+	From, To int
+	// Days flags the weekdays of the window, all of them when zero
+	Days uint8
+}
+
+// ParseTimeWindow decodes a window in the form "[days ]HH:MM-HH:MM", where
+// days is a weekday (mon, tue...) or a range of them (mon-fri)
+func ParseTimeWindow(x string) (TimeWindow, error) {
+	var w TimeWindow
+	fields := strings.Fields(x)
+	switch len(fields) {
+	case 1:
+	case 2:
+		days, err := parseDays(fields[0])
+		if err != nil {
+			return w, fmt.Errorf("bad time window %q: %w", x, err)
+		}
+		w.Days = days
+	default:
+		return w, fmt.Errorf("bad time window %q: expected [days ]HH:MM-HH:MM", x)
+	}
+
+	hours := strings.SplitN(fields[len(fields)-1], "-", 2)
+	if len(hours) != 2 {
+		return w, fmt.Errorf("bad time window %q: expected [days ]HH:MM-HH:MM", x)
+	}
+	var err error
+	if w.From, err = parseClock(hours[0]); err != nil {
+		return w, fmt.Errorf("bad time window %q: %w", x, err)
+	}
+	if w.To, err = parseClock(hours[1]); err != nil {
+		return w, fmt.Errorf("bad time window %q: %w", x, err)
+	}
+	if w.From == w.To {
+		return w, fmt.Errorf("bad time window %q: empty range", x)
+	}
+
+	return w, nil
+}
+
+func parseClock(x string) (int, error) {
+	t, err := time.Parse("15:04", x)
+	if err != nil {
+		return 0, fmt.Errorf("bad time %q, expected HH:MM", x)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseDays(x string) (uint8, error) {
+	ends := strings.SplitN(strings.ToLower(x), "-", 2)
+	from, ok := weekdays[ends[0]]
+	if !ok {
+		return 0, fmt.Errorf("bad weekday %q", ends[0])
+	}
+	to := from
+	if len(ends) == 2 {
+		if to, ok = weekdays[ends[1]]; !ok {
+			return 0, fmt.Errorf("bad weekday %q", ends[1])
+		}
+	}
+
+	var days uint8
+	for d := from; ; d = (d + 1) % 7 {
+		days |= 1 << d
+		if d == to {
+			break
+		}
+	}
+
+	return days, nil
+}
+
+// Contains report if t falls in the window
+func (w TimeWindow) Contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.From < w.To {
+		if m < w.From || m >= w.To {
+			return false
+		}
+	} else {
+		if m >= w.To && m < w.From {
+			return false
+		}
+		if m < w.To {
+			// the early hours belong to the window of the previous day
+			day = (day + 6) % 7
+		}
+	}
+
+	return w.Days == 0 || w.Days&(1<<day) != 0
+}
@@ -0,0 +1,263 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/meox/floki-proxy/types"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// udpSessionTimeout closes the sessions idle, in both directions, for
+	// this long
+	udpSessionTimeout = time.Minute
+	// udpMaxSessions is the number of sessions of a client IP (from as
+	// many ports), the packets opening more are dropped
+	udpMaxSessions = 64
+	// udpQueue is the number of packets waiting for their delay in each
+	// direction of a session, the next ones are lost
+	udpQueue = 1024
+	// udpMaxPacket is the largest datagram forwarded
+	udpMaxPacket = 64 * 1024
+)
+
+// listenUDP starts the UDP proxy p: every client gets its own socket
+// towards the target, the replies coming from it are sent back to the
+// client. The packets are lost, duplicated, reordered and delayed in both
+// directions
+func listenUDP(p types.Forward) error {
+	addr, err := net.ResolveUDPAddr("udp", p.Target)
+	if err != nil {
+		return err
+	}
+	laddr, err := net.ResolveUDPAddr("udp", bindAddr(p.Port))
+	if err != nil {
+		return err
+	}
+	l, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return err
+	}
+
+	var m sync.Mutex
+	sessions := make(map[string]*udpSession)
+	perIP := make(map[string]int)
+	go func() {
+		buf := make([]byte, udpMaxPacket)
+		for {
+			n, client, err := l.ReadFromUDP(buf)
+			if err != nil {
+				log.Errorf("reading udp packet on %d: %v", p.Port, err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+
+			// the packets are forwarded under the lock, none reaches a
+			// session after its removal
+			m.Lock()
+			s, ok := sessions[client.String()]
+			if !ok {
+				ip := client.IP.String()
+				if perIP[ip] >= udpMaxSessions {
+					m.Unlock()
+					log.Debugf("dropping udp packet from %s: too many sessions", client)
+					continue
+				}
+				if s, err = newUDPSession(l, client, addr); err != nil {
+					m.Unlock()
+					log.Errorf("dialing %s: %v", p.Target, err)
+					continue
+				}
+				sessions[client.String()] = s
+				perIP[ip]++
+				go func(key string) {
+					s.run()
+					m.Lock()
+					delete(sessions, key)
+					if perIP[ip]--; perIP[ip] == 0 {
+						delete(perIP, ip)
+					}
+					m.Unlock()
+					s.close()
+				}(client.String())
+			}
+			s.touch()
+			s.toTarget.forward(append([]byte(nil), buf[:n]...))
+			m.Unlock()
+		}
+	}()
+
+	return nil
+}
+
+// udpSession is the flow of packets between a client and the target
+type udpSession struct {
+	// seen is the time (unix nanoseconds) of the last packet of the
+	// client, accessed atomically
+	seen     int64
+	up       *net.UDPConn
+	client   *net.UDPAddr
+	target   string
+	toTarget *udpPipe
+	toClient *udpPipe
+}
+
+func newUDPSession(l *net.UDPConn, client, target *net.UDPAddr) (*udpSession, error) {
+	up, err := net.DialUDP("udp", nil, target)
+	if err != nil {
+		return nil, err
+	}
+
+	return &udpSession{
+		up:     up,
+		client: client,
+		target: target.String(),
+		toTarget: newUDPPipe(fmt.Sprintf("%s -> %s", client, target), func(b []byte) error {
+			_, err := up.Write(b)
+			return err
+		}),
+		toClient: newUDPPipe(fmt.Sprintf("%s -> %s", target, client), func(b []byte) error {
+			_, err := l.WriteToUDP(b, client)
+			return err
+		}),
+	}, nil
+}
+
+// touch records a packet of the client
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.seen, time.Now().UnixNano())
+}
+
+// run forwards the replies of the target to the client until the session is
+// idle, no packet from either side, for udpSessionTimeout
+func (s *udpSession) run() {
+	buf := make([]byte, udpMaxPacket)
+	last := time.Now()
+	for {
+		s.up.SetReadDeadline(last.Add(udpSessionTimeout))
+		n, err := s.up.Read(buf)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// the client may have been sending meanwhile
+			if seen := time.Unix(0, atomic.LoadInt64(&s.seen)); seen.After(last) {
+				last = seen
+				continue
+			}
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				log.Errorf("reading udp packet from %s: %v", s.target, err)
+			}
+			log.Infof("udp session from %s to %s closed", s.client, s.target)
+			return
+		}
+
+		last = time.Now()
+		s.toClient.forward(append([]byte(nil), buf[:n]...))
+	}
+}
+
+// close sends the packets still waiting for their delay and releases the
+// socket of the session
+func (s *udpSession) close() {
+	s.toTarget.stop()
+	s.toClient.stop()
+	s.up.Close()
+}
+
+// udpPacket is a packet waiting for its delay
+type udpPacket struct {
+	data []byte
+	due  time.Time
+}
+
+// udpPipe sends the packets of a direction of a session, applying the
+// faults. The delayed packets are sent in order, by a goroutine, except the
+// reordered ones which are overtaken by the next packets
+type udpPipe struct {
+	desc    string
+	send    func([]byte) error
+	queue   chan udpPacket
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newUDPPipe(desc string, send func([]byte) error) *udpPipe {
+	p := &udpPipe{
+		desc:    desc,
+		send:    send,
+		queue:   make(chan udpPacket, udpQueue),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go p.run()
+
+	return p
+}
+
+func (p *udpPipe) run() {
+	defer close(p.stopped)
+	for {
+		select {
+		case <-p.done:
+			p.flush()
+			return
+		case pkt := <-p.queue:
+			time.Sleep(time.Until(pkt.due))
+			p.send(pkt.data)
+		}
+	}
+}
+
+// flush sends the queued packets, when their delay is elapsed
+func (p *udpPipe) flush() {
+	for {
+		select {
+		case pkt := <-p.queue:
+			time.Sleep(time.Until(pkt.due))
+			p.send(pkt.data)
+		default:
+			return
+		}
+	}
+}
+
+// stop waits for the queued packets to be sent and stops the pipe
+func (p *udpPipe) stop() {
+	close(p.done)
+	<-p.stopped
+}
+
+// forward sends b, unless it is lost
+func (p *udpPipe) forward(b []byte) {
+	if injectFault(udpLossRate, "udp-loss", p.desc) {
+		log.Warnf("dropping a %d bytes udp packet: %s", len(b), p.desc)
+		return
+	}
+	if injectFault(udpReorderRate, "udp-reorder", p.desc) {
+		log.Warnf("reordering a %d bytes udp packet: %s", len(b), p.desc)
+		time.AfterFunc(udpDelay+udpReorderDelay, func() { p.send(b) })
+		return
+	}
+
+	n := 1
+	if injectFault(udpDuplicateRate, "udp-duplicate", p.desc) {
+		log.Warnf("duplicating a %d bytes udp packet: %s", len(b), p.desc)
+		n = 2
+	}
+	due := time.Now().Add(udpDelay)
+	for i := 0; i < n; i++ {
+		select {
+		case p.queue <- udpPacket{data: b, due: due}:
+		default:
+			// the queue is full
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/meox/floki-proxy/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// variant is a stub response
+type variant struct {
+	name        string
+	status      int
+	contentType string
+	body        []byte
+}
+
+// variantGroup are the variants served for the paths starting with prefix
+type variantGroup struct {
+	prefix   string
+	variants []variant
+}
+
+var variantGroups []variantGroup
+
+// loadVariants reads the bodies of the variants, the groups are sorted by
+// decreasing prefix length so that the most specific one wins
+func loadVariants(specs types.VariantSpecs) ([]variantGroup, error) {
+	var groups []variantGroup
+	index := make(map[string]int)
+	for _, spec := range specs {
+		body, err := ioutil.ReadFile(spec.File)
+		if err != nil {
+			return nil, fmt.Errorf("loading variant %s of %s: %w", spec.Name, spec.Prefix, err)
+		}
+		ct := spec.ContentType
+		if ct == "" {
+			ct = mime.TypeByExtension(filepath.Ext(spec.File))
+		}
+		if ct == "" {
+			ct = http.DetectContentType(body)
+		}
+
+		i, ok := index[spec.Prefix]
+		if !ok {
+			i = len(groups)
+			index[spec.Prefix] = i
+			groups = append(groups, variantGroup{prefix: spec.Prefix})
+		}
+		groups[i].variants = append(groups[i].variants, variant{name: spec.Name, status: spec.Status, contentType: ct, body: body})
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return len(groups[i].prefix) > len(groups[j].prefix)
+	})
+
+	return groups, nil
+}
+
+// serveVariant answers r, for the given path, with the variant of its
+// client, it returns false if no variant is configured for the path
+func serveVariant(w http.ResponseWriter, r *http.Request, path string) bool {
+	for _, g := range variantGroups {
+		if !strings.HasPrefix(path, g.prefix) {
+			continue
+		}
+
+		v := g.variants[types.StableHash(types.ClientIdentity(r, variantKey), len(g.variants))]
+		log.Debugf("serving variant %s of %s: %s", v.name, g.prefix, r.RequestURI)
+		w.Header().Set("Content-Type", v.contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(v.body)))
+		w.Header().Set("X-Floki-Variant", v.name)
+		w.WriteHeader(v.status)
+		if r.Method != http.MethodHead {
+			w.Write(v.body)
+		}
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,171 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// webhookTimeout bounds the delivery of a notification
+const webhookTimeout = 5 * time.Second
+
+// the chaos events notified to the webhooks
+const (
+	eventStarted         = "chaos-started"
+	eventStopped         = "chaos-stopped"
+	eventBudgetExhausted = "budget-exhausted"
+	eventErrorRateAbove  = "error-rate-above"
+	eventErrorRateBelow  = "error-rate-below"
+	eventRuleEnabled     = "rule-enabled"
+	eventRuleDisabled    = "rule-disabled"
+	eventBackendDown     = "backend-down"
+	eventBackendUp       = "backend-up"
+)
+
+// webhookEvent is the JSON body posted to the webhooks, text makes it a
+// valid Slack message
+type webhookEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Host  string    `json:"host"`
+	Text  string    `json:"text"`
+}
+
+// webhookURLs are the endpoints of -webhooks
+var webhookURLs []string
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// webhookDeliveries are the notifications being posted
+var webhookDeliveries sync.WaitGroup
+
+// notify posts the event to the webhooks, in background
+func notify(event, format string, args ...interface{}) {
+	if len(webhookURLs) == 0 {
+		return
+	}
+
+	host, _ := os.Hostname()
+	text := fmt.Sprintf(format, args...)
+	body, err := json.Marshal(webhookEvent{
+		Event: event,
+		Time:  time.Now(),
+		Host:  host,
+		Text:  fmt.Sprintf("floki-proxy on %s: %s", host, text),
+	})
+	if err != nil {
+		log.Errorf("encoding webhook event: %v", err)
+		return
+	}
+
+	for _, u := range webhookURLs {
+		webhookDeliveries.Add(1)
+		go func(u string) {
+			defer webhookDeliveries.Done()
+			resp, err := webhookClient.Post(u, "application/json", bytes.NewReader(body))
+			if err != nil {
+				log.Errorf("notifying %s to %s: %v", event, u, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Errorf("notifying %s to %s: %s", event, u, resp.Status)
+			}
+		}(u)
+	}
+}
+
+// notifyStopped notifies the stop of the chaos and waits, up to
+// webhookTimeout, for the notifications to be delivered
+func notifyStopped(format string, args ...interface{}) {
+	notify(eventStopped, format, args...)
+
+	done := make(chan struct{})
+	go func() {
+		webhookDeliveries.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(webhookTimeout):
+	}
+}
+
+// notifyOnSignal notifies the stop of the proxy on SIGINT and SIGTERM, the
+// process exits once the notifications are delivered
+func notifyOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sigs
+		log.Warnf("stopping on %s", s)
+		notifyStopped("stopped by %s", s)
+		os.Exit(0)
+	}()
+}
+
+// errorRateWatch notifies when the error rate observed by the clients, over
+// every interval, crosses the threshold. It counts the requests as a
+// metrics sink
+type errorRateWatch struct {
+	threshold float64
+	requests  uint64
+	errors    uint64
+	above     bool
+	m         sync.Mutex
+}
+
+func newErrorRateWatch(threshold float64) *errorRateWatch {
+	return &errorRateWatch{threshold: threshold}
+}
+
+func (ew *errorRateWatch) request(rr requestRecord) {
+	ew.m.Lock()
+	defer ew.m.Unlock()
+
+	ew.requests++
+	if clientError(rr.status) {
+		ew.errors++
+	}
+}
+
+func (ew *errorRateWatch) fault(string) {}
+
+// run checks the error rate every interval, forever
+func (ew *errorRateWatch) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		ew.check()
+	}
+}
+
+func (ew *errorRateWatch) check() {
+	ew.m.Lock()
+	requests, errors := ew.requests, ew.errors
+	ew.requests, ew.errors = 0, 0
+	ew.m.Unlock()
+
+	if requests == 0 {
+		return
+	}
+
+	rate := 100 * float64(errors) / float64(requests)
+	switch above := rate >= ew.threshold; {
+	case above && !ew.above:
+		notify(eventErrorRateAbove, "error rate %.2f%% over %d requests, above the threshold of %g%%", rate, requests, ew.threshold)
+	case !above && ew.above:
+		notify(eventErrorRateBelow, "error rate %.2f%% over %d requests, back below the threshold of %g%%", rate, requests, ew.threshold)
+	}
+	ew.above = rate >= ew.threshold
+}
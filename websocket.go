@@ -0,0 +1,275 @@
+// Copyright 2021 Gian Lorenzo Meocci (glmeocci@gmail.com). All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// wsMaxFrame is the largest WebSocket frame accepted by the proxy
+	wsMaxFrame = 32 << 20
+	// wsReorderHold is the longest time a reordered message is held back
+	wsReorderHold = time.Second
+
+	wsOpClose = 0x8
+
+	// wsCloseAbnormal is the close code reported when the connection drops
+	// without a close frame, it is never sent
+	wsCloseAbnormal = 1006
+)
+
+// wsMessage is a data message, made by one or more raw frames, or a single
+// control frame
+type wsMessage struct {
+	raw     []byte
+	control bool
+	opcode  byte
+}
+
+// proxyUpgrade takes over the client connection of r, answered by the
+// upstream with 101 Switching Protocols, and relays the traffic in both
+// directions. The WebSocket messages go through the message faults
+func proxyUpgrade(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+	up, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		w.WriteHeader(http.StatusBadGateway)
+		log.Errorf("upgrading %s: the upstream connection is not writable", r.RequestURI)
+		return
+	}
+
+	conn, brw, err := hijack(w)
+	if err != nil {
+		log.Errorf("upgrading %s: %v", r.RequestURI, err)
+		return
+	}
+	defer conn.Close()
+	if f := flowOf(r); f != nil {
+		f.status = resp.StatusCode
+	}
+
+	if err := writeStatusAndHeaders(brw.Writer, resp, true); err != nil {
+		return
+	}
+
+	proto := strings.ToLower(resp.Header.Get("Upgrade"))
+	var closeAt <-chan time.Time
+	if proto == "websocket" && injectRequestFault(r, wsCloseRate, "ws-close") {
+		log.Warnf("closing WebSocket connection (code %d) in %s: %s", wsCloseCode, wsCloseAfter, r.RequestURI)
+		t := time.NewTimer(wsCloseAfter)
+		defer t.Stop()
+		closeAt = t.C
+	}
+
+	done := make(chan struct{}, 2)
+	relay := func(dst io.Writer, src io.Reader, dir string, closeAt <-chan time.Time) {
+		if proto == "websocket" {
+			pumpWebSocket(dst, src, dir, r.RequestURI, closeAt)
+		} else {
+			io.Copy(dst, src)
+		}
+		done <- struct{}{}
+	}
+	go relay(up, brw.Reader, "to upstream", nil)
+	go relay(conn, up, "to client", closeAt)
+	<-done
+
+	log.Infof("%s connection to %s closed", proto, r.RequestURI)
+}
+
+// readWSFrame reads a raw WebSocket frame, the payload is left masked
+func readWSFrame(r io.Reader) (raw []byte, fin bool, opcode byte, err error) {
+	var hdr [14]byte
+	if _, err := io.ReadFull(r, hdr[:2]); err != nil {
+		return nil, false, 0, err
+	}
+	fin = hdr[0]&0x80 != 0
+	opcode = hdr[0] & 0x0f
+
+	ext := 0
+	switch hdr[1] & 0x7f {
+	case 126:
+		ext = 2
+	case 127:
+		ext = 8
+	}
+	masked := hdr[1]&0x80 != 0
+	keyLen := 0
+	if masked {
+		keyLen = 4
+	}
+	if _, err := io.ReadFull(r, hdr[2:2+ext+keyLen]); err != nil {
+		return nil, false, 0, err
+	}
+
+	n := uint64(hdr[1] & 0x7f)
+	switch ext {
+	case 2:
+		n = uint64(binary.BigEndian.Uint16(hdr[2:4]))
+	case 8:
+		n = binary.BigEndian.Uint64(hdr[2:10])
+	}
+	if n > wsMaxFrame {
+		return nil, false, 0, fmt.Errorf("frame of %d bytes exceeds the limit of %d bytes", n, wsMaxFrame)
+	}
+
+	hl := 2 + ext + keyLen
+	raw = make([]byte, hl+int(n))
+	copy(raw, hdr[:hl])
+	if _, err := io.ReadFull(r, raw[hl:]); err != nil {
+		return nil, false, 0, err
+	}
+
+	return raw, fin, opcode, nil
+}
+
+// readWSMessages sends the messages read from src to msgs until an error
+// or done is closed, the control frames interleaved with the fragments of
+// a message are sent as they arrive
+func readWSMessages(src io.Reader, msgs chan<- wsMessage, done <-chan struct{}) {
+	defer close(msgs)
+
+	br := bufio.NewReader(src)
+	var cur wsMessage
+	for {
+		raw, fin, opcode, err := readWSFrame(br)
+		if err != nil {
+			return
+		}
+
+		var m wsMessage
+		if opcode >= wsOpClose {
+			m = wsMessage{raw: raw, control: true, opcode: opcode}
+		} else {
+			if cur.raw == nil {
+				cur.opcode = opcode
+			}
+			cur.raw = append(cur.raw, raw...)
+			if !fin {
+				continue
+			}
+			m, cur = cur, wsMessage{}
+		}
+
+		select {
+		case msgs <- m:
+		case <-done:
+			return
+		}
+	}
+}
+
+// wsCloseFrame returns an unmasked close frame with the given code
+func wsCloseFrame(code int) []byte {
+	frame := []byte{0x80 | wsOpClose, 2, 0, 0}
+	binary.BigEndian.PutUint16(frame[2:], uint16(code))
+	return frame
+}
+
+// validWSCloseCode report if code can be injected: wsCloseAbnormal or a
+// code allowed in a close frame
+func validWSCloseCode(code int) bool {
+	if code == wsCloseAbnormal {
+		return true
+	}
+
+	return code >= 1000 && code <= 4999 && code != 1004 && code != 1005 && code != 1015
+}
+
+// pumpWebSocket relays the WebSocket messages from src to dst applying the
+// message faults (drop, delay and reorder) to the data messages. A message
+// being reordered is held back until a random number (up to the window) of
+// later messages are delivered, a close frame passes or wsReorderHold
+// elapses. When closeAt fires the relay stops, after sending a close frame
+// with -ws-close-code unless it is wsCloseAbnormal
+func pumpWebSocket(dst io.Writer, src io.Reader, dir, target string, closeAt <-chan time.Time) {
+	msgs := make(chan wsMessage)
+	done := make(chan struct{})
+	defer close(done)
+	go readWSMessages(src, msgs, done)
+
+	var held []byte
+	var before int
+	release := func() error {
+		if held == nil {
+			return nil
+		}
+		_, err := dst.Write(held)
+		held = nil
+		return err
+	}
+
+	for {
+		var hold <-chan time.Time
+		if held != nil {
+			hold = time.After(wsReorderHold)
+		}
+
+		var m wsMessage
+		var ok bool
+		select {
+		case m, ok = <-msgs:
+		case <-hold:
+			if release() != nil {
+				return
+			}
+			continue
+		case <-closeAt:
+			if wsCloseCode != wsCloseAbnormal {
+				dst.Write(wsCloseFrame(wsCloseCode))
+			}
+			log.Warnf("closed WebSocket connection (code %d): %s", wsCloseCode, target)
+			return
+		}
+		if !ok {
+			release()
+			return
+		}
+
+		if m.control {
+			if m.opcode == wsOpClose && release() != nil {
+				return
+			}
+			if _, err := dst.Write(m.raw); err != nil {
+				return
+			}
+			continue
+		}
+
+		if injectFault(wsDropRate, "ws-drop", target) {
+			log.Warnf("dropping WebSocket message (%s): %s", dir, target)
+			continue
+		}
+		if injectFault(wsDelayRate, "ws-delay", target) {
+			log.Warnf("delaying WebSocket message (%s) by %s: %s", dir, wsDelay, target)
+			time.Sleep(wsDelay)
+		}
+		if held == nil && injectFault(wsReorderRate, "ws-reorder", target) {
+			before = mathrand.Intn(wsReorderWindow) + 1
+			log.Warnf("reordering WebSocket message (%s) after %d messages: %s", dir, before, target)
+			held = m.raw
+			continue
+		}
+
+		if _, err := dst.Write(m.raw); err != nil {
+			return
+		}
+		if held != nil {
+			before--
+			if before == 0 && release() != nil {
+				return
+			}
+		}
+	}
+}